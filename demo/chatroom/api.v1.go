@@ -22,45 +22,59 @@ func APIInstance() rtclib.API {
 	}
 }
 
-func (api *apiv1) listrooms() (int, *map[string]string, interface{}, *map[int]rtclib.RespCode) {
-	api.manager.roomsLock.RLock()
-	defer api.manager.roomsLock.RUnlock()
-
-	ret := map[string][]string{
-		"rooms": make([]string, len(api.manager.rooms)),
+// run f in roomManager goroutine, rooms accessed without lock
+func (api *apiv1) call(f func()) bool {
+	if api.manager == nil {
+		return false
 	}
 
-	i := 0
-	for id := range api.manager.rooms {
-		ret["rooms"][i] = id
-		i++
+	return api.manager.task.Call(f)
+}
+
+func (api *apiv1) listrooms() (int, *map[string]string, interface{}, *map[int]rtclib.RespCode) {
+	ret := map[string][]string{}
+
+	ok := api.call(func() {
+		ret["rooms"] = make([]string, 0, len(api.manager.rooms))
+		for id := range api.manager.rooms {
+			ret["rooms"] = append(ret["rooms"], id)
+		}
+	})
+	if !ok {
+		return 4, nil, "ChatRoom not running", nil
 	}
 
 	return 0, nil, ret, nil
 }
 
 func (api *apiv1) roominfo(roomid string) (int, *map[string]string, interface{}, *map[int]rtclib.RespCode) {
-	api.manager.roomsLock.RLock()
-	defer api.manager.roomsLock.RUnlock()
-
 	ret := map[string]map[string]string{
 		roomid: make(map[string]string),
 	}
 
-	if room, ok := api.manager.rooms[roomid]; ok {
+	var room *room
+	if !api.call(func() { room = api.manager.rooms[roomid] }) {
+		return 4, nil, "ChatRoom not running", nil
+	}
+
+	if room != nil {
+		room.usersLock.RLock()
 		for id, user := range room.users {
 			ret[roomid][id] = user.nickname
 		}
+		room.usersLock.RUnlock()
 	}
 
 	return 0, nil, ret, nil
 }
 
 func (api *apiv1) deluser(roomid string, userid string) (int, *map[string]string, interface{}, *map[int]rtclib.RespCode) {
-	api.manager.roomsLock.RLock()
-	defer api.manager.roomsLock.RUnlock()
+	var room *room
+	if !api.call(func() { room = api.manager.rooms[roomid] }) {
+		return 4, nil, "ChatRoom not running", nil
+	}
 
-	if room, ok := api.manager.rooms[roomid]; ok {
+	if room != nil {
 		room.usersLock.RLock()
 		defer room.usersLock.RUnlock()
 
@@ -9,6 +9,7 @@ package main
 import (
 	"rtclib"
 	"sync"
+	"time"
 )
 
 type ChatRoom struct {
@@ -16,10 +17,13 @@ type ChatRoom struct {
 }
 
 var (
-	once    sync.Once
-	manager *roomManager
+	managerLock sync.Mutex
+	manager     *roomManager
 )
 
+// time for users to quit when SLP unloaded
+const unloadTimeout = 3 * time.Second
+
 func GetInstance(task *rtclib.Task) rtclib.SLP {
 	slp := &ChatRoom{
 		task: task,
@@ -32,13 +36,48 @@ func GetInstance(task *rtclib.Task) rtclib.SLP {
 }
 
 func (slp *ChatRoom) NewSLPCtx() interface{} {
-	once.Do(func() {
+	managerLock.Lock()
+	defer managerLock.Unlock()
+
+	if manager == nil {
 		manager = slp.newRoomManager()
-	})
+	}
 
 	return manager
 }
 
+// kick out all users and stop roomManager
+func (slp *ChatRoom) closeManager(reason string, deadline time.Time) {
+	managerLock.Lock()
+	m := manager
+	manager = nil
+	managerLock.Unlock()
+
+	if m != nil {
+		m.close(reason, deadline)
+	}
+}
+
+func (slp *ChatRoom) OnUnload() {
+	slp.closeManager("Service Unloaded", time.Now().Add(unloadTimeout))
+}
+
+func (slp *ChatRoom) OnReload() error {
+	managerLock.Lock()
+	m := manager
+	managerLock.Unlock()
+
+	if m == nil {
+		return nil
+	}
+
+	return m.reload()
+}
+
+func (slp *ChatRoom) OnShutdown(deadline time.Time) {
+	slp.closeManager("Service Shutdown", deadline)
+}
+
 func (slp *ChatRoom) Process(msg *rtclib.JSIP) {
 	if msg.Type == rtclib.TERM {
 		slp.task.SetFinished()
@@ -54,8 +93,42 @@ func (slp *ChatRoom) Process(msg *rtclib.JSIP) {
 		return
 	}
 
-	m.process(msg)
+	if !m.post(slp.task, msg) {
+		slp.task.LogError("Recv %s but roomManager stopped", msg.Name())
+
+		rtclib.SendMsg(rtclib.JSIPMsgRes(msg, 500))
+	}
 }
 
 func (slp *ChatRoom) OnLoad(msg *rtclib.JSIP) {
 }
+
+// save subscriptions for new version or restart
+func (slp *ChatRoom) Snapshot(store rtclib.StateStore) error {
+	m, _ := slp.task.GetCtx().(*roomManager)
+	if m == nil {
+		return nil
+	}
+
+	return m.snapshot(store)
+}
+
+// rebuild subscriptions saved by old version or before restart
+func (slp *ChatRoom) Restore(store rtclib.StateStore) error {
+	m, _ := slp.task.GetCtx().(*roomManager)
+	if m == nil {
+		return nil
+	}
+
+	return m.restore(store)
+}
+
+// roomManager runs in onload task, receive msgs from other tasks and rooms
+func (slp *ChatRoom) OnEvent(ev *rtclib.TaskEvent) {
+	m, _ := slp.task.GetCtx().(*roomManager)
+	if m == nil || m.task != slp.task {
+		return
+	}
+
+	m.onEvent(ev)
+}
@@ -7,8 +7,9 @@
 package main
 
 import (
+	"encoding/json"
 	"rtclib"
-	"sync"
+	"time"
 
 	"github.com/alexwoo/golib"
 )
@@ -17,81 +18,203 @@ type config struct {
 	Qsize golib.Size `default:"1k"`
 }
 
+// roomManager runs in goroutine of onload task, msgs of rooms and API calls
+// are delivered to onload task as task events, so no lock needed for rooms
 type roomManager struct {
 	task *rtclib.Task
 	conf *config
 
-	msgC chan *rtclib.JSIP
+	rooms map[string]*room
 
-	rooms     map[string]*room
-	roomdel   chan string
-	roomsLock sync.RWMutex // Lock used in roomManager goroutine and API goroutine
+	persisted bool // states saved in store, users not kicked when closed
 }
 
+// subscription saved in state store
+type subscription struct {
+	Room     string `json:"room"`
+	User     string `json:"user"`
+	Nickname string `json:"nickname"`
+	Expire   int64  `json:"expire"` // unix time
+}
+
+// room quit, sent to onload task by room goroutine
+type roomDel string
+
 func (slp *ChatRoom) newRoomManager() *roomManager {
 	m := &roomManager{
 		task:  slp.task,
 		rooms: make(map[string]*room),
 	}
 
-	err := m.loadConfig()
+	conf, err := m.loadConfig()
 	if err != nil {
 		return nil
 	}
-
-	m.msgC = make(chan *rtclib.JSIP, m.conf.Qsize)
-	m.roomdel = make(chan string, m.conf.Qsize)
-
-	go m.loop()
+	m.conf = conf
 
 	return m
 }
 
-func (m *roomManager) loadConfig() error {
+func (m *roomManager) loadConfig() (*config, error) {
 	file := rtclib.FullPath("conf/chatroom/chatroom.conf")
 	pconf := &config{}
 
 	err := golib.JsonConfigFile(file, pconf)
-	if err == nil {
-		m.conf = pconf
-	} else {
+	if err != nil {
 		m.task.LogError("Load Config error: %s", err)
+		return nil, err
 	}
 
-	return err
+	return pconf, nil
 }
 
-func (m *roomManager) process(msg *rtclib.JSIP) {
-	m.msgC <- msg
+// reload config, new config is used by rooms created after reload
+func (m *roomManager) reload() error {
+	conf, err := m.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	m.task.Call(func() { m.conf = conf })
+
+	return nil
+}
+
+// send msg from task to roomManager, return false if roomManager stopped
+func (m *roomManager) post(from *rtclib.Task, msg *rtclib.JSIP) bool {
+	return m.task.Send(from, msg)
 }
 
 func (m *roomManager) delRoom(roomid string) {
-	m.roomdel <- roomid
+	m.task.Send(nil, roomDel(roomid))
 }
 
-func (m *roomManager) loop() {
-	for {
-		select {
-		case msg := <-m.msgC:
-			if msg.Type == rtclib.SUBSCRIBE && msg.Code == 0 {
-				m.processSubscribe(msg)
-			} else if msg.Type == rtclib.MESSAGE && msg.Code == 0 {
-				m.processMessage(msg)
-			} else {
-				if msg.Code == 0 {
-					res := rtclib.JSIPMsgRes(msg, 400)
-					res.SetString("Reason", "Unexpected msg")
-					rtclib.SendMsg(res)
-				}
-
-				m.task.LogError("Process unexpected msg in roomManager %s", msg.String())
+// save subscriptions of all rooms into store, with ttl of subscription
+func (m *roomManager) snapshot(store rtclib.StateStore) error {
+	for _, key := range store.Keys("subscriptions/") {
+		store.Delete(key)
+	}
+
+	now := time.Now()
+	for roomid, r := range m.rooms {
+		r.usersLock.RLock()
+		for userid, u := range r.users {
+			ttl := u.expireTime().Sub(now)
+			if ttl <= 0 {
+				continue
 			}
 
-		case name := <-m.roomdel:
-			m.roomsLock.Lock()
-			delete(m.rooms, name)
-			m.roomsLock.Unlock()
+			data, _ := json.Marshal(&subscription{
+				Room:     roomid,
+				User:     userid,
+				Nickname: u.nickname,
+				Expire:   u.expireTime().Unix(),
+			})
+
+			key := "subscriptions/" + roomid + "/" + userid
+			if err := store.Set(key, data, ttl); err != nil {
+				r.usersLock.RUnlock()
+				return err
+			}
 		}
+		r.usersLock.RUnlock()
+	}
+
+	m.persisted = true
+
+	return nil
+}
+
+// rebuild rooms and subscriptions saved in store
+func (m *roomManager) restore(store rtclib.StateStore) error {
+	now := time.Now()
+	for _, key := range store.Keys("subscriptions/") {
+		data, ok := store.Get(key)
+		if !ok {
+			continue
+		}
+
+		sub := &subscription{}
+		if err := json.Unmarshal(data, sub); err != nil {
+			m.task.LogError("Restore subscription %s failed: %s", key, err)
+			continue
+		}
+
+		remain := time.Unix(sub.Expire, 0).Sub(now)
+		if remain <= 0 {
+			continue
+		}
+		expire := uint64((remain + time.Second - 1) / time.Second)
+
+		r := m.rooms[sub.Room]
+		if r == nil {
+			r = m.newRoom(sub.Room)
+			m.rooms[sub.Room] = r
+		}
+
+		r.usersLock.Lock()
+		r.users[sub.User] = r.newUser(sub.User, sub.Nickname, expire)
+		r.usersLock.Unlock()
+	}
+
+	return nil
+}
+
+// kick all users out of all rooms, wait until all rooms quit or deadline
+// reached
+func (m *roomManager) close(reason string, deadline time.Time) {
+	m.task.Call(func() {
+		// subscriptions restored by new version or after restart
+		if m.persisted {
+			reason = ""
+		}
+
+		for _, r := range m.rooms {
+			r.close(reason)
+		}
+	})
+
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+
+	for time.Now().Before(deadline) {
+		n := 0
+		if !m.task.Call(func() { n = len(m.rooms) }) || n == 0 {
+			break
+		}
+
+		<-t.C
+	}
+}
+
+// process event in onload task goroutine
+func (m *roomManager) onEvent(ev *rtclib.TaskEvent) {
+	if ev.Type != rtclib.TaskMessage {
+		return
+	}
+
+	switch d := ev.Data.(type) {
+	case *rtclib.JSIP:
+		m.process(d)
+
+	case roomDel:
+		delete(m.rooms, string(d))
+	}
+}
+
+func (m *roomManager) process(msg *rtclib.JSIP) {
+	if msg.Type == rtclib.SUBSCRIBE && msg.Code == 0 {
+		m.processSubscribe(msg)
+	} else if msg.Type == rtclib.MESSAGE && msg.Code == 0 {
+		m.processMessage(msg)
+	} else {
+		if msg.Code == 0 {
+			res := rtclib.JSIPMsgRes(msg, 400)
+			res.SetString("Reason", "Unexpected msg")
+			rtclib.SendMsg(res)
+		}
+
+		m.task.LogError("Process unexpected msg in roomManager %s", msg.String())
 	}
 }
 
@@ -120,9 +243,7 @@ func (m *roomManager) processSubscribe(msg *rtclib.JSIP) {
 	}
 
 	roomid := msg.To
-	m.roomsLock.RLock()
 	room := m.rooms[roomid]
-	m.roomsLock.RUnlock()
 
 	if room == nil {
 		if expire == 0 {
@@ -136,10 +257,7 @@ func (m *roomManager) processSubscribe(msg *rtclib.JSIP) {
 		}
 
 		room = m.newRoom(roomid)
-
-		m.roomsLock.Lock()
 		m.rooms[roomid] = room
-		m.roomsLock.Unlock()
 	}
 
 	room.process(msg)
@@ -157,9 +275,7 @@ func (m *roomManager) processMessage(msg *rtclib.JSIP) {
 	}
 
 	roomid := msg.To
-	m.roomsLock.RLock()
 	room := m.rooms[roomid]
-	m.roomsLock.RUnlock()
 
 	if room == nil {
 		res := rtclib.JSIPMsgRes(msg, 404)
@@ -26,17 +26,19 @@ type room struct {
 }
 
 func (m *roomManager) newRoom(roomid string) *room {
+	conf := m.conf
+
 	r := &room{
 		roomid: roomid,
 
 		task:        m.task,
 		roomManager: m,
-		conf:        m.conf,
+		conf:        conf,
 
-		msgC: make(chan *rtclib.JSIP, m.conf.Qsize),
+		msgC: make(chan *rtclib.JSIP, conf.Qsize),
 
 		users:   make(map[string]*user),
-		userdel: make(chan string, m.conf.Qsize),
+		userdel: make(chan string, conf.Qsize),
 	}
 
 	go r.loop()
@@ -52,6 +54,16 @@ func (r *room) delUser(userid string) {
 	r.userdel <- userid
 }
 
+// kick all users out of room, room quit after all users quit
+func (r *room) close(reason string) {
+	r.usersLock.RLock()
+	defer r.usersLock.RUnlock()
+
+	for _, u := range r.users {
+		u.close(reason)
+	}
+}
+
 func (r *room) loop() {
 	defer func() {
 		r.roomManager.delRoom(r.roomid)
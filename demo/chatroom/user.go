@@ -8,6 +8,7 @@ package main
 
 import (
 	"rtclib"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,6 +25,9 @@ type user struct {
 	msgC  chan *rtclib.JSIP
 	res   chan *rtclib.JSIP
 	msgs  map[string]*rtclib.JSIP
+	quit  chan string
+
+	expire int64 // subscription expire time in unix nano, for snapshot
 }
 
 func (r *room) newUser(userid string, nickname string, expire uint64) *user {
@@ -40,7 +44,9 @@ func (r *room) newUser(userid string, nickname string, expire uint64) *user {
 		msgC:  make(chan *rtclib.JSIP, r.conf.Qsize),
 		res:   make(chan *rtclib.JSIP, r.conf.Qsize),
 		msgs:  make(map[string]*rtclib.JSIP),
+		quit:  make(chan string, 1),
 	}
+	u.setExpire(expire)
 
 	go u.loop()
 
@@ -49,6 +55,16 @@ func (r *room) newUser(userid string, nickname string, expire uint64) *user {
 	return u
 }
 
+func (u *user) setExpire(expire uint64) {
+	deadline := time.Now().Add(time.Duration(expire) * time.Second)
+	atomic.StoreInt64(&u.expire, deadline.UnixNano())
+}
+
+// subscription expire time
+func (u *user) expireTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&u.expire))
+}
+
 func (u *user) process(msg *rtclib.JSIP) {
 	u.msgC <- msg
 }
@@ -57,6 +73,25 @@ func (u *user) subscribe(expire uint64) {
 	u.sub <- expire
 }
 
+// kick user out of room, user will receive NOTIFY with reason, or quit
+// quietly if reason is ""
+func (u *user) close(reason string) {
+	select {
+	case u.quit <- reason:
+	default:
+	}
+}
+
+func (u *user) notify(reason string) {
+	dlg := u.task.NewDialogueIDWithEntry(func(*rtclib.JSIP) {})
+
+	m := rtclib.JSIPMsgReq(rtclib.NOTIFY, u.userid, u.room.roomid, u.userid,
+		dlg)
+	m.SetString("Subscription-State", "terminated")
+	m.SetString("Reason", reason)
+	rtclib.SendMsg(m)
+}
+
 func (u *user) result(res *rtclib.JSIP) {
 	if res.Type == rtclib.TERM {
 		return
@@ -102,11 +137,18 @@ func (u *user) loop() {
 				return
 			} else {
 				u.timer.Reset(time.Duration(expire) * time.Second)
+				u.setExpire(expire)
 			}
 
 		case <-u.timer.C:
 			u.task.LogError("Wait for SUBSCRIBE for user(%s) timeout", u.userid)
 			return
+
+		case reason := <-u.quit:
+			if reason != "" {
+				u.notify(reason)
+			}
+			return
 		}
 	}
 }
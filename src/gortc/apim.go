@@ -86,6 +86,7 @@ func (m *apim) Init() error {
 
 func (m *apim) PreMainloop() error {
 	m.addInternalAPI("apim.v1", Apimv1)
+	m.addInternalAPI("metrics.v1", Metricsv1)
 
 	return nil
 }
@@ -46,6 +46,9 @@ type apiServer struct {
 
 var apis *apiServer
 
+var apiLatency = rtclib.NewHistogram("api_request_duration_seconds",
+	"API call latency by api and method", nil, "api", "method")
+
 func apiServerInstance() *apiServer {
 	if apis != nil {
 		return apis
@@ -172,6 +175,15 @@ func (m *apiServer) callAPI(req *http.Request, apiname string, version string,
 }
 
 func (m *apiServer) handler(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+
+	// prometheus scrape path
+	if req.URL.Path == "/metrics" {
+		newResponse(m.callAPI(req, "metrics", "v1", "")).sendResp(w)
+		apiLatency.Since(start, "metrics.v1", req.Method)
+		return
+	}
+
 	ok, apiname, version, paras := m.parseUri(req.URL.Path)
 	if !ok {
 		newResponse(1, nil, nil, nil).sendResp(w)
@@ -179,6 +191,17 @@ func (m *apiServer) handler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	newResponse(m.callAPI(req, apiname, version, paras)).sendResp(w)
+
+	// uri and method are set by client, record API not loaded and method not
+	// supported as unknown to keep labels bounded
+	api, method := apiname+"."+version, req.Method
+	if am.getAPI(api) == nil {
+		api = "unknown"
+	}
+	if method != "GET" && method != "POST" && method != "DELETE" {
+		method = "unknown"
+	}
+	apiLatency.Since(start, api, method)
 }
 
 // for module interface
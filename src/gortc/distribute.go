@@ -7,48 +7,182 @@ package main
 import (
 	"fmt"
 	"rtclib"
+	"sort"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/alexwoo/golib"
 )
 
+// Normal Config
+type distConfig struct {
+	Node           string
+	RouteTable     string `default:"memory"`
+	Peers          string
+	GossipInterval time.Duration `default:"1s"`
+	SyncInterval   time.Duration `default:"30s"`
+	PeerTimeout    time.Duration `default:"3s"`
+	TaskLifetime   time.Duration `default:"0s"`
+	DrainTimeout   time.Duration `default:"300s"`
+	RetryAfter     time.Duration `default:"30s"`
+	Alternate      string
+}
+
+// initial request of task waiting for final response
+type pendingReq struct {
+	task *rtclib.Task
+	cseq uint64
+}
+
 type distribute struct {
-	relLock sync.RWMutex
-	relids  map[string]*rtclib.Task
-	msgC    chan *rtclib.JSIP
-	taskQ   chan *rtclib.Task
-	exit    chan bool
+	config   *distConfig
+	relLock  sync.RWMutex
+	relids   map[string]*rtclib.Task
+	pendLock sync.Mutex
+	pending  map[string]*pendingReq
+	routes   rtclib.RouteTable
+	gossip   *rtclib.GossipRouteTable
+	msgC     chan *rtclib.JSIP
+	taskQ    chan *rtclib.Task
+	exit     chan bool
+
+	drainFlag  int32 // 1 in drain mode
+	drainLock  sync.Mutex
+	drainStart time.Time
+	rejected   uint64
 }
 
 var dist *distribute
 
+var slpTasks = rtclib.NewGauge("slp_tasks", "Active tasks by SLP", "slp")
+
 func distInstance() *distribute {
 	if dist != nil {
 		return dist
 	}
 
 	dist = &distribute{
-		relids: make(map[string]*rtclib.Task),
-		msgC:   make(chan *rtclib.JSIP, 1024),
-		taskQ:  make(chan *rtclib.Task),
-		exit:   make(chan bool),
+		relids:  make(map[string]*rtclib.Task),
+		pending: make(map[string]*pendingReq),
+		msgC:    make(chan *rtclib.JSIP, 1024),
+		taskQ:   make(chan *rtclib.Task),
+		exit:    make(chan bool),
 	}
 
 	return dist
 }
 
-func (m *distribute) State() string {
-	m.relLock.RLock()
-	defer m.relLock.RUnlock()
+func (m *distribute) loadConfig() error {
+	confPath := rtclib.FullPath("conf/gortc.ini")
 
-	ret := "relids:{\n"
-	for k, v := range m.relids {
-		ret += fmt.Sprintf("    %s: %p\n", k, v)
+	config := &distConfig{}
+	err := golib.ConfigFile(confPath, "Distribute", config)
+	if err != nil {
+		return fmt.Errorf("Parse config %s Failed, %s", confPath, err)
 	}
-	ret += "}\n"
+	m.config = config
+
+	return nil
+}
+
+func (m *distribute) initRouteTable() error {
+	switch m.config.RouteTable {
+	case "memory":
+		m.routes = rtclib.NewMemRouteTable()
+	case "gossip":
+		if m.config.Node == "" {
+			return fmt.Errorf("gossip route table configured but node not set")
+		}
+
+		m.gossip = rtclib.NewGossipRouteTable(m.config.Node,
+			m.config.GossipInterval, m.config.SyncInterval)
+		m.gossip.OnError(func(err error) {
+			rtcs.LogError("Gossip route table error: %v", err)
+		})
+
+		for _, peer := range strings.Split(m.config.Peers, ",") {
+			peer = strings.TrimSpace(peer)
+			if peer == "" {
+				continue
+			}
+
+			url := "http://" + peer + "/distribute/v1/routes"
+			m.gossip.AddPeer(rtclib.NewHTTPRoutePeer(url,
+				m.config.PeerTimeout))
+		}
+
+		m.routes = m.gossip
+	default:
+		return fmt.Errorf("Unknown route table %s", m.config.RouteTable)
+	}
+
+	return nil
+}
+
+// route owner of id in cluster, return "" if id is owned by local node
+// or not found
+func (m *distribute) owner(id string) string {
+	if id == "" || m.config.Node == "" {
+		return ""
+	}
+
+	node, ok := m.routes.Get(id)
+	if !ok || node == m.config.Node {
+		return ""
+	}
+
+	return node
+}
+
+func (m *distribute) listRoutes() string {
+	ret := "id		node\n"
+	ret += "------------------------------------------------------------\n"
+	for id, node := range m.routes.Routes() {
+		ret += fmt.Sprintf("%s\t%s\n", id, node)
+	}
+	ret += "------------------------------------------------------------\n"
 
 	return ret
 }
 
+// relid in distribute runtime state
+type relidInfo struct {
+	ID   string `json:"id"`
+	Task string `json:"task"` // task name
+	SLP  string `json:"slp"`  // SLP instance of task
+}
+
+// runtime state of distribute, filter relids by dlg and slp
+func (m *distribute) State(f *rtclib.StateFilter) map[string]interface{} {
+	relids := []*relidInfo{}
+
+	m.relLock.RLock()
+	for id, task := range m.relids {
+		if f.Dlg != "" && !strings.Contains(id, f.Dlg) {
+			continue
+		}
+
+		if f.SLP != "" && f.SLP != task.Name {
+			continue
+		}
+
+		info := &relidInfo{ID: id, Task: task.Name}
+		if task.SLP != nil {
+			info.SLP = fmt.Sprintf("%p", task.SLP)
+		}
+		relids = append(relids, info)
+	}
+	m.relLock.RUnlock()
+
+	sort.Slice(relids, func(i, j int) bool { return relids[i].ID < relids[j].ID })
+	start, end := f.Page(len(relids))
+
+	return map[string]interface{}{
+		"relids": rtclib.StatePage{Total: len(relids), Items: relids[start:end]},
+	}
+}
+
 func (m *distribute) setRelated(id string, task *rtclib.Task) {
 	if id == "" || task == nil {
 		return
@@ -58,6 +192,7 @@ func (m *distribute) setRelated(id string, task *rtclib.Task) {
 	defer m.relLock.Unlock()
 
 	m.relids[id] = task
+	m.routes.Set(id, m.config.Node)
 }
 
 func (m *distribute) getSrvNameByUri(uri string) string {
@@ -76,23 +211,102 @@ func (m *distribute) getSrvNameByUri(uri string) string {
 	return service
 }
 
+// whether uri is realm of this rtc server
+func (m *distribute) registrar(uri string) bool {
+	jsipUri, err := rtclib.NewJSIPUri(uri)
+	if err != nil {
+		return false
+	}
+
+	return jsipUri.Hostport.Host == rtclib.Realm()
+}
+
+// name of SLP which will process new request, for authentication in
+// JSIP Stack, return "" if request belongs to an existing task
+func (m *distribute) slpName(jsip *rtclib.JSIP) string {
+	m.relLock.RLock()
+	task := m.relids[jsip.DialogueID]
+	m.relLock.RUnlock()
+
+	// task on other node in cluster
+	if task != nil || m.owner(jsip.DialogueID) != "" {
+		return ""
+	}
+
+	if len(jsip.Router) == 0 {
+		if jsip.Type == rtclib.REGISTER && m.registrar(jsip.RequestURI) {
+			return "location"
+		}
+
+		return m.getSrvNameByUri(jsip.RequestURI)
+	}
+
+	jsipUri, err := rtclib.NewJSIPUri(jsip.Router[0])
+	if err != nil {
+		return ""
+	}
+
+	if rid, ok := jsipUri.Paras["relid"]; ok && rid != "" {
+		return ""
+	}
+
+	if name, ok := jsipUri.Paras["type"]; ok && name != "" {
+		return name
+	}
+
+	return m.getSrvNameByUri(jsipUri.Hostport.Host)
+}
+
 func (m *distribute) process(jsip *rtclib.JSIP) {
 	dlg := jsip.DialogueID
 
 	// old DialogueID
 	m.relLock.RLock()
 	task := m.relids[dlg]
+	m.relLock.RUnlock()
+
 	if task != nil {
 		if jsip.Type == rtclib.TERM {
-			delete(m.relids, dlg)
+			// relids is read by other goroutines, as auth and state API
+			m.relLock.Lock()
+			if m.relids[dlg] == task {
+				delete(m.relids, dlg)
+				m.routes.Del(dlg)
+			}
+			m.relLock.Unlock()
 		}
-		m.relLock.RUnlock()
 
 		task.OnMsg(jsip)
 
 		return
 	}
-	m.relLock.RUnlock()
+
+	// request to task by relid, in-dialog requests forwarded by other node
+	// in cluster have relid too, so relid is found before checking type
+	var jsipUri *rtclib.JSIPUri
+	if jsip.Code == 0 && jsip.Type != rtclib.TERM && len(jsip.Router) > 0 {
+		var err error
+		jsipUri, err = rtclib.NewJSIPUri(jsip.Router[0])
+		if err != nil {
+			rtcs.LogError("Router[%s] format error, %v", jsip.Router[0], err)
+			rtclib.SendMsg(rtclib.JSIPMsgRes(jsip, 400))
+			return
+		}
+
+		if rid, ok := jsipUri.Paras["relid"]; ok && rid != "" {
+			m.processRelid(jsip, rid)
+			return
+		}
+	}
+
+	// DialogueID owned by other node in cluster, in-dialog requests are
+	// forwarded, responses are not, as transaction is not on this node
+	if jsip.Code == 0 && jsip.Type != rtclib.TERM {
+		if node := m.owner(dlg); node != "" {
+			m.forward(jsip, node, dlg)
+			return
+		}
+	}
 
 	// new request
 
@@ -113,36 +327,21 @@ func (m *distribute) process(jsip *rtclib.JSIP) {
 		return
 	}
 
-	slpname := "default"
+	// REGISTER to this rtc server, processed by location service
+	if jsip.Type == rtclib.REGISTER && len(jsip.Router) == 0 &&
+		m.registrar(jsip.RequestURI) {
 
-	// get relid
-	if len(jsip.Router) > 0 {
-		jsipUri, err := rtclib.NewJSIPUri(jsip.Router[0])
-		if err != nil {
-			rtcs.LogError("Router[%s] format error, %v", jsip.Router[0], err)
-			rtclib.SendMsg(rtclib.JSIPMsgRes(jsip, 400))
+		if m.reject(jsip) {
 			return
 		}
 
-		rid, ok := jsipUri.Paras["relid"]
-		if ok && rid != "" {
-			// If has relid, but cannot find task, task has finished
-			m.relLock.RLock()
-			task = m.relids[rid]
-			m.relLock.RUnlock()
-
-			if task == nil {
-				rtcs.LogError("Cannot find task for slp %s", slpname)
-				rtclib.SendMsg(rtclib.JSIPMsgRes(jsip, 404))
-				return
-			}
-
-			m.setRelated(dlg, task)
+		rtclib.SendMsg(rtclib.LocationInstance().Register(jsip))
+		return
+	}
 
-			task.OnMsg(jsip)
-			return
-		}
+	slpname := "default"
 
+	if jsipUri != nil {
 		name, ok := jsipUri.Paras["type"]
 		if ok && name != "" {
 			slpname = name
@@ -153,50 +352,180 @@ func (m *distribute) process(jsip *rtclib.JSIP) {
 		slpname = m.getSrvNameByUri(jsip.RequestURI)
 	}
 
+	if m.reject(jsip) {
+		return
+	}
+
 	// get task by slpname
-	task = rtclib.NewTask(m.taskQ, m.setRelated, rtcs.log, rtcs.logLevel)
-	task.Name = slpname
-	sm.getSLP(task, SLPPROCESS)
-	if task.SLP == nil {
+	task = m.newTask(slpname, jsip)
+	if task == nil {
 		rtcs.LogError("Cannot find task for slp %s", slpname)
 		rtclib.SendMsg(rtclib.JSIPMsgRes(jsip, 404))
 		return
 	}
 
+	m.pendLock.Lock()
+	m.pending[dlg] = &pendingReq{task: task, cseq: jsip.CSeq}
+	m.pendLock.Unlock()
+
 	m.setRelated(dlg, task)
 
 	task.OnMsg(jsip)
 }
 
+// request with relid in Router, sent to task of relid
+func (m *distribute) processRelid(jsip *rtclib.JSIP, rid string) {
+	m.relLock.RLock()
+	task := m.relids[rid]
+	m.relLock.RUnlock()
+
+	// If has relid, but cannot find task, task has finished
+	if task == nil {
+		// relid owned by other node in cluster
+		if node := m.owner(rid); node != "" {
+			m.forward(jsip, node, rid)
+			return
+		}
+
+		rtcs.LogError("Cannot find task for relid %s", rid)
+		if jsip.Type != rtclib.ACK {
+			rtclib.SendMsg(rtclib.JSIPMsgRes(jsip, 404))
+		}
+		return
+	}
+
+	m.setRelated(jsip.DialogueID, task)
+
+	task.OnMsg(jsip)
+}
+
+// in-dialog request without session in JSIP Stack, relayed if dialogue is
+// owned by other node in cluster, or forwarded by other node with relid
+func (m *distribute) relayed(jsip *rtclib.JSIP) bool {
+	if m.owner(jsip.DialogueID) != "" {
+		return true
+	}
+
+	if len(jsip.Router) == 0 {
+		return false
+	}
+
+	jsipUri, err := rtclib.NewJSIPUri(jsip.Router[0])
+	if err != nil {
+		return false
+	}
+
+	return jsipUri.Paras["relid"] != ""
+}
+
+// create task of SLP slpname, jsip is used to choose version of SLP,
+// return nil if SLP not exist
+func (m *distribute) newTask(slpname string, jsip *rtclib.JSIP) *rtclib.Task {
+	task := rtclib.NewTask(m.taskQ, m.setRelated, rtcs.log, rtcs.logLevel)
+	task.Name = slpname
+	sm.getSLP(task, SLPPROCESS, jsip)
+	if task.SLP == nil {
+		return nil
+	}
+	slpTasks.Add(1, task.Name)
+
+	if m.config.TaskLifetime > 0 {
+		task.SetMaxLifetime(m.config.TaskLifetime)
+	}
+
+	return task
+}
+
+// create task of SLP slpname invoked by SLP in process
+func (m *distribute) invoke(slpname string, parent *rtclib.Task) (
+	*rtclib.Task, error) {
+
+	task := m.newTask(slpname, nil)
+	if task == nil {
+		return nil, fmt.Errorf("SLP %s not exist", slpname)
+	}
+
+	rtcs.LogDebug("SLP %s invoked by %s", slpname, parent.Name)
+
+	return task, nil
+}
+
 func (m *distribute) onMsg(msg *rtclib.JSIP) {
 	m.msgC <- msg
 }
 
+// count final response of initial request for SLP version of task
+func (m *distribute) onResp(msg *rtclib.JSIP) {
+	m.pendLock.Lock()
+	req := m.pending[msg.DialogueID]
+	if req == nil || req.cseq != msg.CSeq {
+		m.pendLock.Unlock()
+		return
+	}
+	delete(m.pending, msg.DialogueID)
+	m.pendLock.Unlock()
+
+	sm.countResp(req.task, msg.Code)
+}
+
 func (m *distribute) delTask(task *rtclib.Task) {
+	slpTasks.Add(-1, task.Name)
+
 	ids := task.GetRelids()
 
+	// task finished without final response
+	m.pendLock.Lock()
+	for _, id := range ids {
+		if req := m.pending[id]; req != nil && req.task == task {
+			delete(m.pending, id)
+			sm.countResp(task, 0)
+		}
+	}
+	m.pendLock.Unlock()
+
+	if task.Panic != nil {
+		sm.crashSLP(task)
+	}
+
+	sm.endSLP(task)
+
 	m.relLock.Lock()
 	defer m.relLock.Unlock()
 
 	for _, id := range ids {
 		delete(m.relids, id)
+		m.routes.Del(id)
 	}
 }
 
 func (m *distribute) PreInit() error {
-	return nil
+	return m.loadConfig()
 }
 
 func (m *distribute) Init() error {
-	return nil
+	return m.initRouteTable()
 }
 
 func (m *distribute) PreMainloop() error {
+	am.addInternalAPI("distribute.v1", Distributev1)
+	am.addInternalAPI("location.v1", Locationv1)
+
 	return nil
 }
 
 func (m *distribute) Mainloop() {
 	rtclib.JStackInstance().SetHandler(m.onMsg)
+	rtclib.JStackInstance().SetAuthFilter(m.slpName)
+	rtclib.JStackInstance().SetRespObserver(m.onResp)
+	rtclib.JStackInstance().SetRelayFilter(m.relayed)
+	rtclib.SetInvoker(m.invoke)
+
+	// sessions established before restart
+	if n := rtclib.JStackInstance().RestoreSessions(); n > 0 {
+		rtcs.LogInfo("Restore %d INVITE sessions", n)
+	}
+
+	go m.watchDrain()
 
 	for {
 		select {
@@ -212,4 +541,6 @@ func (m *distribute) Mainloop() {
 
 func (m *distribute) Exit() {
 	m.exit <- true
+
+	m.routes.Close()
 }
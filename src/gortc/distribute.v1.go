@@ -0,0 +1,64 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+// Distribute V1
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"rtclib"
+)
+
+type DISTRIBUTE_V1 struct {
+}
+
+type routesBody struct {
+	Node   string                `json:"node"`
+	Routes []*rtclib.RouteUpdate `json:"routes"`
+}
+
+func Distributev1() rtclib.API {
+	return &DISTRIBUTE_V1{}
+}
+
+func (api *DISTRIBUTE_V1) Get(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	switch paras {
+	case "routes":
+		return -1, nil, dist.listRoutes(), nil
+	}
+
+	return 3, nil, nil, nil
+}
+
+// Receive route updates pushed by peer node in cluster
+func (api *DISTRIBUTE_V1) Post(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	switch paras {
+	case "routes":
+		if dist.gossip == nil {
+			return 4, nil, nil, nil
+		}
+
+		body := &routesBody{}
+		if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+			rtcs.LogError("Decode routes from peer failed, %v", err)
+			return 4, nil, nil, nil
+		}
+
+		dist.gossip.Push(body.Node, body.Routes)
+
+		return 0, nil, nil, nil
+	}
+
+	return 3, nil, nil, nil
+}
+
+func (api *DISTRIBUTE_V1) Delete(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	return 2, nil, nil, nil
+}
@@ -0,0 +1,159 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+// drain mode before shutdown, new websocket and out-of-dialog requests are
+// rejected, existing dialogues are served until they end or drain timeout,
+// then gortc quits gracefully
+
+package main
+
+import (
+	"net/http"
+	"os"
+	sig "os/signal"
+	"rtclib"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// interval for checking whether existing dialogues end
+const drainCheckInterval = time.Second
+
+// drain progress
+type drainState struct {
+	Draining  bool    `json:"draining"`
+	Elapsed   float64 `json:"elapsed"`   // seconds since drain started
+	Remaining float64 `json:"remaining"` // seconds until drain timeout
+	Tasks     int     `json:"tasks"`     // tasks serving dialogues
+	Dialogues int     `json:"dialogues"` // DialogueIDs and relids of tasks
+	Sessions  int     `json:"sessions"`  // INVITE sessions in JSIP stack
+	Rejected  uint64  `json:"rejected"`  // requests and websockets rejected
+}
+
+func (m *distribute) draining() bool {
+	return atomic.LoadInt32(&m.drainFlag) == 1
+}
+
+// Start drain, return false if already draining
+func (m *distribute) drain() bool {
+	if !atomic.CompareAndSwapInt32(&m.drainFlag, 0, 1) {
+		return false
+	}
+
+	m.drainLock.Lock()
+	m.drainStart = time.Now()
+	m.drainLock.Unlock()
+
+	rtcs.LogInfo("Drain start, timeout %s", m.config.DrainTimeout)
+
+	go m.drainLoop()
+
+	return true
+}
+
+// wait for existing dialogues end or drain timeout, then quit gracefully
+func (m *distribute) drainLoop() {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		state := m.drainState()
+
+		if state.Tasks == 0 && state.Sessions == 0 {
+			rtcs.LogInfo("Drain finished, rejected %d", state.Rejected)
+			break
+		}
+
+		if state.Remaining <= 0 {
+			rtcs.LogError("Drain timeout, %d tasks and %d sessions remain",
+				state.Tasks, state.Sessions)
+			break
+		}
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGINT)
+}
+
+func (m *distribute) drainState() *drainState {
+	state := &drainState{
+		Draining: m.draining(),
+		Rejected: atomic.LoadUint64(&m.rejected),
+	}
+
+	if state.Draining {
+		m.drainLock.Lock()
+		start := m.drainStart
+		m.drainLock.Unlock()
+
+		state.Elapsed = time.Since(start).Seconds()
+		state.Remaining = (m.config.DrainTimeout - time.Since(start)).Seconds()
+		if state.Remaining < 0 {
+			state.Remaining = 0
+		}
+	}
+
+	tasks := make(map[*rtclib.Task]bool)
+	m.relLock.RLock()
+	for _, task := range m.relids {
+		tasks[task] = true
+	}
+	state.Dialogues = len(m.relids)
+	m.relLock.RUnlock()
+	state.Tasks = len(tasks)
+
+	jstack := rtclib.JStackInstance().State(&rtclib.StateFilter{Limit: 1})
+	state.Sessions = jstack.Sessions.Total
+
+	return state
+}
+
+// Retry-After in seconds for requests rejected in drain mode
+func (m *distribute) retryAfter() uint64 {
+	return uint64(m.config.RetryAfter.Seconds())
+}
+
+// reject new out-of-dialog request with 503 in drain mode, return true if
+// rejected
+func (m *distribute) reject(jsip *rtclib.JSIP) bool {
+	if !m.draining() {
+		return false
+	}
+
+	atomic.AddUint64(&m.rejected, 1)
+
+	resp := rtclib.JSIPMsgRes(jsip, 503)
+	resp.SetUint("Retry-After", m.retryAfter())
+	if m.config.Alternate != "" {
+		resp.SetString("Router", m.config.Alternate)
+	}
+	rtclib.SendMsg(resp)
+
+	return true
+}
+
+// reject new websocket with 503 in drain mode, return true if rejected
+func (m *distribute) rejectConn(w http.ResponseWriter) bool {
+	if !m.draining() {
+		return false
+	}
+
+	atomic.AddUint64(&m.rejected, 1)
+
+	w.Header().Set("Retry-After", strconv.FormatUint(m.retryAfter(), 10))
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	return true
+}
+
+// drain triggered by SIGUSR2
+func (m *distribute) watchDrain() {
+	c := make(chan os.Signal, 1)
+	sig.Notify(c, syscall.SIGUSR2)
+
+	for range c {
+		if !m.drain() {
+			rtcs.LogInfo("Drain already started")
+		}
+	}
+}
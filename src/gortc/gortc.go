@@ -24,11 +24,12 @@ func usage() {
 	fmt.Printf("usage: %s -h\n", os.Args[0])
 	fmt.Printf("usage: %s [-d]\n", os.Args[0])
 	fmt.Printf("    -d    start backgroud\n")
-	fmt.Printf("    -s quit|stop|reopen|reload\n")
+	fmt.Printf("    -s quit|stop|reopen|reload|drain\n")
 	fmt.Printf("          quit: gortc quit directly\n")
 	fmt.Printf("          stop: gortc quit gracefully\n")
 	fmt.Printf("          reopen: gortc reopen logs\n")
 	fmt.Printf("          reload: gortc reload config\n")
+	fmt.Printf("          drain: gortc quit after existing dialogues end\n")
 	os.Exit(1)
 }
 
@@ -75,6 +76,8 @@ func signal(cmd string) {
 		syscall.Kill(pid, syscall.SIGUSR1)
 	case "reload":
 		syscall.Kill(pid, syscall.SIGHUP)
+	case "drain":
+		syscall.Kill(pid, syscall.SIGUSR2)
 	default:
 		fmt.Println("Unknown command for gortc -s", cmd)
 		os.Exit(-1)
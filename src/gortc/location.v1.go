@@ -0,0 +1,45 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+// Location V1
+
+package main
+
+import (
+	"net/http"
+	"rtclib"
+)
+
+type LOCATION_V1 struct {
+}
+
+func Locationv1() rtclib.API {
+	return &LOCATION_V1{}
+}
+
+func (api *LOCATION_V1) Get(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	switch paras {
+	case "bindings":
+		return -1, nil, rtclib.LocationInstance().State(), nil
+	}
+
+	return 3, nil, nil, nil
+}
+
+func (api *LOCATION_V1) Post(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	return 2, nil, nil, nil
+}
+
+// Kick binding of userid
+func (api *LOCATION_V1) Delete(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	if !rtclib.LocationInstance().Kick(paras) {
+		return -1, nil, "Binding " + paras + " not exist\n", nil
+	}
+
+	return -1, nil, "Kick binding " + paras + " successd\n", nil
+}
@@ -0,0 +1,40 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+// Metrics V1
+
+package main
+
+import (
+	"net/http"
+	"rtclib"
+)
+
+type METRICS_V1 struct {
+}
+
+func Metricsv1() rtclib.API {
+	return &METRICS_V1{}
+}
+
+// metrics in prometheus text format
+func (api *METRICS_V1) Get(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	headers := map[string]string{
+		"Content-Type": "text/plain; version=0.0.4; charset=utf-8",
+	}
+
+	return -1, &headers, rtclib.Metrics(), nil
+}
+
+func (api *METRICS_V1) Post(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	return 2, nil, nil, nil
+}
+
+func (api *METRICS_V1) Delete(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	return 2, nil, nil, nil
+}
@@ -0,0 +1,119 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+// relay for forwarding dialogue to other gortc node in cluster
+
+package main
+
+import (
+	"rtclib"
+	"strconv"
+)
+
+type relay struct {
+	task   *rtclib.Task
+	in     string // DialogueID received from peer
+	out    string // DialogueID sent to owner node
+	router string // Router to owner node
+	terms  int
+
+	// forwarded request transaction id -> original request
+	reqs map[string]*rtclib.JSIP
+	// original request CSeq -> forwarded request CSeq, for RelatedID
+	cseqs map[uint64]uint64
+}
+
+func relayTransID(dlg string, cseq uint64) string {
+	return dlg + ":" + strconv.FormatUint(cseq, 10)
+}
+
+// forward request to node in cluster which owns id (relid or DialogueID),
+// a relay task will be created for the dialogue,
+// owner node will use id as relid to find the task
+func (m *distribute) forward(jsip *rtclib.JSIP, node string, id string) {
+	task := rtclib.NewTask(m.taskQ, m.setRelated, rtcs.log, rtcs.logLevel)
+	task.Name = "relay"
+	task.TermNotify = true
+	slpTasks.Add(1, task.Name)
+
+	r := &relay{
+		task:   task,
+		in:     jsip.DialogueID,
+		router: node + ";relid=" + id,
+		reqs:   make(map[string]*rtclib.JSIP),
+		cseqs:  make(map[uint64]uint64),
+	}
+	task.Process = r.process
+	r.out = task.NewDialogueID()
+
+	rtcs.LogInfo("Forward %s to node %s for %s", jsip.Name(), node, id)
+
+	m.setRelated(r.in, task)
+
+	task.OnMsg(jsip)
+}
+
+func (r *relay) process(msg *rtclib.JSIP) {
+	if msg.Type == rtclib.TERM {
+		r.terms++
+		if r.terms >= 2 {
+			r.task.SetFinished()
+		}
+
+		return
+	}
+
+	peer := r.out
+	if msg.DialogueID == r.out {
+		peer = r.in
+	}
+
+	if msg.Code == 0 {
+		r.request(msg, peer)
+	} else {
+		r.response(msg)
+	}
+}
+
+func (r *relay) request(msg *rtclib.JSIP, peer string) {
+	req := rtclib.JSIPMsgClone(msg, peer)
+
+	if peer == r.out {
+		req.Router = []string{r.router}
+		if len(msg.Router) > 1 {
+			req.Router = append(req.Router, msg.Router[1:]...)
+		}
+	} else {
+		req.Router = []string{}
+	}
+
+	if relatedid, ok := msg.GetUint("RelatedID"); ok {
+		if cseq, ok := r.cseqs[relatedid]; ok {
+			req.SetUint("RelatedID", cseq)
+		}
+	}
+
+	if msg.Type != rtclib.ACK {
+		r.reqs[relayTransID(peer, req.CSeq)] = msg
+	}
+	r.cseqs[msg.CSeq] = req.CSeq
+
+	rtclib.SendMsg(req)
+}
+
+func (r *relay) response(msg *rtclib.JSIP) {
+	tid := relayTransID(msg.DialogueID, msg.CSeq)
+	req := r.reqs[tid]
+	if req == nil {
+		r.task.LogError("Relay %s but request not found", msg.Name())
+		return
+	}
+
+	if rtclib.JSIPRespType(msg.Code) > rtclib.JSIPProvisionalResp {
+		delete(r.reqs, tid)
+	}
+
+	res := rtclib.JSIPMsgClone(msg, req.DialogueID)
+	res.CSeq = req.CSeq
+
+	rtclib.SendMsg(res)
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -18,13 +19,19 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+var rtcConns = rtclib.NewGauge("rtc_connections",
+	"Websocket connections by subprotocol", "protocol")
+
 // Normal Config
 type rtcConfig struct {
-	Listen    string
-	TlsListen string
-	Location  string `default:"/rtc"`
-	Cert      string
-	Key       string
+	Listen       string
+	TlsListen    string
+	TcpListen    string
+	TcpTlsListen string
+	UdpListen    string
+	Location     string `default:"/rtc"`
+	Cert         string
+	Key          string
 }
 
 // Dynamic Config which can be reload
@@ -46,6 +53,7 @@ type rtcServer struct {
 	logLevel  int
 	server    *golib.HTTPServer
 	tlsServer *golib.HTTPServer
+	listeners map[string]rtclib.TransportListener
 	nServers  uint
 
 	taskQ chan *rtclib.Task
@@ -146,11 +154,40 @@ func (m *rtcServer) wsCheckOrigin(r *http.Request) bool {
 }
 
 func (m *rtcServer) handler(w http.ResponseWriter, req *http.Request) {
+	if dist.rejectConn(w) {
+		m.LogInfo("Reject websocket from %s in drain mode", req.RemoteAddr)
+		return
+	}
+
+	// SIP over WebSocket, RFC 7118
+	sip := false
+	for _, p := range websocket.Subprotocols(req) {
+		if p == "sip" {
+			sip = true
+			break
+		}
+	}
+
+	// JSIP encoding, first subprotocol supported in client preferred order
+	subproto := ""
+	if !sip {
+		for _, p := range websocket.Subprotocols(req) {
+			if rtclib.IsJSIPSubprotocol(p) {
+				subproto = p
+				break
+			}
+		}
+	}
+
 	userid := req.URL.Query().Get("userid")
 	if userid == "" {
-		m.LogError("Miss userid")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		if !sip {
+			m.LogError("Miss userid")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userid = req.RemoteAddr
 	}
 
 	upgrader := websocket.Upgrader{
@@ -159,16 +196,73 @@ func (m *rtcServer) handler(w http.ResponseWriter, req *http.Request) {
 		CheckOrigin:     m.wsCheckOrigin,
 	}
 
+	if sip {
+		upgrader.Subprotocols = []string{"sip"}
+	} else if subproto != "" {
+		upgrader.Subprotocols = []string{subproto}
+	}
+
 	c, err := upgrader.Upgrade(w, req, nil)
 	if err != nil {
 		m.LogError("Create Websocket server failed, %v", err)
 		return
 	}
 
-	conn := golib.NewWSServer(userid, c, m.dconfig.Qsize, rtclib.RecvMsg,
-		m.log, m.logLevel)
+	if sip {
+		sipc := rtclib.NewSIPConn(userid, req.TLS != nil, m.log, m.logLevel)
+		conn := golib.NewWSServer(userid, c, m.dconfig.Qsize, sipc.RecvMsg,
+			m.log, m.logLevel)
+		sipc.SetConn(conn)
+
+		rtcConns.Add(1, "sip")
+		conn.Accept()
+		rtcConns.Add(-1, "sip")
+		rtclib.LocationInstance().Unbind(sipc)
+		return
+	}
+
+	var conn rtclib.WSServerConn
+	if rtclib.IsJSIPBinarySubprotocol(subproto) {
+		conn = rtclib.NewWSServerConn(userid, c, &rtclib.TransportOpts{
+			Qsize:    m.dconfig.Qsize,
+			Handler:  rtclib.RecvMsg,
+			Log:      m.log,
+			LogLevel: m.logLevel,
+		})
+	} else {
+		conn = golib.NewWSServer(userid, c, m.dconfig.Qsize, rtclib.RecvMsg,
+			m.log, m.logLevel)
+	}
 
+	// Accept returns when websocket closed
+	rtclib.AddUser(userid, conn)
+	rtcConns.Add(1, "jsip")
 	conn.Accept()
+	rtcConns.Add(-1, "jsip")
+	rtclib.DelUser(userid, conn)
+}
+
+func (m *rtcServer) transportListen(name string, addr string,
+	config *tls.Config) error {
+
+	opts := &rtclib.TransportOpts{
+		Qsize:    m.dconfig.Qsize,
+		TLS:      config,
+		Handler:  rtclib.RecvMsg,
+		Log:      m.log,
+		LogLevel: m.logLevel,
+	}
+
+	l, err := rtclib.GetTransport(name).Listen(addr, opts)
+	if err != nil {
+		return fmt.Errorf("New %s listener error: %s", name, err)
+	}
+
+	m.listeners[name] = l
+
+	m.nServers++
+
+	return nil
 }
 
 // for module interface
@@ -187,6 +281,19 @@ func (m *rtcServer) PreInit() error {
 	}
 
 	rtclib.JStackInstance().SetLog(m.log, m.logLevel)
+	golib.AddReloader("jsipstack", rtclib.JStackInstance())
+
+	loc := rtclib.LocationInstance()
+	if loc == nil {
+		return fmt.Errorf("Location service init failed")
+	}
+	loc.SetLog(m.log, m.logLevel)
+
+	tracer := rtclib.TracerInstance()
+	if tracer == nil {
+		return fmt.Errorf("JSIP tracer init failed")
+	}
+	tracer.SetLog(m.log, m.logLevel)
 
 	golib.AddReloader("rtcserver", m)
 
@@ -195,6 +302,7 @@ func (m *rtcServer) PreInit() error {
 
 func (m *rtcServer) Init() error {
 	m.taskQ = make(chan *rtclib.Task, 1024)
+	m.listeners = make(map[string]rtclib.TransportListener)
 
 	accessFile := rtclib.FullPath(m.dconfig.AccessFile)
 
@@ -211,7 +319,7 @@ func (m *rtcServer) Init() error {
 		m.nServers++
 	}
 
-	if m.config.TlsListen != "" {
+	if m.config.TlsListen != "" || m.config.TcpTlsListen != "" {
 		if m.config.Cert == "" || m.config.Key == "" {
 			return fmt.Errorf("TLS cert(%s) or key(%s) file configured error",
 				m.config.Cert, m.config.Key)
@@ -219,7 +327,9 @@ func (m *rtcServer) Init() error {
 
 		m.config.Cert = rtclib.FullPath("certs/" + m.config.Cert)
 		m.config.Key = rtclib.FullPath("certs/" + m.config.Key)
+	}
 
+	if m.config.TlsListen != "" {
 		s, err := golib.NewHTTPServer(m.config.TlsListen, m.config.Cert,
 			m.config.Key, m.config.Location, m.dconfig.ClientHeaderTimeout,
 			m.dconfig.Keepalived, m.log, m.handler, accessFile)
@@ -232,10 +342,41 @@ func (m *rtcServer) Init() error {
 		m.nServers++
 	}
 
+	if m.config.TcpListen != "" {
+		if err := m.transportListen("tcp", m.config.TcpListen, nil); err != nil {
+			return err
+		}
+	}
+
+	if m.config.TcpTlsListen != "" {
+		cert, err := tls.LoadX509KeyPair(m.config.Cert, m.config.Key)
+		if err != nil {
+			return fmt.Errorf("Load TLS cert(%s) or key(%s) error: %s",
+				m.config.Cert, m.config.Key, err)
+		}
+
+		config := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+
+		err = m.transportListen("tls", m.config.TcpTlsListen, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.config.UdpListen != "" {
+		if err := m.transportListen("udp", m.config.UdpListen, nil); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (m *rtcServer) PreMainloop() error {
+	am.addInternalAPI("trace.v1", Tracev1)
+
 	return nil
 }
 
@@ -292,6 +433,18 @@ func (m *rtcServer) Mainloop() {
 		}()
 	}
 
+	for name, l := range m.listeners {
+		m.LogInfo("rtc %s listener start ...", name)
+		go func(name string, l rtclib.TransportListener) {
+			if err := l.Serve(); err != nil {
+				m.LogError("rtc %s listener failure, %s", name, err)
+			} else {
+				m.LogError("rtc %s listener close", name)
+			}
+			quit <- true
+		}(name, l)
+	}
+
 	for {
 		<-quit
 		m.nServers--
@@ -324,6 +477,11 @@ func (m *rtcServer) Exit() {
 		m.LogInfo("closing rtc tlsserver ...")
 		m.tlsServer.Close()
 	}
+
+	for name, l := range m.listeners {
+		m.LogInfo("closing rtc %s listener ...", name)
+		l.Close()
+	}
 }
 
 // for log ctx
@@ -10,6 +10,10 @@ import (
 	"runtime"
 )
 
+var runtimeCode = map[int]rtclib.RespCode{
+	10: {Status: 400, Msg: "Invalid offset or limit"},
+}
+
 type RUNTIME_V1 struct {
 }
 
@@ -40,17 +44,34 @@ func (api *RUNTIME_V1) Get(req *http.Request, paras string) (int,
 	case "stack": // GO Stack
 		return -1, nil, stack(), nil
 	case "jstack": // JSIP Stack
-		return -1, nil, rtclib.JStackInstance().State(), nil
+		f, err := rtclib.ParseStateFilter(req.URL.Query())
+		if err != nil {
+			return 10, nil, nil, &runtimeCode
+		}
+		return 0, nil, *rtclib.JStackInstance().State(f), nil
 	case "distribute": // Distribute Stack
-		return -1, nil, dist.State(), nil
+		f, err := rtclib.ParseStateFilter(req.URL.Query())
+		if err != nil {
+			return 10, nil, nil, &runtimeCode
+		}
+		return 0, nil, dist.State(f), nil
+	case "drain": // Drain progress
+		return 0, nil, *dist.drainState(), nil
 	}
 	return 3, nil, nil, nil
 }
 
+// Start drain before shutdown
 func (api *RUNTIME_V1) Post(req *http.Request, paras string) (int,
 	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
 
-	return 2, nil, nil, nil
+	if paras != "drain" {
+		return 3, nil, nil, nil
+	}
+
+	dist.drain()
+
+	return 0, nil, *dist.drainState(), nil
 }
 
 func (api *RUNTIME_V1) Delete(req *http.Request, paras string) (int,
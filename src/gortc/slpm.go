@@ -7,12 +7,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"plugin"
 	"rtclib"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/alexwoo/golib"
 	"github.com/tidwall/gjson"
 )
 
@@ -21,23 +28,85 @@ const (
 	SLPPROCESS
 )
 
+// Normal Config
+type slpmConfig struct {
+	DrainTimeout    time.Duration `default:"300s"`
+	ShutdownTimeout time.Duration `default:"3s"`
+	MaxCrashes      uint64        `default:"0"`
+	StateStore      string        `default:"file"`
+	StateFile       string        `default:"data/slpstate.db"`
+}
+
+// max weight of SLP version, sum of weights must not overflow
+const maxSLPWeight = 10000
+
+// version of SLP saved in conf/.slps
+type slpVersionConf struct {
+	File   string   `json:"file"`
+	Weight uint64   `json:"weight"`
+	Match  []string `json:"match,omitempty"`
+}
+
+// match rule for choosing version of SLP for new task
+type slpMatch func(jsip *rtclib.JSIP) bool
+
+// one version of SLP loaded from plugin file
 type slpPlugin struct {
 	name     string
+	version  uint64
 	used     uint64
 	using    uint64
 	file     string
 	time     time.Time
 	ctx      interface{}
 	instance func(task *rtclib.Task) rtclib.SLP
+
+	// route of new tasks
+	weight  uint64
+	match   []string
+	matches []slpMatch
+
+	// final responses of initial requests of tasks
+	success uint64
+	errors  uint64
+	crashes uint64 // tasks crashed by panic
+
+	onload   *rtclib.Task // task created when SLP loaded
+	slp      rtclib.SLP   // SLP instance created when SLP loaded, for hooks
+	draining bool
+	disabled bool // draining for crashing too many times
+	retired  bool
+	deadline time.Time // force terminate tasks after deadline when draining
+}
+
+// versions of SLP with same name, new tasks use active versions, by match
+// rules first, then by weight, others are draining, and retired once no task
+// using or deadline reached
+type slpSlot struct {
+	name     string
+	version  uint64 // last version loaded
+	active   []*slpPlugin
+	versions []*slpPlugin
 }
 
 type slpm struct {
-	slps    map[string]*slpPlugin
+	config  *slpmConfig
+	store   rtclib.StateStore
+	lock    sync.Mutex
+	slps    map[string]*slpSlot
+	tasks   map[*rtclib.Task]*slpPlugin
 	slpconf string
 	slpdir  string
-	plugins map[string]string
+	exit    chan bool
 }
 
+var slpResps = rtclib.NewCounter("slp_responses_total",
+	"Final responses of initial requests by SLP version", "slp", "version",
+	"result")
+
+var slpCrashes = rtclib.NewCounter("slp_crashes_total",
+	"Tasks crashed by panic by SLP version", "slp", "version")
+
 var sm *slpm
 
 func slpmInstance() *slpm {
@@ -46,20 +115,68 @@ func slpmInstance() *slpm {
 	}
 
 	sm = &slpm{
-		slps:    make(map[string]*slpPlugin),
-		plugins: make(map[string]string),
+		slps:  make(map[string]*slpSlot),
+		tasks: make(map[*rtclib.Task]*slpPlugin),
+		exit:  make(chan bool),
 	}
 
 	return sm
 }
 
+func (m *slpm) loadConfig() error {
+	confPath := rtclib.FullPath("conf/gortc.ini")
+
+	config := &slpmConfig{}
+	err := golib.ConfigFile(confPath, "SLPM", config)
+	if err != nil {
+		return fmt.Errorf("Parse config %s Failed, %s", confPath, err)
+	}
+
+	m.lock.Lock()
+	m.config = config
+	m.lock.Unlock()
+
+	return nil
+}
+
 // for module interface
 
 func (m *slpm) PreInit() error {
+	if err := m.loadConfig(); err != nil {
+		return err
+	}
+
+	golib.AddReloader("slpmanager", m)
+
+	return nil
+}
+
+func (m *slpm) initStore() error {
+	switch m.config.StateStore {
+	case "memory":
+		m.store = rtclib.NewMemoryStore()
+	case "file":
+		path := rtclib.FullPath(m.config.StateFile)
+		store, err := rtclib.NewFileStore(path)
+		if err != nil {
+			return fmt.Errorf("open state store %s failed: %v", path, err)
+		}
+		m.store = store
+	default:
+		return fmt.Errorf("unknown state store %s", m.config.StateStore)
+	}
+
+	rtclib.SetStateStore(m.store)
+
 	return nil
 }
 
 func (m *slpm) Init() error {
+	// states restored when SLPs loaded
+	if err := m.initStore(); err != nil {
+		return err
+	}
+
 	m.slpconf = rtclib.FullPath("conf/.slps")
 	m.slpdir = rtclib.FullPath("plugins/")
 
@@ -80,21 +197,45 @@ func (m *slpm) Init() error {
 	}
 
 	for name, v := range j {
-		path, ok := v.(string)
-		if !ok {
+		confs, err := parseSLPConf(v)
+		if err != nil {
 			return fmt.Errorf("slp %s format error: %v", name, err)
 		}
 
-		if err := m.slpLoad(name, path); err != nil {
-			return err
+		for _, conf := range confs {
+			if err := m.slpLoad(name, conf, false); err != nil {
+				return err
+			}
 		}
-		m.plugins[name] = path
 	}
 
 	return nil
 
 }
 
+// SLP in conf/.slps is plugin file, or list of versions
+func parseSLPConf(v interface{}) ([]*slpVersionConf, error) {
+	if file, ok := v.(string); ok {
+		return []*slpVersionConf{{File: file, Weight: 100}}, nil
+	}
+
+	d, _ := json.Marshal(v)
+
+	confs := []*slpVersionConf{}
+	if err := json.Unmarshal(d, &confs); err != nil {
+		return nil, err
+	}
+
+	for _, conf := range confs {
+		if conf.Weight > maxSLPWeight {
+			return nil, fmt.Errorf("weight %d of %s out of range 0-%d",
+				conf.Weight, conf.File, maxSLPWeight)
+		}
+	}
+
+	return confs, nil
+}
+
 func (m *slpm) PreMainloop() error {
 	am.addInternalAPI("slpm.v1", Slpmv1)
 
@@ -102,21 +243,186 @@ func (m *slpm) PreMainloop() error {
 }
 
 func (m *slpm) Mainloop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			m.checkDeadline(now)
+		case <-m.exit:
+			return
+		}
+	}
+}
+
+// notify all versions of SLPs to reload config
+func (m *slpm) Reload() error {
+	if err := m.loadConfig(); err != nil {
+		return err
+	}
+
+	var ret error
+	for _, p := range m.plugins() {
+		r, ok := p.slp.(rtclib.SLPReloader)
+		if !ok {
+			continue
+		}
+
+		if err := r.OnReload(); err != nil {
+			rtcs.LogError("SLP %s version %d reload failed: %v", p.name,
+				p.version, err)
+			if ret == nil {
+				ret = fmt.Errorf("SLP %s version %d reload failed: %v", p.name,
+					p.version, err)
+			}
+		}
+	}
+
+	return ret
 }
 
+// notify all versions of SLPs to finish before deadline, wait until all
+// finished or deadline reached
 func (m *slpm) Exit() {
+	m.lock.Lock()
+	deadline := time.Now().Add(m.config.ShutdownTimeout)
+	tasks := make([]*rtclib.Task, 0, len(m.tasks))
+	for t := range m.tasks {
+		tasks = append(tasks, t)
+	}
+	m.lock.Unlock()
+
+	// save states for restart before SLPs finish
+	for _, p := range m.actives("") {
+		m.snapshot(p)
+	}
+
+	// notify tasks implement rtclib.SLPEventHandler
+	go func() {
+		for _, t := range tasks {
+			t.OnEvent(&rtclib.TaskEvent{
+				Type:     rtclib.TaskShutdown,
+				Deadline: deadline,
+			})
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	for _, p := range m.plugins() {
+		s, ok := p.slp.(rtclib.SLPShutdowner)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *slpPlugin) {
+			defer wg.Done()
+
+			s.OnShutdown(deadline)
+			rtcs.LogInfo("SLP %s version %d shutdown", p.name, p.version)
+		}(p)
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		rtcs.LogError("SLP shutdown timeout")
+	}
+
+	if err := m.store.Close(); err != nil {
+		rtcs.LogError("close state store failed: %v", err)
+	}
+
+	m.exit <- true
+}
+
+// active versions of SLP name, or of all SLPs if name is ""
+func (m *slpm) actives(name string) []*slpPlugin {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ps := []*slpPlugin{}
+	for _, slot := range m.slps {
+		if name == "" || slot.name == name {
+			ps = append(ps, slot.active...)
+		}
+	}
+
+	return ps
+}
+
+// SLP version save states into state store, in goroutine of onload task
+func (m *slpm) snapshot(p *slpPlugin) {
+	s, ok := p.slp.(rtclib.SLPSnapshotter)
+	if !ok {
+		return
+	}
+
+	m.lock.Lock()
+	onload := p.onload
+	m.lock.Unlock()
+
+	var err error
+	store := rtclib.SLPStore(p.name)
+	f := func() { err = s.Snapshot(store) }
+
+	// onload task finished, SLP not running in it
+	if onload == nil || !onload.Call(f) {
+		f()
+	}
+
+	if err != nil {
+		rtcs.LogError("SLP %s version %d snapshot failed: %v", p.name,
+			p.version, err)
+		return
+	}
+
+	rtcs.LogInfo("SLP %s version %d snapshot", p.name, p.version)
+}
+
+// all versions of SLPs loaded, active and draining
+func (m *slpm) plugins() []*slpPlugin {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ps := []*slpPlugin{}
+	for _, slot := range m.slps {
+		ps = append(ps, slot.versions...)
+	}
+
+	return ps
 }
 
 // internal interface
 
 func (m *slpm) updateSLPFile() error {
+	m.lock.Lock()
+	plugins := make(map[string][]*slpVersionConf)
+	for name, slot := range m.slps {
+		for _, p := range slot.active {
+			plugins[name] = append(plugins[name], &slpVersionConf{
+				File:   p.file,
+				Weight: p.weight,
+				Match:  p.match,
+			})
+		}
+	}
+	m.lock.Unlock()
+
 	f, err := os.OpenFile(m.slpconf, os.O_TRUNC|os.O_WRONLY, 0644)
 	defer f.Close()
 	if err != nil {
 		return fmt.Errorf("open file %s failed: %v", m.slpconf, err)
 	}
 
-	d, _ := json.Marshal(m.plugins)
+	d, _ := json.Marshal(plugins)
 
 	_, err = f.Write(d)
 	if err != nil {
@@ -126,20 +432,157 @@ func (m *slpm) updateSLPFile() error {
 	return nil
 }
 
-func (m *slpm) slpLoad(name string, slpFile string) error {
-	slp := &slpPlugin{
+// match rules:
+//
+//	userid:lo-hi       crc32 of Userid or user of From mod 100 in [lo, hi]
+//	domain:host        host of From is host
+//	header:name=value  JSIP header name is value
+func parseSLPMatch(rule string) (slpMatch, error) {
+	split := strings.SplitN(rule, ":", 2)
+	if len(split) != 2 || split[1] == "" {
+		return nil, fmt.Errorf("invalid match rule %s", rule)
+	}
+
+	switch split[0] {
+	case "userid":
+		var lo, hi uint32
+		n, err := fmt.Sscanf(split[1], "%d-%d", &lo, &hi)
+		if err != nil || n != 2 || lo > hi || hi > 99 {
+			return nil, fmt.Errorf("invalid userid range %s", split[1])
+		}
+
+		return func(jsip *rtclib.JSIP) bool {
+			userid := jsip.Userid
+			if userid == "" {
+				from, err := rtclib.NewJSIPUri(jsip.From)
+				if err != nil {
+					return false
+				}
+				userid = from.User
+			}
+
+			bucket := crc32.ChecksumIEEE([]byte(userid)) % 100
+
+			return bucket >= lo && bucket <= hi
+		}, nil
+	case "domain":
+		domain := split[1]
+
+		return func(jsip *rtclib.JSIP) bool {
+			from, err := rtclib.NewJSIPUri(jsip.From)
+			if err != nil {
+				return false
+			}
+
+			return from.Hostport.Host == domain
+		}, nil
+	case "header":
+		kv := strings.SplitN(split[1], "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid header rule %s", split[1])
+		}
+
+		return func(jsip *rtclib.JSIP) bool {
+			v, ok := jsip.GetString(kv[0])
+			return ok && v == kv[1]
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown match rule %s", rule)
+}
+
+func (p *slpPlugin) setRoute(weight uint64, match []string) error {
+	matches := []slpMatch{}
+	for _, rule := range match {
+		f, err := parseSLPMatch(rule)
+		if err != nil {
+			return err
+		}
+		matches = append(matches, f)
+	}
+
+	p.weight = weight
+	p.match = match
+	p.matches = matches
+
+	return nil
+}
+
+func (p *slpPlugin) matched(jsip *rtclib.JSIP) bool {
+	for _, f := range p.matches {
+		if f(jsip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// choose active version for new task of jsip, by match rules first, then
+// by weight, first active version is used if all weight is 0
+func (s *slpSlot) choose(jsip *rtclib.JSIP) *slpPlugin {
+	if len(s.active) == 0 {
+		return nil
+	}
+
+	if jsip != nil {
+		for _, p := range s.active {
+			if p.matched(jsip) {
+				return p
+			}
+		}
+	}
+
+	total := uint64(0)
+	for _, p := range s.active {
+		total += p.weight
+	}
+
+	if total == 0 {
+		return s.active[0]
+	}
+
+	n := uint64(rand.Int63n(int64(total)))
+	for _, p := range s.active {
+		if n < p.weight {
+			return p
+		}
+		n -= p.weight
+	}
+
+	return s.active[0]
+}
+
+func (s *slpSlot) activeVersion(version uint64) *slpPlugin {
+	for _, p := range s.active {
+		if p.version == version {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// load a version of SLP, if upgrade, new version replaces all active versions,
+// otherwise, new version is added to active versions
+func (m *slpm) slpLoad(name string, conf *slpVersionConf, upgrade bool) error {
+	p := &slpPlugin{
 		name: name,
-		file: slpFile,
+		file: conf.File,
 		time: time.Now(),
 	}
-	path := m.slpdir + slpFile
+	path := m.slpdir + conf.File
 
-	p, err := plugin.Open(path)
+	if err := p.setRoute(conf.Weight, conf.Match); err != nil {
+		return err
+	}
+
+	plug, err := plugin.Open(path)
 	if err != nil {
 		return fmt.Errorf("open slp plugin error: %v", err)
 	}
 
-	v, err := p.Lookup("GetInstance")
+	v, err := plug.Lookup("GetInstance")
 	if err != nil {
 		return fmt.Errorf("find slp plugin entry error: %v", err)
 	}
@@ -148,41 +591,124 @@ func (m *slpm) slpLoad(name string, slpFile string) error {
 	if !ok {
 		return fmt.Errorf("load %s %s failed: GetInstance type err", name, path)
 	}
-	slp.instance = instance
-	m.slps[name] = slp
+	p.instance = instance
+
+	// upgrade, new version restore states saved by old versions
+	if upgrade {
+		for _, old := range m.actives(name) {
+			m.snapshot(old)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	// SLP Init Process when loaded
 	t := rtclib.NewTask(dist.taskQ, dist.setRelated, rtcs.log, rtcs.logLevel)
 	t.Name = name
-	m.getSLP(t, SLPONLOAD)
+	m.newInstance(t, p, SLPONLOAD)
 	if t.SLP == nil {
 		return fmt.Errorf("get slp %s failed", name)
 	}
+	slpTasks.Add(1, t.Name)
+
+	slot := m.slps[name]
+	if slot == nil {
+		slot = &slpSlot{name: name}
+		m.slps[name] = slot
+	}
+
+	slot.version++
+	p.version = slot.version
+	slot.versions = append(slot.versions, p)
+
+	// upgrade, old versions draining
+	if upgrade {
+		for len(slot.active) > 0 {
+			m.drain(slot.active[0])
+		}
+	}
+	slot.active = append(slot.active, p)
 
-	t.OnMsg(nil)
+	t.OnEvent(&rtclib.TaskEvent{Type: rtclib.TaskLoad})
 
 	return nil
 }
 
-func (m *slpm) addSLP(name string, slpFile string) string {
-	if err := m.slpLoad(name, slpFile); err != nil {
-		return fmt.Sprintf("Load SLP %s %s failed, %s\n", name, slpFile, err)
+// load SLP, version with weight or match rules is added as canary of
+// active versions, otherwise it replaces all active versions
+func (m *slpm) addSLP(name string, conf *slpVersionConf, canary bool) string {
+	if err := m.slpLoad(name, conf, !canary); err != nil {
+		return fmt.Sprintf("Load SLP %s %s failed, %s\n", name, conf.File, err)
 	}
 
-	m.plugins[name] = slpFile
-
 	err := m.updateSLPFile()
 	if err != nil {
 		return fmt.Sprintf("Update slp conf file %s error: %v\n",
 			m.slpconf, err)
 	}
 
-	return fmt.Sprintf("Load SLP %s %s successd\n", name, slpFile)
+	return fmt.Sprintf("Load SLP %s %s successd\n", name, conf.File)
 }
 
-func (m *slpm) delSLP(name string) string {
-	delete(m.plugins, name)
-	delete(m.slps, name)
+// set weight and match rules of active version, nil for not changed
+func (m *slpm) routeSLP(name string, version uint64, weight *uint64,
+	match []string) string {
+
+	m.lock.Lock()
+	slot := m.slps[name]
+	if slot == nil || slot.activeVersion(version) == nil {
+		m.lock.Unlock()
+		return fmt.Sprintf("SLP %s version %d not active\n", name, version)
+	}
+
+	p := slot.activeVersion(version)
+	w := p.weight
+	if weight != nil {
+		w = *weight
+	}
+	if match == nil {
+		match = p.match
+	}
+
+	err := p.setRoute(w, match)
+	m.lock.Unlock()
+
+	if err != nil {
+		return fmt.Sprintf("Set route of SLP %s version %d failed, %s\n",
+			name, version, err)
+	}
+
+	if err := m.updateSLPFile(); err != nil {
+		return fmt.Sprintf("Update slp conf file %s error: %v\n",
+			m.slpconf, err)
+	}
+
+	return fmt.Sprintf("Set route of SLP %s version %d successd\n", name,
+		version)
+}
+
+// delete SLP, new task will not use it, versions loaded are drained,
+// if version is not 0, only the version is drained
+func (m *slpm) delSLP(name string, version uint64) string {
+	m.lock.Lock()
+	slot := m.slps[name]
+	if slot != nil {
+		if version == 0 {
+			for len(slot.active) > 0 {
+				m.drain(slot.active[0])
+			}
+		} else if p := slot.activeVersion(version); p != nil {
+			m.drain(p)
+		} else {
+			slot = nil
+		}
+	}
+	m.lock.Unlock()
+
+	if slot == nil {
+		return fmt.Sprintf("SLP %s version %d not active\n", name, version)
+	}
 
 	err := m.updateSLPFile()
 	if err != nil {
@@ -190,59 +716,257 @@ func (m *slpm) delSLP(name string) string {
 			m.slpconf, err)
 	}
 
+	if version != 0 {
+		return fmt.Sprintf("Delete SLP %s version %d successd\n", name,
+			version)
+	}
+
 	return fmt.Sprintf("Delete SLP %s successd\n", name)
 }
 
 func (m *slpm) getSLPByName(name string) *slpPlugin {
-	p := m.slps[name]
-	if p == nil {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	slot := m.slps[name]
+	if slot == nil || len(slot.active) == 0 {
 		return nil
 	}
 
-	return p
+	return slot.active[0]
 }
 
-func (m *slpm) getSLP(t *rtclib.Task, stage int) {
-	p := m.slps[t.Name]
-	if p == nil {
+// get SLP instance for task, version is chosen by jsip which create task
+func (m *slpm) getSLP(t *rtclib.Task, stage int, jsip *rtclib.JSIP) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	slot := m.slps[t.Name]
+	if slot == nil || len(slot.active) == 0 {
 		rtcs.LogError("SLP %s not exist", t.Name)
 		return
 	}
-	p.using++
 
+	m.newInstance(t, slot.choose(jsip), stage)
+}
+
+// create SLP instance of version p for task t, must be called with lock
+func (m *slpm) newInstance(t *rtclib.Task, p *slpPlugin, stage int) {
 	t.SLP = p.instance(t)
 	if t.SLP == nil {
 		rtcs.LogError("get slp error")
 		return
 	}
+	m.tasks[t] = p
 
 	switch stage {
 	case SLPONLOAD:
 		t.Process = t.SLP.OnLoad
 		p.ctx = t.SLP.NewSLPCtx()
+		p.onload = t
+		p.slp = t.SLP
 	case SLPPROCESS:
 		t.Process = t.SLP.Process
+		p.using++
 	}
 
 	t.SetCtx(p.ctx)
 }
 
+// count final response of initial request of task, code 0 for task
+// finished without final response
+func (m *slpm) countResp(t *rtclib.Task, code int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p := m.tasks[t]
+	if p == nil {
+		return
+	}
+
+	version := strconv.FormatUint(p.version, 10)
+	if code >= 200 && code < 300 {
+		p.success++
+		slpResps.Inc(p.name, version, "success")
+	} else {
+		p.errors++
+		slpResps.Inc(p.name, version, "error")
+	}
+}
+
+// task crashed by panic in SLP, version is disabled if it crashed more than
+// MaxCrashes times
+func (m *slpm) crashSLP(t *rtclib.Task) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p := m.tasks[t]
+	if p == nil {
+		return
+	}
+
+	p.crashes++
+	slpCrashes.Inc(p.name, strconv.FormatUint(p.version, 10))
+
+	if m.config.MaxCrashes == 0 || p.crashes <= m.config.MaxCrashes ||
+		p.draining {
+
+		return
+	}
+
+	rtcs.LogError("SLP %s version %d crashed %d times, disabled", p.name,
+		p.version, p.crashes)
+
+	p.disabled = true
+	m.drain(p)
+}
+
+// task finished, retire version of task if it is drained
 func (m *slpm) endSLP(t *rtclib.Task) {
-	p := m.slps[t.Name]
-	if p == nil { // SLP has been deleted
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	p := m.tasks[t]
+	if p == nil { // not SLP task
+		return
+	}
+	delete(m.tasks, t)
+
+	if p.onload == t {
+		p.onload = nil
 		return
 	}
 
 	p.using--
 	p.used++
+
+	if p.draining && p.using == 0 {
+		m.retire(p, false)
+	}
+}
+
+// version stop serving new tasks, must be called with lock
+func (m *slpm) drain(p *slpPlugin) {
+	if slot := m.slps[p.name]; slot != nil {
+		for i, v := range slot.active {
+			if v == p {
+				slot.active = append(slot.active[:i], slot.active[i+1:]...)
+				break
+			}
+		}
+	}
+
+	p.draining = true
+	p.deadline = time.Now().Add(m.config.DrainTimeout)
+
+	rtcs.LogInfo("SLP %s version %d draining, using %d", p.name, p.version,
+		p.using)
+
+	if p.using == 0 {
+		m.retire(p, false)
+	}
+}
+
+// remove version from slot, tasks still using it are terminated if force,
+// must be called with lock
+func (m *slpm) retire(p *slpPlugin, force bool) {
+	if p.retired {
+		return
+	}
+	p.retired = true
+
+	slot := m.slps[p.name]
+	if slot == nil {
+		return
+	}
+
+	for i, v := range slot.versions {
+		if v == p {
+			slot.versions = append(slot.versions[:i], slot.versions[i+1:]...)
+			break
+		}
+	}
+
+	if len(slot.versions) == 0 {
+		delete(m.slps, p.name)
+	}
+
+	if force {
+		for t, v := range m.tasks {
+			if v == p && t != p.onload {
+				t.SetFinished()
+			}
+		}
+	}
+
+	// OnUnload may be slow, not call it with lock
+	go func(slp rtclib.SLP, onload *rtclib.Task) {
+		if u, ok := slp.(rtclib.SLPUnloader); ok {
+			u.OnUnload()
+		}
+
+		if onload != nil {
+			onload.SetFinished()
+		}
+	}(p.slp, p.onload)
+
+	rtcs.LogInfo("SLP %s version %d retired, force: %v, using %d", p.name,
+		p.version, force, p.using)
+}
+
+// force retire draining versions reach deadline
+func (m *slpm) checkDeadline(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	expired := []*slpPlugin{}
+	for _, slot := range m.slps {
+		for _, p := range slot.versions {
+			if p.draining && now.After(p.deadline) {
+				expired = append(expired, p)
+			}
+		}
+	}
+
+	for _, p := range expired {
+		m.retire(p, true)
+	}
 }
 
 func (m *slpm) listSLP() string {
-	ret := "slp\t\tused\t\tusing\t\tfile\t\ttime\n"
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := make([]string, 0, len(m.slps))
+	for name := range m.slps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ret := "slp\t\tversion\tstate\t\tweight\tmatch\t\tused\t\tusing" +
+		"\t\tsuccess\terror\tcrash\tfile\t\ttime\n"
 	ret += "------------------------------------------------------------\n"
-	for _, v := range m.slps {
-		ret += fmt.Sprintf("%s\t%d\t%d\t%s\t%s\n", v.name, v.used, v.using,
-			v.file, v.time.Format("2006-01-02 15:04:05.000"))
+	for _, name := range names {
+		for _, v := range m.slps[name].versions {
+			state := "active"
+			if v.disabled {
+				state = "disabled(" +
+					v.deadline.Format("2006-01-02 15:04:05") + ")"
+			} else if v.draining {
+				state = "draining(" +
+					v.deadline.Format("2006-01-02 15:04:05") + ")"
+			}
+
+			match := strings.Join(v.match, ",")
+			if match == "" {
+				match = "-"
+			}
+
+			ret += fmt.Sprintf("%s\t%d\t%s\t%d\t%s\t%d\t%d\t%d\t%d\t%d\t%s"+
+				"\t%s\n", v.name, v.version, state, v.weight, match, v.used,
+				v.using, v.success, v.errors, v.crashes, v.file,
+				v.time.Format("2006-01-02 15:04:05.000"))
+		}
 	}
 	ret += "------------------------------------------------------------\n"
 
@@ -7,8 +7,13 @@ package main
 import (
 	"net/http"
 	"rtclib"
+	"strconv"
 )
 
+var slpmCode = map[int]rtclib.RespCode{
+	10: {Status: 400, Msg: "Invalid weight"},
+}
+
 type SLPM_V1 struct {
 }
 
@@ -27,17 +32,73 @@ func (api *SLPM_V1) Get(req *http.Request, paras string) (int,
 	return 3, nil, nil, nil
 }
 
+// Load SLP with file, or set route of active version
+//
+//	file: plugin file, load as new version
+//	weight, match: route of version, version loaded with them is added as
+//	    canary, otherwise it replaces all active versions
+//	version: active version to set route
 func (api *SLPM_V1) Post(req *http.Request, paras string) (int,
 	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
 
 	apiname := paras
-	filename := req.URL.Query().Get("file")
+	query := req.URL.Query()
+
+	var weight *uint64
+	if v := query.Get("weight"); v != "" {
+		w, err := strconv.ParseUint(v, 10, 64)
+		if err != nil || w > maxSLPWeight {
+			return 10, nil, "Invalid weight " + v + ", range 0-" +
+				strconv.Itoa(maxSLPWeight), &slpmCode
+		}
+		weight = &w
+	}
+
+	var match []string
+	if _, ok := query["match"]; ok {
+		match = []string{}
+		for _, rule := range query["match"] {
+			if rule != "" {
+				match = append(match, rule)
+			}
+		}
+	}
+
+	if v := query.Get("version"); v != "" {
+		version, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return -1, nil, "Invalid version " + v + "\n", nil
+		}
 
-	return -1, nil, sm.addSLP(apiname, filename), nil
+		return -1, nil, sm.routeSLP(apiname, version, weight, match), nil
+	}
+
+	conf := &slpVersionConf{
+		File:   query.Get("file"),
+		Weight: 100,
+		Match:  match,
+	}
+	if weight != nil {
+		conf.Weight = *weight
+	}
+
+	canary := weight != nil || len(match) > 0
+
+	return -1, nil, sm.addSLP(apiname, conf, canary), nil
 }
 
+// Delete SLP, or only version in query
 func (api *SLPM_V1) Delete(req *http.Request, paras string) (int,
 	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
 
-	return -1, nil, sm.delSLP(paras), nil
+	version := uint64(0)
+	if v := req.URL.Query().Get("version"); v != "" {
+		var err error
+		version, err = strconv.ParseUint(v, 10, 64)
+		if err != nil || version == 0 {
+			return -1, nil, "Invalid version " + v + "\n", nil
+		}
+	}
+
+	return -1, nil, sm.delSLP(paras, version), nil
 }
@@ -0,0 +1,65 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+// JSIP Trace V1
+
+package main
+
+import (
+	"net/http"
+	"rtclib"
+)
+
+var traceCode = map[int]rtclib.RespCode{
+	10: {Status: 400, Msg: "Invalid trace rule"},
+	11: {Status: 404, Msg: "Trace rule not exist"},
+}
+
+type TRACE_V1 struct {
+}
+
+func Tracev1() rtclib.API {
+	return &TRACE_V1{}
+}
+
+// List trace rules
+func (api *TRACE_V1) Get(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	switch paras {
+	case "rules":
+		return 0, nil, map[string]interface{}{
+			"rules": rtclib.TracerInstance().Rules(),
+		}, nil
+	}
+
+	return 3, nil, nil, nil
+}
+
+// Add trace rule by userid, dlg or uri in query
+func (api *TRACE_V1) Post(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	if paras != "rule" {
+		return 3, nil, nil, nil
+	}
+
+	query := req.URL.Query()
+	rule, err := rtclib.TracerInstance().AddRule(query.Get("userid"),
+		query.Get("dlg"), query.Get("uri"))
+	if err != nil {
+		return 10, nil, err.Error(), &traceCode
+	}
+
+	return 0, nil, map[string]interface{}{"rule": rule}, nil
+}
+
+// Delete trace rule by id
+func (api *TRACE_V1) Delete(req *http.Request, paras string) (int,
+	*map[string]string, interface{}, *map[int]rtclib.RespCode) {
+
+	if !rtclib.TracerInstance().DelRule(paras) {
+		return 11, nil, nil, &traceCode
+	}
+
+	return 0, nil, nil, nil
+}
@@ -0,0 +1,276 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+// JSIP trace ladder, render ladder diagram of one dialog in trace file
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"rtclib"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alexwoo/golib"
+)
+
+const colWidth = 24
+
+var (
+	dlg     string
+	files   []string
+	verbose bool
+)
+
+func usage() {
+	fmt.Printf("usage: %s -h\n", os.Args[0])
+	fmt.Printf("usage: %s -d dlg [-f tracefile]... [-v]\n", os.Args[0])
+	os.Exit(1)
+}
+
+// trace file and its rotated files, oldest first
+func defaultFiles() []string {
+	path := rtclib.FullPath("logs/trace.log")
+
+	files := []string{}
+	for i := 1; ; i++ {
+		f := path + "." + strconv.Itoa(i)
+		if _, err := os.Stat(f); err != nil {
+			break
+		}
+		files = append([]string{f}, files...)
+	}
+
+	return append(files, path)
+}
+
+func readRecords(file string, dlg string) ([]*rtclib.TraceRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []*rtclib.TraceRecord{}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		r := &rtclib.TraceRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue
+		}
+
+		if r.Dlg == dlg {
+			records = append(records, r)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+type ladder struct {
+	cols    []string
+	index   map[string]int
+	session bool
+}
+
+func newLadder(records []*rtclib.TraceRecord) *ladder {
+	l := &ladder{index: make(map[string]int)}
+
+	for _, r := range records {
+		if r.Layer == rtclib.TraceTransaction && r.Type != "TERM" {
+			l.addCol(remoteName(r.Remote))
+		}
+
+		if r.Layer == rtclib.TraceSession {
+			l.session = true
+		}
+	}
+
+	l.addCol(rtclib.TraceTransaction)
+	l.addCol(rtclib.TraceSession)
+	l.addCol(rtclib.TraceApp)
+
+	return l
+}
+
+func remoteName(remote string) string {
+	if remote == "" {
+		return "peer"
+	}
+
+	return remote
+}
+
+func (l *ladder) addCol(name string) {
+	if _, ok := l.index[name]; ok {
+		return
+	}
+
+	l.index[name] = len(l.cols)
+	l.cols = append(l.cols, name)
+}
+
+func (l *ladder) pos(col string) int {
+	return l.index[col]*colWidth + colWidth/2
+}
+
+func (l *ladder) blank() []byte {
+	row := []byte(strings.Repeat(" ", len(l.cols)*colWidth))
+	for _, col := range l.cols {
+		row[l.pos(col)] = '|'
+	}
+
+	return row
+}
+
+func (l *ladder) header() string {
+	row := []byte(strings.Repeat(" ", len(l.cols)*colWidth))
+	for _, col := range l.cols {
+		name := col
+		if len(name) > colWidth-2 {
+			name = name[:colWidth-2]
+		}
+
+		start := l.pos(col) - len(name)/2
+		copy(row[start:], name)
+	}
+
+	return string(row)
+}
+
+// from and to column of record
+func (l *ladder) arrow(r *rtclib.TraceRecord) (string, string) {
+	switch r.Layer {
+	case rtclib.TraceTransaction:
+		if r.Dir == "in" {
+			return remoteName(r.Remote), rtclib.TraceTransaction
+		}
+		return rtclib.TraceTransaction, remoteName(r.Remote)
+	case rtclib.TraceSession:
+		if r.Dir == "in" {
+			return rtclib.TraceSession, rtclib.TraceApp
+		}
+		return rtclib.TraceSession, rtclib.TraceTransaction
+	default:
+		if l.session {
+			return rtclib.TraceApp, rtclib.TraceSession
+		}
+		return rtclib.TraceApp, rtclib.TraceTransaction
+	}
+}
+
+func label(r *rtclib.TraceRecord) string {
+	if r.Code != 0 {
+		return strconv.Itoa(r.Code) + " " + r.Type
+	}
+
+	return r.Type
+}
+
+func (l *ladder) row(r *rtclib.TraceRecord) string {
+	row := l.blank()
+
+	// TERM is internal msg, mark on layer emit it
+	if r.Type == "TERM" {
+		p := l.pos(r.Layer)
+		copy(row[p+2:], "x TERM")
+		return string(row)
+	}
+
+	from, to := l.arrow(r)
+	start, end := l.pos(from), l.pos(to)
+	if start > end {
+		start, end = end, start
+	}
+
+	for i := start + 1; i < end; i++ {
+		row[i] = '-'
+	}
+
+	if l.pos(to) > l.pos(from) {
+		row[end-1] = '>'
+	} else {
+		row[start+1] = '<'
+	}
+
+	text := label(r)
+	if len(text) > end-start-4 {
+		text = text[:end-start-4]
+	}
+	copy(row[start+2:], text)
+
+	return string(row)
+}
+
+func (l *ladder) render(records []*rtclib.TraceRecord) string {
+	lines := []string{
+		strings.TrimRight(fmt.Sprintf("%-10s%s", "", l.header()), " "),
+		strings.TrimRight(fmt.Sprintf("%-10s%s", "", string(l.blank())), " "),
+	}
+
+	begin := records[0].Time
+	for _, r := range records {
+		offset := fmt.Sprintf("+%.3f", r.Time.Sub(begin).Seconds())
+		lines = append(lines, strings.TrimRight(
+			fmt.Sprintf("%-10s%s", offset, l.row(r)), " "))
+
+		if verbose && len(r.Msg) > 0 {
+			lines = append(lines, fmt.Sprintf("%-10s%s", "", string(r.Msg)))
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func main() {
+	opt := golib.NewOptParser()
+	for opt.GetOpt("hd:f:v") {
+		switch opt.Opt() {
+		case 'h':
+			usage()
+		case 'd': // DialogueID
+			dlg = opt.OptVal()
+		case 'f': // trace file
+			files = append(files, opt.OptVal())
+		case 'v': // print full msg
+			verbose = true
+		case '?':
+			usage()
+		}
+	}
+
+	if dlg == "" {
+		log.Println("dlg must be set")
+		usage()
+	}
+
+	if len(files) == 0 {
+		files = defaultFiles()
+	}
+
+	records := []*rtclib.TraceRecord{}
+	for _, f := range files {
+		rs, err := readRecords(f, dlg)
+		if err != nil {
+			log.Fatalf("Read trace file %s failed: %s", f, err)
+		}
+		records = append(records, rs...)
+	}
+
+	if len(records) == 0 {
+		log.Fatalf("No trace record of dialog %s", dlg)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	fmt.Printf("Dialog %s\n\n", dlg)
+	fmt.Print(newLadder(records).render(records))
+}
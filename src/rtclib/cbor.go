@@ -0,0 +1,319 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// CBOR encoding of JSIP msg, websocket subprotocol jsip.cbor, RFC 8949
+// byte string is decoded as text string, tags are ignored, undefined is
+// decoded as null
+
+package rtclib
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	cborUint = iota << 5
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+type cborCodec struct{}
+
+// head of data item, major type and argument
+func cborHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return appendBE(append(b, major|25), n, 2)
+	case n <= math.MaxUint32:
+		return appendBE(append(b, major|26), n, 4)
+	}
+
+	return appendBE(append(b, major|27), n, 8)
+}
+
+func (cborCodec) appendNil(b []byte) []byte {
+	return append(b, cborSimple|22)
+}
+
+func (cborCodec) appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, cborSimple|21)
+	}
+
+	return append(b, cborSimple|20)
+}
+
+func (cborCodec) appendInt(b []byte, v int64) []byte {
+	if v >= 0 {
+		return cborHead(b, cborUint, uint64(v))
+	}
+
+	return cborHead(b, cborNegInt, uint64(-1-v))
+}
+
+func (cborCodec) appendUint(b []byte, v uint64) []byte {
+	return cborHead(b, cborUint, v)
+}
+
+func (cborCodec) appendFloat(b []byte, v float64) []byte {
+	return appendBE(append(b, cborSimple|27), math.Float64bits(v), 8)
+}
+
+func (cborCodec) appendString(b []byte, s string) []byte {
+	return append(cborHead(b, cborText, uint64(len(s))), s...)
+}
+
+func (cborCodec) appendArray(b []byte, n int) []byte {
+	return cborHead(b, cborArray, uint64(n))
+}
+
+func (cborCodec) appendMap(b []byte, n int) []byte {
+	return cborHead(b, cborMap, uint64(n))
+}
+
+func (cborCodec) decode(data []byte) (interface{}, error) {
+	d := &binaryDecoder{data: data}
+
+	v, err := d.cborValue(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.end() {
+		return nil, errors.New("cbor extra data")
+	}
+
+	return v, nil
+}
+
+// major type and argument of next data item, argument is additional info if
+// indefinite or simple value
+func (d *binaryDecoder) cborHead() (byte, byte, uint64, error) {
+	c, err := d.byte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	major, info := c&0xe0, c&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		n, err := d.uint(1 << (info - 24))
+		return major, info, n, err
+	case info == cborIndefinite && major != cborUint &&
+		major != cborNegInt && major != cborTag:
+
+		return major, info, 0, nil
+	}
+
+	return 0, 0, 0, errors.New("cbor invalid additional info")
+}
+
+func (d *binaryDecoder) cborValue(depth int) (interface{}, error) {
+	if depth >= binaryMaxDepth {
+		return nil, errBinaryDepth
+	}
+
+	major, info, n, err := d.cborHead()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		if info == cborIndefinite {
+			return d.cborChunks(major)
+		}
+
+		b, err := d.take(n)
+		return string(b), err
+	case cborArray:
+		return d.cborArray(info == cborIndefinite, n, depth)
+	case cborMap:
+		return d.cborMap(info == cborIndefinite, n, depth)
+	case cborTag:
+		return d.cborValue(depth + 1)
+	}
+
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 25:
+		return float16(uint16(n)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 27:
+		return math.Float64frombits(n), nil
+	case cborIndefinite:
+		return nil, errors.New("cbor unexpected break")
+	}
+
+	return nil, errors.New("cbor simple value not supported")
+}
+
+// indefinite length string, chunks of definite length strings
+func (d *binaryDecoder) cborChunks(major byte) (interface{}, error) {
+	var s []byte
+	for {
+		if !d.end() && d.data[d.pos] == cborBreak {
+			d.pos++
+			return string(s), nil
+		}
+
+		m, info, n, err := d.cborHead()
+		if err != nil {
+			return nil, err
+		}
+
+		if m != major || info == cborIndefinite {
+			return nil, errors.New("cbor invalid chunk")
+		}
+
+		b, err := d.take(n)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, b...)
+	}
+}
+
+// at end of definite items or break of indefinite items
+func (d *binaryDecoder) cborEnd(indefinite bool, n uint64,
+	i int) (bool, error) {
+
+	if !indefinite {
+		return uint64(i) >= n, nil
+	}
+
+	if d.end() {
+		return true, errBinaryTruncated
+	}
+
+	if d.data[d.pos] == cborBreak {
+		d.pos++
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (d *binaryDecoder) cborArray(indefinite bool, n uint64,
+	depth int) (interface{}, error) {
+
+	l := 0
+	if !indefinite {
+		var err error
+		if l, err = d.count(n, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	a := make([]interface{}, 0, l)
+	for i := 0; ; i++ {
+		end, err := d.cborEnd(indefinite, n, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if end {
+			return a, nil
+		}
+
+		v, err := d.cborValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+}
+
+func (d *binaryDecoder) cborMap(indefinite bool, n uint64,
+	depth int) (interface{}, error) {
+
+	l := 0
+	if !indefinite {
+		var err error
+		if l, err = d.count(n, 2); err != nil {
+			return nil, err
+		}
+	}
+
+	m := make(map[string]interface{}, l)
+	for i := 0; ; i++ {
+		end, err := d.cborEnd(indefinite, n, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if end {
+			return m, nil
+		}
+
+		k, err := d.cborValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return nil, errBinaryKey
+		}
+
+		if m[key], err = d.cborValue(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// IEEE 754 half precision
+func float16(h uint16) float64 {
+	exp, frac := int(h>>10)&0x1f, float64(h&0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(frac+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		f = -f
+	}
+
+	return f
+}
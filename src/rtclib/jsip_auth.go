@@ -0,0 +1,609 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Stack authentication, challenge request with 401,
+// verify Digest credentials or Bearer JWT in Authorization header
+
+package rtclib
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+type jsipAuthDConfig struct {
+	Realm       string
+	Methods     string `default:"INVITE,MESSAGE,REGISTER"`
+	SLPs        string
+	Passwd      string
+	JWTAlg      string
+	JWTKey      string
+	NonceExpire time.Duration `default:"300s"`
+}
+
+type jsipAuth struct {
+	realm       string
+	methods     map[JSIPType]bool
+	slps        map[string]bool
+	users       map[string]string // username -> password
+	jwtAlg      string
+	hmacKey     []byte
+	rsaKey      *rsa.PublicKey
+	nonceExpire time.Duration
+
+	*jsipAuthState
+}
+
+// state of authentication kept across reload, nonces issued before reload
+// are still valid
+type jsipAuthState struct {
+	secret []byte // for signing nonce
+
+	lock     sync.Mutex
+	rejected map[string]*wheelTimer // INVITE challenged, wait for ACK
+
+	nonceLock sync.Mutex
+	nonces    map[string]uint64 // nonce -> last nc used
+}
+
+// prev is auth before reload, its state is kept, nil for first load
+func newJSIPAuth(c *jsipAuthDConfig, realm string, prev *jsipAuth) (*jsipAuth,
+	error) {
+
+	a := &jsipAuth{
+		realm:       c.Realm,
+		methods:     make(map[JSIPType]bool),
+		slps:        make(map[string]bool),
+		users:       make(map[string]string),
+		jwtAlg:      c.JWTAlg,
+		nonceExpire: c.NonceExpire,
+	}
+
+	if a.realm == "" {
+		a.realm = realm
+	}
+
+	if prev != nil {
+		a.jsipAuthState = prev.jsipAuthState
+	} else {
+		a.jsipAuthState = &jsipAuthState{
+			secret:   make([]byte, 16),
+			rejected: make(map[string]*wheelTimer),
+			nonces:   make(map[string]uint64),
+		}
+
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range strings.Split(c.Methods, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+
+		typ := NewJSIPType(m)
+		if typ == JSIPType(Unknown) {
+			return nil, fmt.Errorf("unknown method %s", m)
+		}
+		a.methods[typ] = true
+	}
+
+	for _, slp := range strings.Split(c.SLPs, ",") {
+		slp = strings.TrimSpace(slp)
+		if slp != "" {
+			a.slps[slp] = true
+		}
+	}
+
+	if c.Passwd != "" {
+		if err := a.loadPasswd(FullPath("conf/" + c.Passwd)); err != nil {
+			return nil, err
+		}
+	}
+
+	switch c.JWTAlg {
+	case "":
+	case "HS256":
+		if c.JWTKey == "" {
+			return nil, errors.New("jwtkey not configured")
+		}
+		a.hmacKey = []byte(c.JWTKey)
+	case "RS256":
+		key, err := loadRSAPublicKey(FullPath("certs/" + c.JWTKey))
+		if err != nil {
+			return nil, err
+		}
+		a.rsaKey = key
+	default:
+		return nil, fmt.Errorf("unsupported jwtalg %s", c.JWTAlg)
+	}
+
+	if len(a.slps) > 0 && len(a.users) == 0 && a.jwtAlg == "" {
+		return nil, errors.New("slps need auth but passwd or jwtalg not set")
+	}
+
+	return a, nil
+}
+
+// passwd file, every line as username:password
+func (a *jsipAuth) loadPasswd(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open passwd %s failed, %s", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("passwd %s format error: %s", path, line)
+		}
+		a.users[kv[0]] = kv[1]
+	}
+
+	return scanner.Err()
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read jwt key %s failed, %s", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem in jwt key %s", path)
+	}
+
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse jwt key %s failed, %s", path, err)
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("jwt key %s is not rsa public key", path)
+	}
+
+	return key, nil
+}
+
+func loadAuthConfig(realm string, prev *jsipAuth) (*jsipAuth, error) {
+	confPath := FullPath("conf/gortc.ini")
+
+	config := &jsipAuthDConfig{}
+	err := golib.ConfigFile(confPath, "JSIPAuth", config)
+	if err != nil {
+		return nil, fmt.Errorf("Parse dconfig %s Failed, %s", confPath, err)
+	}
+
+	auth, err := newJSIPAuth(config, realm, prev)
+	if err != nil {
+		return nil, fmt.Errorf("JSIPAuth config error, %s", err)
+	}
+
+	return auth, nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *jsipAuth) sign(s string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(s))
+
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// nonce as timestamp.random.signature, no need to save until used
+func (a *jsipAuth) nonce() string {
+	rnd := make([]byte, 4)
+	rand.Read(rnd)
+	s := strconv.FormatInt(time.Now().Unix(), 10) + "." +
+		hex.EncodeToString(rnd)
+
+	return s + "." + a.sign(s)
+}
+
+func (a *jsipAuth) checkNonce(nonce string) (bool, bool) {
+	i := strings.LastIndex(nonce, ".")
+	if i < 0 || !hmac.Equal([]byte(a.sign(nonce[:i])), []byte(nonce[i+1:])) {
+		return false, false
+	}
+
+	split := strings.SplitN(nonce[:i], ".", 2)
+	ts, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil {
+		return false, false
+	}
+
+	if time.Since(time.Unix(ts, 0)) > a.nonceExpire {
+		return false, true
+	}
+
+	return true, false
+}
+
+// value of WWW-Authenticate in 401
+func (a *jsipAuth) challenge(stale bool) string {
+	if len(a.users) == 0 {
+		return "Bearer realm=\"" + a.realm + "\""
+	}
+
+	ret := "Digest realm=\"" + a.realm + "\", nonce=\"" + a.nonce() +
+		"\", algorithm=MD5, qop=\"auth\""
+	if stale {
+		ret += ", stale=true"
+	}
+
+	return ret
+}
+
+// parse auth params as key1="value1", key2=value2
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+
+		value := ""
+		if strings.HasPrefix(s, "\"") {
+			end := strings.Index(s[1:], "\"")
+			if end < 0 {
+				value = s[1:]
+				s = ""
+			} else {
+				value = s[1 : end+1]
+				s = s[end+2:]
+			}
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				value = s
+				s = ""
+			} else {
+				value = s[:end]
+				s = s[end:]
+			}
+		}
+
+		params[key] = strings.TrimSpace(value)
+	}
+
+	return params
+}
+
+// record nc used with nonce, nc must be greater than last one used,
+// nonce is forgotten after expired
+func (a *jsipAuth) useNonce(nonce string, nc uint64) error {
+	a.nonceLock.Lock()
+	defer a.nonceLock.Unlock()
+
+	last, ok := a.nonces[nonce]
+	if ok && nc <= last {
+		return errors.New("nonce count replayed")
+	}
+	a.nonces[nonce] = nc
+
+	if !ok {
+		sharedWheel().AfterFunc(a.nonceExpire, func() {
+			a.nonceLock.Lock()
+			delete(a.nonces, nonce)
+			a.nonceLock.Unlock()
+		})
+	}
+
+	return nil
+}
+
+// verify Digest credentials of user for request to uri, return stale if
+// nonce expired
+func (a *jsipAuth) verifyDigest(method string, uri string, cred string,
+	user string) (bool, error) {
+
+	p := parseAuthParams(cred)
+
+	if p["username"] != user {
+		return false, errors.New("username not match")
+	}
+
+	passwd, ok := a.users[user]
+	if !ok {
+		return false, errors.New("user not exist")
+	}
+
+	if p["realm"] != a.realm {
+		return false, errors.New("realm not match")
+	}
+
+	// uri may be SIP uri from SIP client
+	if sipToJSIPUri(p["uri"]) != uri {
+		return false, errors.New("uri not match")
+	}
+
+	// nonce can be used only once without qop
+	nc := uint64(1)
+	if p["qop"] != "" {
+		var err error
+		nc, err = strconv.ParseUint(p["nc"], 16, 64)
+		if err != nil || nc == 0 {
+			return false, errors.New("nc invalid")
+		}
+	}
+
+	valid, stale := a.checkNonce(p["nonce"])
+	if !valid {
+		return stale, errors.New("nonce invalid")
+	}
+
+	ha1 := md5Hex(user + ":" + a.realm + ":" + passwd)
+	ha2 := md5Hex(method + ":" + p["uri"])
+
+	var resp string
+	if p["qop"] == "" {
+		resp = md5Hex(ha1 + ":" + p["nonce"] + ":" + ha2)
+	} else {
+		resp = md5Hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" +
+			p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+	}
+
+	if !hmac.Equal([]byte(resp), []byte(p["response"])) {
+		return false, errors.New("response not match")
+	}
+
+	return false, a.useNonce(p["nonce"], nc)
+}
+
+// verify Bearer JWT of user, sub in claims must be user
+func (a *jsipAuth) verifyJWT(token string, user string) error {
+	if a.jwtAlg == "" {
+		return errors.New("jwt not configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("jwt format error")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("jwt header error")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return errors.New("jwt header error")
+	}
+
+	if header.Alg != a.jwtAlg {
+		return fmt.Errorf("jwt alg %s not match", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return errors.New("jwt signature error")
+	}
+
+	input := parts[0] + "." + parts[1]
+	switch a.jwtAlg {
+	case "HS256":
+		mac := hmac.New(sha256.New, a.hmacKey)
+		mac.Write([]byte(input))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errors.New("jwt signature not match")
+		}
+	case "RS256":
+		sum := sha256.Sum256([]byte(input))
+		if err := rsa.VerifyPKCS1v15(a.rsaKey, crypto.SHA256, sum[:],
+			sig); err != nil {
+
+			return errors.New("jwt signature not match")
+		}
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.New("jwt claims error")
+	}
+
+	claims := struct {
+		Sub string   `json:"sub"`
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return errors.New("jwt claims error")
+	}
+
+	now := float64(time.Now().Unix())
+	if claims.Exp != nil && now >= *claims.Exp {
+		return errors.New("jwt expired")
+	}
+
+	if claims.Nbf != nil && now < *claims.Nbf {
+		return errors.New("jwt not valid yet")
+	}
+
+	if claims.Sub == "" || claims.Sub != user {
+		return errors.New("jwt sub not match")
+	}
+
+	return nil
+}
+
+// verify Authorization in request, return stale if digest nonce expired
+func (a *jsipAuth) verify(m *JSIP) (bool, error) {
+	cred, ok := m.GetString("Authorization")
+	if !ok || cred == "" {
+		return false, errors.New("no Authorization")
+	}
+
+	user := ""
+	if from, err := NewJSIPUri(m.From); err == nil {
+		user = from.User
+	}
+
+	split := strings.SplitN(strings.TrimSpace(cred), " ", 2)
+	if len(split) != 2 {
+		return false, errors.New("Authorization format error")
+	}
+
+	var stale bool
+	var err error
+	switch strings.ToLower(split[0]) {
+	case "digest":
+		stale, err = a.verifyDigest(m.Type.String(), m.RequestURI, split[1],
+			user)
+	case "bearer":
+		err = a.verifyJWT(strings.TrimSpace(split[1]), user)
+	default:
+		return false, errors.New("Unsupported Authorization " + split[0])
+	}
+
+	if err == nil {
+		m.authUser = user
+	}
+
+	return stale, err
+}
+
+// record INVITE transaction challenged, forgotten if no ACK in timeout
+func (a *jsipAuth) reject(tid string, timeout time.Duration) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if t := a.rejected[tid]; t != nil {
+		t.Stop()
+	}
+
+	var t *wheelTimer
+	t = sharedWheel().AfterFunc(timeout, func() {
+		a.lock.Lock()
+		if a.rejected[tid] == t {
+			delete(a.rejected, tid)
+		}
+		a.lock.Unlock()
+	})
+	a.rejected[tid] = t
+}
+
+// Set filter for authentication, f return name of SLP which will process
+// the request, request to SLP configured in slps of [JSIPAuth] will be
+// authenticated
+func (s *JSIPStack) SetAuthFilter(f func(m *JSIP) string) {
+	s.authFilter = f
+}
+
+// authenticate request received, return false if request is challenged or
+// should be dropped
+func (s *JSIPStack) authenticate(msg *JSIP) bool {
+	s.lock.RLock()
+	a := s.auth
+	s.lock.RUnlock()
+	if a == nil || len(a.slps) == 0 || msg.Code != 0 {
+		return true
+	}
+
+	// ACK for INVITE challenged
+	if msg.Type == ACK {
+		relid, _ := msg.GetUint("RelatedID")
+		tid := transactionID(msg.DialogueID, relid)
+
+		a.lock.Lock()
+		t, ok := a.rejected[tid]
+		if ok {
+			t.Stop()
+			delete(a.rejected, tid)
+		}
+		a.lock.Unlock()
+
+		return !ok
+	}
+
+	if !a.methods[msg.Type] {
+		return true
+	}
+
+	name := ""
+	if s.authFilter != nil {
+		name = s.authFilter(msg)
+	}
+
+	if !a.slps[name] {
+		return true
+	}
+
+	stale, err := a.verify(msg)
+	if err == nil {
+		return true
+	}
+
+	s.log.LogInfo(msg, "Authenticate failed: %s", err.Error())
+
+	if msg.conn == nil {
+		return false
+	}
+
+	resp := JSIPMsgRes(msg, 401)
+	resp.SetString("WWW-Authenticate", a.challenge(stale))
+
+	data, err := resp.Marshal()
+	if err != nil {
+		s.log.LogError(msg, "Marshal JSIP err: %s", err.Error())
+		return false
+	}
+
+	if msg.Type == INVITE {
+		a.reject(transactionID(msg.DialogueID, msg.CSeq), s.conf().TransTimer)
+	}
+
+	msg.conn.Send(data)
+
+	return false
+}
@@ -0,0 +1,328 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Stack authentication Test Case
+
+package rtclib
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+// connection for test, save JSIP msg sent
+type authTestConn struct {
+	msgs []*JSIP
+}
+
+func (c *authTestConn) Send(data []byte) {
+	m := &JSIP{}
+	assert(m.Unmarshal(data) == nil)
+	c.msgs = append(c.msgs, m)
+}
+
+func (c *authTestConn) Close() {
+}
+
+func (c *authTestConn) Prefix() string {
+	return "[authtest]"
+}
+
+func (c *authTestConn) Suffix() string {
+	return ""
+}
+
+func (c *authTestConn) LogLevel() int {
+	return golib.LOGDEBUG
+}
+
+func newAuthTest() *jsipAuth {
+	return &jsipAuth{
+		realm:       "test.com",
+		methods:     map[JSIPType]bool{INVITE: true, REGISTER: true},
+		slps:        map[string]bool{"default": true},
+		users:       map[string]string{"alice": "secret"},
+		nonceExpire: 300 * time.Second,
+		jsipAuthState: &jsipAuthState{
+			secret:   []byte("0123456789abcdef"),
+			rejected: make(map[string]*wheelTimer),
+			nonces:   make(map[string]uint64),
+		},
+	}
+}
+
+func digestCred(user string, passwd string, method string, uri string,
+	nonce string) string {
+
+	return digestCredNC(user, passwd, method, uri, nonce, "00000001")
+}
+
+func digestCredNC(user string, passwd string, method string, uri string,
+	nonce string, nc string) string {
+
+	ha1 := md5Hex(user + ":test.com:" + passwd)
+	ha2 := md5Hex(method + ":" + uri)
+	resp := md5Hex(ha1 + ":" + nonce + ":" + nc + ":abc:auth:" + ha2)
+
+	return fmt.Sprintf("Digest username=\"%s\", realm=\"test.com\", "+
+		"nonce=\"%s\", uri=\"%s\", qop=auth, nc=%s, cnonce=\"abc\", "+
+		"response=\"%s\"", user, nonce, uri, nc, resp)
+}
+
+func jwtToken(alg string, claims string, sign func(string) []byte) string {
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString([]byte(`{"alg":"`+alg+`","typ":"JWT"}`)) +
+		"." + enc.EncodeToString([]byte(claims))
+
+	return input + "." + enc.EncodeToString(sign(input))
+}
+
+func TestAuthDigest(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestAuthDigest")
+
+	a := newAuthTest()
+
+	p := parseAuthParams(`Digest realm="a, b", nonce=123, qop="auth"`[7:])
+	assert(p["realm"] == "a, b" && p["nonce"] == "123" && p["qop"] == "auth")
+
+	m := JSIPMsgReq(INVITE, "bob@test.com", "alice@test.com", "bob@test.com",
+		"dlg1")
+
+	_, err := a.verify(m)
+	assert(err != nil)
+
+	nonce := a.nonce()
+	m.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"bob@test.com", nonce))
+	_, err = a.verify(m)
+	assert(err == nil)
+
+	m.SetString("Authorization", digestCred("alice", "wrong", "INVITE",
+		"bob@test.com", nonce))
+	_, err = a.verify(m)
+	assert(err != nil)
+
+	// username must be From user
+	m.SetString("Authorization", digestCred("bob", "secret", "INVITE",
+		"bob@test.com", nonce))
+	_, err = a.verify(m)
+	assert(err != nil)
+
+	// nonce forged
+	m.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"bob@test.com", "1.abc"))
+	stale, err := a.verify(m)
+	assert(err != nil && !stale)
+
+	// nonce expired
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	m.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"bob@test.com", ts+"."+a.sign(ts)))
+	stale, err = a.verify(m)
+	assert(err != nil && stale)
+
+	// nonce replayed with same or lower nc
+	m.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"bob@test.com", nonce))
+	_, err = a.verify(m)
+	assert(err != nil)
+
+	m.SetString("Authorization", digestCredNC("alice", "secret", "INVITE",
+		"bob@test.com", nonce, "00000003"))
+	_, err = a.verify(m)
+	assert(err == nil)
+
+	m.SetString("Authorization", digestCredNC("alice", "secret", "INVITE",
+		"bob@test.com", nonce, "00000002"))
+	_, err = a.verify(m)
+	assert(err != nil)
+
+	// uri must be Request-URI, SIP uri as JSIP uri
+	nonce = a.nonce()
+	m.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"carol@test.com", nonce))
+	_, err = a.verify(m)
+	assert(err != nil)
+
+	m.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"sip:bob@test.com;transport=ws", nonce))
+	_, err = a.verify(m)
+	assert(err == nil)
+
+	// nonces are unique
+	assert(a.nonce() != a.nonce())
+}
+
+func TestAuthReload(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestAuthReload")
+
+	c := &jsipAuthDConfig{Methods: "INVITE", NonceExpire: 300 * time.Second}
+
+	prev, err := newJSIPAuth(c, "test.com", nil)
+	assert(err == nil && len(prev.secret) == 16)
+	prev.users["alice"] = "secret"
+
+	m := JSIPMsgReq(INVITE, "bob@test.com", "alice@test.com", "bob@test.com",
+		"dlg1")
+	nonce := prev.nonce()
+	m.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"bob@test.com", nonce))
+	_, err = prev.verify(m)
+	assert(err == nil)
+	prev.reject("dlg1_1", time.Second)
+
+	// config updated, secret, nonces and rejected kept
+	c.Methods = "INVITE,REGISTER"
+	a, err := newJSIPAuth(c, "test.com", prev)
+	assert(err == nil && a.methods[REGISTER] && !prev.methods[REGISTER])
+	assert(string(a.secret) == string(prev.secret))
+	a.users["alice"] = "secret"
+
+	// nonce issued before reload still valid, and nc replay still detected
+	_, err = a.verify(m)
+	assert(err != nil)
+	m.SetString("Authorization", digestCredNC("alice", "secret", "INVITE",
+		"bob@test.com", nonce, "00000002"))
+	_, err = a.verify(m)
+	assert(err == nil)
+
+	a.lock.Lock()
+	assert(a.rejected["dlg1_1"] != nil)
+	a.lock.Unlock()
+
+	// first load has new secret
+	b, err := newJSIPAuth(c, "test.com", nil)
+	assert(err == nil && string(b.secret) != string(a.secret))
+}
+
+func TestAuthJWT(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestAuthJWT")
+
+	a := newAuthTest()
+	a.jwtAlg = "HS256"
+	a.hmacKey = []byte("jwtkey")
+
+	hs := func(key string) func(string) []byte {
+		return func(input string) []byte {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(input))
+			return mac.Sum(nil)
+		}
+	}
+
+	exp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	assert(a.verifyJWT(jwtToken("HS256", `{"sub":"alice","exp":`+exp+`}`,
+		hs("jwtkey")), "alice") == nil)
+	assert(a.verifyJWT(jwtToken("HS256", `{"sub":"alice","exp":`+exp+`}`,
+		hs("other")), "alice") != nil)
+	assert(a.verifyJWT(jwtToken("HS256", `{"sub":"alice","exp":`+past+`}`,
+		hs("jwtkey")), "alice") != nil)
+	assert(a.verifyJWT(jwtToken("HS256", `{"sub":"alice","nbf":`+exp+`}`,
+		hs("jwtkey")), "alice") != nil)
+	assert(a.verifyJWT(jwtToken("HS256", `{"sub":"bob"}`,
+		hs("jwtkey")), "alice") != nil)
+	assert(a.verifyJWT(jwtToken("none", `{}`,
+		func(string) []byte { return nil }), "alice") != nil)
+	assert(a.verifyJWT("abc", "alice") != nil)
+
+	m := JSIPMsgReq(MESSAGE, "bob@test.com", "alice@test.com", "bob@test.com",
+		"dlg1")
+	m.SetString("Authorization", "Bearer "+jwtToken("HS256", `{"sub":"alice"}`,
+		hs("jwtkey")))
+	_, err := a.verify(m)
+	assert(err == nil)
+
+	// token without sub
+	m.SetString("Authorization", "Bearer "+jwtToken("HS256", `{}`,
+		hs("jwtkey")))
+	_, err = a.verify(m)
+	assert(err != nil)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert(err == nil)
+
+	a.jwtAlg = "RS256"
+	a.rsaKey = &key.PublicKey
+
+	rs := func(input string) []byte {
+		sum := sha256.Sum256([]byte(input))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		assert(err == nil)
+		return sig
+	}
+
+	assert(a.verifyJWT(jwtToken("RS256", `{"sub":"alice"}`, rs),
+		"alice") == nil)
+	assert(a.verifyJWT(jwtToken("HS256", `{"sub":"alice"}`, hs("jwtkey")),
+		"alice") != nil)
+}
+
+func TestAuthenticate(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestAuthenticate")
+
+	s := &JSIPStack{
+		log:    golib.NewLog("stack.log"),
+		config: &jsipDConfig{Realm: "test.com", TransTimer: time.Second},
+		auth:   newAuthTest(),
+	}
+	s.SetAuthFilter(func(m *JSIP) string {
+		if m.RequestURI == "room@chatroom.test.com" {
+			return "chatroom"
+		}
+
+		return "default"
+	})
+
+	conn := &authTestConn{}
+
+	newReq := func(typ JSIPType, uri string) *JSIP {
+		m := JSIPMsgReq(typ, uri, "alice@test.com", uri, "dlg1")
+		m.conn = conn
+		m.recv = true
+		return m
+	}
+
+	// SLP not need authentication, and method not need authentication
+	assert(s.authenticate(newReq(INVITE, "room@chatroom.test.com")))
+	assert(s.authenticate(newReq(OPTIONS, "bob@test.com")))
+	assert(len(conn.msgs) == 0)
+
+	// challenge
+	invite := newReq(INVITE, "bob@test.com")
+	assert(!s.authenticate(invite))
+	assert(len(conn.msgs) == 1)
+	resp := conn.msgs[0]
+	assert(resp.Code == 401 && resp.CSeq == invite.CSeq)
+	challenge, _ := resp.GetString("WWW-Authenticate")
+	p := parseAuthParams(challenge[len("Digest "):])
+	assert(p["realm"] == "test.com" && p["nonce"] != "")
+
+	// ACK for 401 dropped
+	resp.Type = INVITE
+	ack := JSIPMsgAck(resp)
+	ack.recv = true
+	assert(!s.authenticate(ack))
+	assert(s.authenticate(ack))
+
+	// retry with credentials
+	invite = newReq(INVITE, "bob@test.com")
+	invite.SetString("Authorization", digestCred("alice", "secret", "INVITE",
+		"bob@test.com", p["nonce"]))
+	assert(s.authenticate(invite))
+	assert(len(conn.msgs) == 1)
+
+	// response not authenticated
+	assert(s.authenticate(JSIPMsgRes(invite, 200)))
+}
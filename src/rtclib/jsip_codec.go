@@ -0,0 +1,786 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP codec, decode JSIP msg in one pass into fields of JSIP, encode JSIP
+// msg into pooled buffer. Output is the same as encoding/json marshalling
+// headers as a map, keys sorted and strings HTML escaped.
+//
+// Headers not known by JSIP stack are kept in rawMsg, strings, numbers,
+// bools and null are decoded into go values, objects and arrays are kept as
+// raw JSON. Integers are decoded into int64 or uint64 for 64-bit precision.
+
+package rtclib
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+)
+
+// raw JSON object or array of header not known by JSIP stack
+type jsipRaw []byte
+
+// buffers for encode, larger ones are not put back into pool
+const jsipCodecBufMax = 64 * 1024
+
+type jsipEncodeState struct {
+	buf  []byte
+	keys []string
+}
+
+var jsipEncodePool = sync.Pool{
+	New: func() interface{} {
+		return &jsipEncodeState{
+			buf:  make([]byte, 0, 1024),
+			keys: make([]string, 0, 16),
+		}
+	},
+}
+
+// headers encoded from fields of JSIP, others in rawMsg are ignored
+func (m *JSIP) coreHeader(key string) bool {
+	switch key {
+	case "Type", "From", "To", "CSeq", "DialogueID":
+		return true
+	case "Body":
+		return m.Body != nil
+	}
+
+	if m.Code == 0 {
+		return key == "Request-URI" || key == "Router"
+	}
+
+	return key == "Code" || key == "Desc"
+}
+
+func (m *JSIP) router() string {
+	if len(m.Router) == 0 {
+		return ""
+	}
+
+	router := m.Router[0]
+	for i := 1; i < len(m.Router); i++ {
+		router += ", " + m.Router[i]
+	}
+
+	return router
+}
+
+// check headers must be set before encode
+func (m *JSIP) check() error {
+	typ := JSIPRespType(m.Code)
+	if typ == JSIPResponseType(Unknown) {
+		return errors.New("Invalid Code")
+	} else if typ == JSIPReq {
+		if m.Type.String() == "UNKNOWN" {
+			return errors.New("Unknow Type")
+		}
+
+		if m.RequestURI == "" {
+			return errors.New("No RequestURI")
+		}
+	}
+
+	if m.From == "" {
+		return errors.New("No From")
+	}
+
+	if m.To == "" {
+		return errors.New("No To")
+	}
+
+	if m.CSeq == 0 {
+		return errors.New("No CSeq")
+	}
+
+	if m.DialogueID == "" {
+		return errors.New("No DialogueID")
+	}
+
+	return nil
+}
+
+// append sorted keys of headers encoded
+func (m *JSIP) headerKeys(keys []string, router string) []string {
+	if m.Code == 0 {
+		keys = append(keys, "Type", "Request-URI")
+		if router != "" {
+			keys = append(keys, "Router")
+		}
+	} else {
+		keys = append(keys, "Type", "Code", "Desc")
+	}
+	keys = append(keys, "From", "To", "CSeq", "DialogueID")
+	if m.Body != nil {
+		keys = append(keys, "Body")
+	}
+
+	for k := range m.rawMsg {
+		if !m.coreHeader(k) {
+			keys = append(keys, k)
+		}
+	}
+	sortStrings(keys)
+
+	return keys
+}
+
+func (e *jsipEncodeState) put() {
+	if cap(e.buf) <= jsipCodecBufMax {
+		e.keys = e.keys[:0]
+		jsipEncodePool.Put(e)
+	}
+}
+
+func (m *JSIP) encode() ([]byte, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+
+	e := jsipEncodePool.Get().(*jsipEncodeState)
+	defer e.put()
+
+	router := m.router()
+	keys := m.headerKeys(e.keys[:0], router)
+	e.keys = keys
+
+	var err error
+	b := append(e.buf[:0], '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendJSONString(b, k)
+		b = append(b, ':')
+
+		switch {
+		case !m.coreHeader(k):
+			b, err = appendJSONValue(b, m.rawMsg[k])
+		case k == "Type" && m.Code == 0:
+			b = appendJSONString(b, m.Type.String())
+		case k == "Type":
+			b = appendJSONString(b, "RESPONSE")
+		case k == "Request-URI":
+			b = appendJSONString(b, m.RequestURI)
+		case k == "Router":
+			b = appendJSONString(b, router)
+		case k == "Code":
+			b = strconv.AppendInt(b, int64(m.Code), 10)
+		case k == "Desc":
+			b = appendJSONString(b, JSIPRespDesc(m.Code))
+		case k == "From":
+			b = appendJSONString(b, m.From)
+		case k == "To":
+			b = appendJSONString(b, m.To)
+		case k == "CSeq":
+			b = strconv.AppendUint(b, m.CSeq, 10)
+		case k == "DialogueID":
+			b = appendJSONString(b, m.DialogueID)
+		case k == "Body":
+			b, err = appendJSONValue(b, m.Body)
+		}
+
+		if err != nil {
+			e.buf = b
+			return nil, err
+		}
+	}
+	b = append(b, '}')
+	e.buf = b
+
+	// buffer is reused, msg sent may be queued by connection
+	out := make([]byte, len(b))
+	copy(out, b)
+
+	return out, nil
+}
+
+// value of header, for Type, Code and Desc which are checked after all
+// headers decoded
+type jsipField struct {
+	raw []byte
+	ok  bool
+}
+
+func (m *JSIP) decode(data []byte) error {
+	d := &jsipDecoder{data: data}
+
+	d.skipSpace()
+	if !d.next('{') {
+		return errors.New("raw is not json object")
+	}
+
+	var typ, code, desc, uri, router, from, to, cseq, dlg jsipField
+	var body []byte
+
+	for {
+		d.skipSpace()
+		if d.end() || d.peek() == '}' {
+			break
+		}
+
+		if d.next(',') {
+			continue
+		}
+
+		if d.peek() != '"' {
+			break
+		}
+		key := d.value()
+
+		d.skipSpace()
+		if !d.next(':') {
+			break
+		}
+		d.skipSpace()
+
+		raw := d.value()
+
+		// known headers are matched without converting key to string
+		k := jsonKey(key)
+		if k == nil {
+			k = []byte(unquoteJSON(key))
+		}
+
+		switch string(k) {
+		case "Type":
+			typ = jsipField{raw, true}
+		case "Code":
+			code = jsipField{raw, true}
+		case "Desc":
+			desc = jsipField{raw, true}
+		case "Request-URI":
+			uri = jsipField{raw, true}
+		case "Router":
+			router = jsipField{raw, true}
+		case "From":
+			from = jsipField{raw, true}
+		case "To":
+			to = jsipField{raw, true}
+		case "CSeq":
+			cseq = jsipField{raw, true}
+		case "DialogueID":
+			dlg = jsipField{raw, true}
+		case "Body":
+			body = raw
+		default:
+			m.setHeader(unquoteJSON(key), decodeJSONValue(raw))
+		}
+	}
+
+	t, ok := typ.string()
+	if !ok {
+		return errors.New("Type error")
+	}
+
+	if t == "RESPONSE" {
+		if m.Code, ok = code.int(); !ok {
+			return errors.New("Code error")
+		}
+
+		if JSIPRespType(m.Code) < JSIPProvisionalResp {
+			return errors.New("Invalid Code")
+		}
+
+		// Request-URI and Router of response are not known by JSIP stack
+		uri.header(m, "Request-URI")
+		router.header(m, "Router")
+	} else {
+		m.Type = NewJSIPType(t)
+		if m.Type == JSIPType(Unknown) {
+			return errors.New("Unknown Type")
+		}
+
+		if m.RequestURI, ok = uri.string(); !ok {
+			return errors.New("Request-URI error")
+		}
+
+		if routers, ok := router.string(); ok {
+			m.Router = splitRouter(routers)
+		}
+
+		code.header(m, "Code")
+		desc.header(m, "Desc")
+	}
+
+	if m.From, ok = from.string(); !ok {
+		return errors.New("From error")
+	}
+
+	if m.To, ok = to.string(); !ok {
+		return errors.New("To error")
+	}
+
+	if m.CSeq, ok = cseq.uint64(); !ok {
+		return errors.New("CSeq error")
+	}
+
+	if m.DialogueID, ok = dlg.string(); !ok {
+		return errors.New("DialogueID error")
+	}
+
+	if body != nil {
+		m.Body = gjson.ParseBytes(body).Value()
+		if m.Body == nil { // Body null is kept as header
+			m.setHeader("Body", nil)
+		}
+	}
+
+	return nil
+}
+
+func (m *JSIP) setHeader(key string, value interface{}) {
+	if m.rawMsg == nil {
+		m.rawMsg = make(map[string]interface{})
+	}
+
+	m.rawMsg[key] = value
+}
+
+func splitRouter(routers string) []string {
+	router := strings.Split(routers, ",")
+	for i := 0; i < len(router); i++ {
+		router[i] = strings.TrimSpace(router[i])
+	}
+
+	return router
+}
+
+// keep field not known by JSIP stack as header
+func (f jsipField) header(m *JSIP, key string) {
+	if f.ok {
+		m.setHeader(key, decodeJSONValue(f.raw))
+	}
+}
+
+func (f jsipField) string() (string, bool) {
+	if !f.ok || len(f.raw) == 0 || f.raw[0] != '"' {
+		return "", false
+	}
+
+	return unquoteJSON(f.raw), true
+}
+
+func (f jsipField) int() (int, bool) {
+	v, ok := f.number()
+	switch v := v.(type) {
+	case int64:
+		return int(v), ok
+	case uint64:
+		return int(v), ok
+	case float64:
+		return int(v), ok
+	}
+
+	return 0, false
+}
+
+func (f jsipField) uint64() (uint64, bool) {
+	v, ok := f.number()
+	switch v := v.(type) {
+	case int64:
+		return uint64(v), ok
+	case uint64:
+		return v, ok
+	case float64:
+		return uint64(v), ok
+	}
+
+	return 0, false
+}
+
+func (f jsipField) number() (interface{}, bool) {
+	if !f.ok || len(f.raw) == 0 {
+		return nil, false
+	}
+
+	if c := f.raw[0]; c != '-' && (c < '0' || c > '9') {
+		return nil, false
+	}
+
+	return decodeJSONValue(f.raw), true
+}
+
+// decode JSON value of header, objects and arrays are kept as raw JSON if
+// valid, invalid values are decoded leniently
+func decodeJSONValue(raw []byte) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	switch raw[0] {
+	case '"':
+		return unquoteJSON(raw)
+	case '{', '[':
+		if json.Valid(raw) {
+			return jsipRaw(append([]byte(nil), raw...))
+		}
+	case 't':
+		if string(raw) == "true" {
+			return true
+		}
+	case 'f':
+		if string(raw) == "false" {
+			return false
+		}
+	case 'n':
+		if string(raw) == "null" {
+			return nil
+		}
+	default:
+		if v, ok := decodeJSONNumber(raw); ok {
+			return v
+		}
+	}
+
+	return gjson.ParseBytes(raw).Value()
+}
+
+func decodeJSONNumber(raw []byte) (interface{}, bool) {
+	s := string(raw)
+
+	// -0 is float in encoding/json
+	if s != "-0" {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, true
+		}
+
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return u, true
+		}
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+
+	return nil, false
+}
+
+// decoder scan JSON value leniently as gjson, for compatible with peers
+type jsipDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *jsipDecoder) end() bool {
+	return d.pos >= len(d.data)
+}
+
+func (d *jsipDecoder) peek() byte {
+	return d.data[d.pos]
+}
+
+func (d *jsipDecoder) next(c byte) bool {
+	if d.end() || d.data[d.pos] != c {
+		return false
+	}
+
+	d.pos++
+
+	return true
+}
+
+func (d *jsipDecoder) skipSpace() {
+	for !d.end() && d.data[d.pos] <= ' ' {
+		d.pos++
+	}
+}
+
+func (d *jsipDecoder) skipString() {
+	d.pos++ // '"'
+	for !d.end() {
+		switch d.data[d.pos] {
+		case '\\':
+			d.pos += 2
+			continue
+		case '"':
+			d.pos++
+			return
+		}
+		d.pos++
+	}
+
+	if d.pos > len(d.data) {
+		d.pos = len(d.data)
+	}
+}
+
+// raw bytes of next value
+func (d *jsipDecoder) value() []byte {
+	start := d.pos
+	if d.end() {
+		return nil
+	}
+
+	switch d.peek() {
+	case '"':
+		d.skipString()
+	case '{', '[':
+		depth := 0
+		for !d.end() {
+			switch d.data[d.pos] {
+			case '"':
+				d.skipString()
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+			d.pos++
+
+			if depth == 0 {
+				break
+			}
+		}
+	default:
+		for !d.end() {
+			c := d.data[d.pos]
+			if c == ',' || c == '}' || c == ']' || c <= ' ' {
+				break
+			}
+			d.pos++
+		}
+	}
+
+	return d.data[start:d.pos]
+}
+
+// bytes of key without quotes, nil if key has escapes or not terminated
+func jsonKey(raw []byte) []byte {
+	n := len(raw)
+	if n < 2 || raw[n-1] != '"' {
+		return nil
+	}
+
+	for i := 1; i < n-1; i++ {
+		if raw[i] == '\\' {
+			return nil
+		}
+	}
+
+	return raw[1 : n-1]
+}
+
+// unquote JSON string, raw starts with '"', unterminated string is accepted
+func unquoteJSON(raw []byte) string {
+	s := raw[1:]
+	if n := len(s); n > 0 && s[n-1] == '"' {
+		escaped := false
+		for i := 0; i < n-1; i++ {
+			if s[i] == '\\' {
+				escaped = true
+				break
+			}
+		}
+
+		if !escaped {
+			return string(s[:n-1])
+		}
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			break
+		}
+
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			break
+		}
+
+		switch s[i] {
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r, n := decodeJSONRune(s[i+1:])
+			if n == 0 {
+				b = append(b, 'u')
+				continue
+			}
+			i += n
+
+			if utf16.IsSurrogate(r) {
+				if len(s) > i+2 && s[i+1] == '\\' && s[i+2] == 'u' {
+					if r2, n := decodeJSONRune(s[i+3:]); n > 0 {
+						r = utf16.DecodeRune(r, r2)
+						i += n + 2
+					}
+				}
+			}
+
+			b = appendRune(b, r)
+		default: // '"', '\\', '/' and invalid escapes
+			b = append(b, s[i])
+		}
+	}
+
+	return string(b)
+}
+
+func decodeJSONRune(s []byte) (rune, int) {
+	if len(s) < 4 {
+		return 0, 0
+	}
+
+	r, err := strconv.ParseUint(string(s[:4]), 16, 16)
+	if err != nil {
+		return 0, 0
+	}
+
+	return rune(r), 4
+}
+
+func appendRune(b []byte, r rune) []byte {
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+
+	return append(b, buf[:n]...)
+}
+
+// string needs no escape is appended directly, others are encoded by
+// encoding/json, escape of which differs between go versions
+func appendJSONString(b []byte, s string) []byte {
+	if !jsonPlain(s) {
+		data, _ := json.Marshal(s)
+		return append(b, data...)
+	}
+
+	b = append(b, '"')
+	b = append(b, s...)
+
+	return append(b, '"')
+}
+
+// valid UTF-8 without control, HTML and JS special characters
+func jsonPlain(s string) bool {
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c < ' ' || c == '"' || c == '\\' || c == '<' || c == '>' ||
+				c == '&' {
+
+				return false
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || r == '\u2028' ||
+			r == '\u2029' {
+
+			return false
+		}
+		i += size
+	}
+
+	return true
+}
+
+// encode value as encoding/json, common types are encoded without reflect
+func appendJSONValue(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, "null"...), nil
+	case string:
+		return appendJSONString(b, v), nil
+	case bool:
+		return strconv.AppendBool(b, v), nil
+	case int:
+		return strconv.AppendInt(b, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(b, v, 10), nil
+	case uint64:
+		return strconv.AppendUint(b, v, 10), nil
+	case float64:
+		// integers in float64 from peer, others are encoded by encoding/json
+		if v == math.Trunc(v) && math.Abs(v) < 1e21 &&
+			!(v == 0 && math.Signbit(v)) {
+
+			return strconv.AppendFloat(b, v, 'f', -1, 64), nil
+		}
+	case jsipRaw:
+		return append(b, v...), nil
+	case map[string]interface{}:
+		if v == nil {
+			return append(b, "null"...), nil
+		}
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sortStrings(keys)
+
+		var err error
+		b = append(b, '{')
+		for i, k := range keys {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSONString(b, k)
+			b = append(b, ':')
+			if b, err = appendJSONValue(b, v[k]); err != nil {
+				return b, err
+			}
+		}
+
+		return append(b, '}'), nil
+	case []interface{}:
+		if v == nil {
+			return append(b, "null"...), nil
+		}
+
+		var err error
+		b = append(b, '[')
+		for i, e := range v {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = appendJSONValue(b, e); err != nil {
+				return b, err
+			}
+		}
+
+		return append(b, ']'), nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return b, err
+	}
+
+	return append(b, data...), nil
+}
+
+// insertion sort, headers of JSIP msg are few
+func sortStrings(s []string) {
+	for i := 1; i < len(s); i++ {
+		for j := i; j > 0 && s[j] < s[j-1]; j-- {
+			s[j], s[j-1] = s[j-1], s[j]
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP codec Test Case
+
+package rtclib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+// codec before single-pass codec, wire format of it must be kept
+
+func legacyMarshal(m *JSIP) ([]byte, error) {
+	typ := JSIPRespType(m.Code)
+	if typ == JSIPResponseType(Unknown) {
+		return nil, errors.New("Invalid Code")
+	} else if typ == JSIPReq {
+		m.rawMsg["Type"] = m.Type.String()
+		if m.rawMsg["Type"] == "UNKNOWN" {
+			return nil, errors.New("Unknow Type")
+		}
+
+		if m.RequestURI == "" {
+			return nil, errors.New("No RequestURI")
+		}
+		m.rawMsg["Request-URI"] = m.RequestURI
+
+		router := ""
+		if len(m.Router) > 0 {
+			router = m.Router[0]
+			for i := 1; i < len(m.Router); i++ {
+				router += ", " + m.Router[i]
+			}
+		}
+
+		if router == "" {
+			delete(m.rawMsg, "Router")
+		} else {
+			m.rawMsg["Router"] = router
+		}
+	} else {
+		m.rawMsg["Type"] = "RESPONSE"
+		m.rawMsg["Code"] = m.Code
+		m.rawMsg["Desc"] = JSIPRespDesc(m.Code)
+	}
+
+	if m.From == "" {
+		return nil, errors.New("No From")
+	}
+	m.rawMsg["From"] = m.From
+
+	if m.To == "" {
+		return nil, errors.New("No To")
+	}
+	m.rawMsg["To"] = m.To
+
+	if m.CSeq == 0 {
+		return nil, errors.New("No CSeq")
+	}
+	m.rawMsg["CSeq"] = m.CSeq
+
+	if m.DialogueID == "" {
+		return nil, errors.New("No DialogueID")
+	}
+	m.rawMsg["DialogueID"] = m.DialogueID
+
+	if m.Body != nil {
+		m.rawMsg["Body"] = m.Body
+	}
+
+	return json.Marshal(m.rawMsg)
+}
+
+func legacyUnmarshal(m *JSIP, raw []byte) error {
+	rawMsg, ok := gjson.ParseBytes(raw).Value().(map[string]interface{})
+	if !ok {
+		return errors.New("raw is not json object")
+	}
+
+	m.rawMsg = rawMsg
+
+	typ, ok := rawMsg["Type"].(string)
+	if !ok {
+		return errors.New("Type error")
+	}
+
+	if typ == "RESPONSE" {
+		if m.Code, ok = getJsonInt(rawMsg, "Code"); !ok {
+			return errors.New("Code error")
+		}
+
+		if JSIPRespType(m.Code) < JSIPProvisionalResp {
+			return errors.New("Invalid Code")
+		}
+	} else {
+		m.Type = NewJSIPType(typ)
+		if m.Type == JSIPType(Unknown) {
+			return errors.New("Unknown Type")
+		}
+
+		if m.RequestURI, ok = rawMsg["Request-URI"].(string); !ok {
+			return errors.New("Request-URI error")
+		}
+
+		if routers, ok := rawMsg["Router"].(string); ok {
+			m.Router = strings.Split(routers, ",")
+			for i := 0; i < len(m.Router); i++ {
+				m.Router[i] = strings.TrimSpace(m.Router[i])
+			}
+		}
+	}
+
+	if m.From, ok = rawMsg["From"].(string); !ok {
+		return errors.New("From error")
+	}
+
+	if m.To, ok = rawMsg["To"].(string); !ok {
+		return errors.New("To error")
+	}
+
+	if m.CSeq, ok = getJsonUint64(rawMsg, "CSeq"); !ok {
+		return errors.New("CSeq error")
+	}
+
+	if m.DialogueID, ok = rawMsg["DialogueID"].(string); !ok {
+		return errors.New("DialogueID error")
+	}
+
+	body := gjson.GetBytes(raw, "Body")
+	if body.Exists() {
+		m.Body = body.Value()
+	}
+
+	return nil
+}
+
+// msg in current wire format, as legacy codec forwards it
+func legacyForward(data []byte) ([]byte, error) {
+	m := &JSIP{}
+	if err := legacyUnmarshal(m, data); err != nil {
+		return nil, err
+	}
+
+	return legacyMarshal(m)
+}
+
+var codecCorpus = []string{
+	`{"CSeq":1,"DialogueID":"test1","From":"jsip","Request-URI":"jsip.com","To":"jsip","Type":"INVITE","Router":"router1"}`,
+	`{"CSeq":1,"Code":199,"Desc":"User Defined Provisional Response","DialogueID":"test1","From":"jsip","To":"jsip","Type":"RESPONSE"}`,
+	`{"Body":{"sdp":"v=0\r\no=- 1 2 IN IP4 <127.0.0.1>","candidates":[{"port":5000,"prio":1.5e-7}],"n":null},"CSeq":3,"DialogueID":"d é😀","Expire":600,"From":"a&b","RelatedID":12345678901234567,"Request-URI":"jsip.com","Router":"r1 ,r2,  r3","To":"to","Type":"UPDATE","X-Obj":{"b":[1,2],"a":true}}`,
+	`{"Type":"RESPONSE","Code":200,"CSeq":18446744073709551615,"DialogueID":"dlg","From":"f","To":"t","Router":"alternate","Request-URI":"x","Body":null,"Retry-After":30,"X-Neg":-0,"X-Float":1e21}`,
+	`{"Type":"MESSAGE","CSeq":2,"DialogueID":"dlg","From":"f","To":"t","Request-URI":"u","Code":1.5,"Desc":"desc","Body":"text","X-Bool":false}`,
+	` { "Type" : "BYE" , "CSeq" : 9 , "DialogueID" : "dlg" , "From" : "f" , "To" : "t" , "Request-URI" : "u" , "X-Arr" : [ 1 , { "b" : 2 , "a" : 1 } ] } `,
+}
+
+func TestCodecCompatible(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestCodecCompatible")
+
+	for _, data := range codecCorpus {
+		wire, err := legacyForward([]byte(data))
+		assert(err == nil)
+
+		m := &JSIP{}
+		assert(m.Unmarshal(wire) == nil)
+		out, err := m.Marshal()
+		assert(err == nil)
+		assert(bytes.Equal(out, wire))
+
+		// Marshal does not modify msg
+		out, _ = m.Marshal()
+		assert(bytes.Equal(out, wire))
+	}
+
+	// msg constructed by app
+	req := JSIPMsgReq(INVITE, "jsip.com", "<alex>", "jsip", "dlg")
+	req.Router = []string{"r1", "r2"}
+	req.Body = map[string]interface{}{
+		"k": []interface{}{"v", float64(1), nil, true},
+		"i": 10,
+		"s": struct{ A int }{1},
+	}
+	req.SetUint("RelatedID", 3)
+	req.SetInt("X-Int", -3)
+	req.SetString("X-Str", "\x01\xff")
+	res := JSIPMsgRes(req, 603)
+	res.SetString("Router", "alternate")
+
+	for _, m := range []*JSIP{req, res} {
+		out, err := m.Marshal()
+		assert(err == nil)
+
+		c := JSIPMsgClone(m, m.DialogueID)
+		c.CSeq = m.CSeq
+		wire, err := legacyMarshal(c)
+		assert(err == nil)
+		assert(bytes.Equal(out, wire))
+	}
+
+	// unsupported value
+	req.Body = make(chan int)
+	_, err := req.Marshal()
+	assert(err != nil)
+}
+
+func TestCodecPrecision(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestCodecPrecision")
+
+	data := `{"CSeq":9007199254740993,"DialogueID":"dlg","From":"f","RelatedID":18446744073709551615,"Request-URI":"u","To":"t","Type":"INVITE","X-Int":-9007199254740993,"X-Obj":{"b":1,"a":2}}`
+
+	m := &JSIP{}
+	assert(m.Unmarshal([]byte(data)) == nil)
+	assert(m.CSeq == 9007199254740993)
+
+	id, ok := m.GetUint("RelatedID")
+	assert(ok && id == 18446744073709551615)
+
+	i, ok := m.GetInt("X-Int")
+	assert(ok && i == -9007199254740993)
+
+	// unknown object kept as raw JSON
+	_, ok = m.GetString("X-Obj")
+	assert(!ok)
+	assert(string(m.rawMsg["X-Obj"].(jsipRaw)) == `{"b":1,"a":2}`)
+
+	out, err := m.Marshal()
+	assert(err == nil)
+	assert(string(out) == data)
+}
+
+func TestCodecLenient(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestCodecLenient")
+
+	// accepted as gjson does
+	data := `{"Type":"INVITE","CSeq":1,"DialogueID":"dlg","From":"f\u00","To":"t","Request-URI":"u","X":[1,2,}`
+	m := &JSIP{}
+	assert(m.Unmarshal([]byte(data)) == nil)
+	assert(m.From == "fu00")
+
+	// escaped key
+	data = `{"\u0054ype":"INVITE","CSeq":1,"DialogueID":"dlg","From":"f","To":"t","Request-URI":"u"}`
+	m = &JSIP{}
+	assert(m.Unmarshal([]byte(data)) == nil)
+	assert(m.Type == INVITE && len(m.rawMsg) == 0)
+
+	for _, data := range []string{``, `{`, `{"Type"`, `{"Type":"INVITE",`, `{"Type":}`} {
+		m := &JSIP{}
+		assert(m.Unmarshal([]byte(data)) != nil)
+	}
+}
+
+func FuzzJSIPCodec(f *testing.F) {
+	for _, data := range codecCorpus {
+		f.Add([]byte(data))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// encoded msg decoded and encoded again is the same
+		m := &JSIP{}
+		if m.Unmarshal(data) == nil {
+			if out, err := m.Marshal(); err == nil {
+				m2 := &JSIP{}
+				if err := m2.Unmarshal(out); err != nil {
+					t.Fatalf("decode %q err: %s", out, err)
+				}
+
+				out2, err := m2.Marshal()
+				if err != nil || !bytes.Equal(out, out2) {
+					t.Fatalf("encode %q, again %q", out, out2)
+				}
+			}
+		}
+
+		// msg in current wire format is forwarded byte for byte
+		wire, err := legacyForward(data)
+		if err != nil {
+			return
+		}
+
+		legacy := &JSIP{}
+		legacyUnmarshal(legacy, wire)
+
+		m = &JSIP{}
+		if err := m.Unmarshal(wire); err != nil {
+			t.Fatalf("decode %q err: %s", wire, err)
+		}
+
+		if m.Type != legacy.Type || m.Code != legacy.Code ||
+			m.RequestURI != legacy.RequestURI || m.From != legacy.From ||
+			m.To != legacy.To || m.DialogueID != legacy.DialogueID ||
+			strings.Join(m.Router, ",") != strings.Join(legacy.Router, ",") {
+
+			t.Fatalf("decode %q, fields differ from legacy codec", wire)
+		}
+
+		out, err := m.Marshal()
+		if err != nil || !bytes.Equal(out, wire) {
+			t.Fatalf("encode %q, legacy %q", out, wire)
+		}
+	})
+}
+
+var benchMsg = []byte(`{"Body":{"sdp":"v=0\r\no=- 4611731400430051336 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n","type":"offer"},"CSeq":1,"DialogueID":"6c2ab1e9-6b5f-4f0e-9d8e-6d2fd5f0b1a7","Expire":600,"From":"alice@gortc.com","P-Asserted-Identity":"alice","RelatedID":3,"Request-URI":"bob@gortc.com","Router":"rtcbroker1, rtcbroker2","To":"bob@gortc.com","Type":"INVITE"}`)
+
+func BenchmarkJSIPUnmarshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := &JSIP{}
+		if err := m.Unmarshal(benchMsg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSIPUnmarshalLegacy(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m := &JSIP{}
+		if err := legacyUnmarshal(m, benchMsg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSIPMarshal(b *testing.B) {
+	m := &JSIP{}
+	m.Unmarshal(benchMsg)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSIPMarshalLegacy(b *testing.B) {
+	m := &JSIP{}
+	legacyUnmarshal(m, benchMsg)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := legacyMarshal(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP msg encodings negotiated by websocket subprotocol. JSON is the default
+// encoding, MessagePack and CBOR are compact encodings for clients on poor
+// links and trunks between rtc servers.
+//
+// Binary encoded msg is a map of headers as JSON object, integral numbers
+// are encoded as integers. Msgs decoded are the same as JSON ones for SLPs,
+// numbers in Body are float64 as decoded from JSON.
+
+package rtclib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/alexwoo/golib"
+)
+
+// Websocket subprotocols of JSIP encodings
+const (
+	JSIPSubprotoJSON    = "jsip.json"
+	JSIPSubprotoMsgpack = "jsip.msgpack"
+	JSIPSubprotoCBOR    = "jsip.cbor"
+)
+
+// max depth of nested arrays and maps in binary msg
+const binaryMaxDepth = 512
+
+var (
+	errBinaryTruncated = errors.New("binary msg truncated")
+	errBinaryDepth     = errors.New("binary msg nested too deep")
+	errBinaryKey       = errors.New("binary msg map key is not string")
+)
+
+// Binary encoding of JSIP msg
+type jsipBinaryCodec interface {
+	appendNil(b []byte) []byte
+	appendBool(b []byte, v bool) []byte
+	appendInt(b []byte, v int64) []byte
+	appendUint(b []byte, v uint64) []byte
+	appendFloat(b []byte, v float64) []byte
+	appendString(b []byte, s string) []byte
+	appendArray(b []byte, n int) []byte
+	appendMap(b []byte, n int) []byte
+
+	// decode one value into nil, bool, int64, uint64, float64, string,
+	// []interface{} or map[string]interface{}
+	decode(data []byte) (interface{}, error)
+}
+
+var jsipBinaryCodecs = map[string]jsipBinaryCodec{
+	JSIPSubprotoMsgpack: msgpackCodec{},
+	JSIPSubprotoCBOR:    cborCodec{},
+}
+
+// JSIP subprotocol of encoding name json, msgpack or cbor,
+// return "" if encoding not supported
+func JSIPSubprotocol(encoding string) string {
+	p := "jsip." + encoding
+	if !IsJSIPSubprotocol(p) {
+		return ""
+	}
+
+	return p
+}
+
+// Whether websocket subprotocol is a JSIP encoding supported
+func IsJSIPSubprotocol(p string) bool {
+	return p == JSIPSubprotoJSON || jsipBinaryCodecs[p] != nil
+}
+
+// Whether websocket subprotocol is a binary JSIP encoding, msgs of which are
+// sent in websocket binary messages
+func IsJSIPBinarySubprotocol(p string) bool {
+	return jsipBinaryCodecs[p] != nil
+}
+
+// connection with JSIP encoding negotiated
+type codecConn interface {
+	codec() jsipBinaryCodec
+}
+
+// binary codec of connection, nil for JSON
+func connCodec(conn golib.Conn) jsipBinaryCodec {
+	if c, ok := conn.(codecConn); ok {
+		return c.codec()
+	}
+
+	return nil
+}
+
+func (m *JSIP) encodeBinary(c jsipBinaryCodec) ([]byte, error) {
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+
+	e := jsipEncodePool.Get().(*jsipEncodeState)
+	defer e.put()
+
+	router := m.router()
+	keys := m.headerKeys(e.keys[:0], router)
+	e.keys = keys
+
+	var err error
+	b := c.appendMap(e.buf[:0], len(keys))
+	for _, k := range keys {
+		b = c.appendString(b, k)
+
+		var v interface{}
+		switch {
+		case !m.coreHeader(k):
+			v = m.rawMsg[k]
+		case k == "Type" && m.Code == 0:
+			v = m.Type.String()
+		case k == "Type":
+			v = "RESPONSE"
+		case k == "Request-URI":
+			v = m.RequestURI
+		case k == "Router":
+			v = router
+		case k == "Code":
+			v = m.Code
+		case k == "Desc":
+			v = JSIPRespDesc(m.Code)
+		case k == "From":
+			v = m.From
+		case k == "To":
+			v = m.To
+		case k == "CSeq":
+			v = m.CSeq
+		case k == "DialogueID":
+			v = m.DialogueID
+		case k == "Body":
+			v = m.Body
+		}
+
+		if b, err = appendBinaryValue(c, b, v); err != nil {
+			e.buf = b
+			return nil, err
+		}
+	}
+	e.buf = b
+
+	out := make([]byte, len(b))
+	copy(out, b)
+
+	return out, nil
+}
+
+// encode value with binary codec, values not common are converted by
+// encoding/json as JSON encoding
+func appendBinaryValue(c jsipBinaryCodec, b []byte,
+	v interface{}) ([]byte, error) {
+
+	switch v := v.(type) {
+	case nil:
+		return c.appendNil(b), nil
+	case string:
+		return c.appendString(b, v), nil
+	case bool:
+		return c.appendBool(b, v), nil
+	case int:
+		return c.appendInt(b, int64(v)), nil
+	case int64:
+		return c.appendInt(b, v), nil
+	case uint64:
+		return c.appendUint(b, v), nil
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 &&
+			!(v == 0 && math.Signbit(v)) {
+
+			return c.appendInt(b, int64(v)), nil
+		}
+
+		return c.appendFloat(b, v), nil
+	case jsipRaw:
+		tree, err := jsonTree(v)
+		if err != nil {
+			return b, err
+		}
+
+		return appendBinaryValue(c, b, tree)
+	case map[string]interface{}:
+		if v == nil {
+			return c.appendNil(b), nil
+		}
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sortStrings(keys)
+
+		var err error
+		b = c.appendMap(b, len(v))
+		for _, k := range keys {
+			b = c.appendString(b, k)
+			if b, err = appendBinaryValue(c, b, v[k]); err != nil {
+				return b, err
+			}
+		}
+
+		return b, nil
+	case []interface{}:
+		if v == nil {
+			return c.appendNil(b), nil
+		}
+
+		var err error
+		b = c.appendArray(b, len(v))
+		for _, e := range v {
+			if b, err = appendBinaryValue(c, b, e); err != nil {
+				return b, err
+			}
+		}
+
+		return b, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return b, err
+	}
+
+	tree, err := jsonTree(data)
+	if err != nil {
+		return b, err
+	}
+
+	return appendBinaryValue(c, b, tree)
+}
+
+// decode JSON into values, integers are kept in int64 or uint64
+func jsonTree(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return jsonNumbers(v), nil
+}
+
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, ok := decodeJSONNumber([]byte(v)); ok {
+			return n
+		}
+
+		return string(v)
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonNumbers(e)
+		}
+	}
+
+	return v
+}
+
+func (m *JSIP) decodeBinary(c jsipBinaryCodec, data []byte) error {
+	v, err := c.decode(data)
+	if err != nil {
+		return err
+	}
+
+	h, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("raw is not map")
+	}
+
+	t, ok := h["Type"].(string)
+	if !ok {
+		return errors.New("Type error")
+	}
+
+	if t == "RESPONSE" {
+		if m.Code, ok = binaryInt(h["Code"]); !ok {
+			return errors.New("Code error")
+		}
+
+		if JSIPRespType(m.Code) < JSIPProvisionalResp {
+			return errors.New("Invalid Code")
+		}
+	} else {
+		m.Type = NewJSIPType(t)
+		if m.Type == JSIPType(Unknown) {
+			return errors.New("Unknown Type")
+		}
+
+		if m.RequestURI, ok = h["Request-URI"].(string); !ok {
+			return errors.New("Request-URI error")
+		}
+
+		if routers, ok := h["Router"].(string); ok {
+			m.Router = splitRouter(routers)
+		}
+	}
+
+	if m.From, ok = h["From"].(string); !ok {
+		return errors.New("From error")
+	}
+
+	if m.To, ok = h["To"].(string); !ok {
+		return errors.New("To error")
+	}
+
+	if m.CSeq, ok = binaryUint64(h["CSeq"]); !ok {
+		return errors.New("CSeq error")
+	}
+
+	if m.DialogueID, ok = h["DialogueID"].(string); !ok {
+		return errors.New("DialogueID error")
+	}
+
+	// Body null is kept as header
+	m.Body = binaryBody(h["Body"])
+
+	// headers not known by JSIP stack, as decoded from JSON
+	for k, v := range h {
+		if m.coreHeader(k) {
+			continue
+		}
+
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			raw, err := appendJSONValue(nil, v)
+			if err != nil {
+				return err
+			}
+			v = jsipRaw(raw)
+		}
+		m.setHeader(k, v)
+	}
+
+	return nil
+}
+
+func binaryInt(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int64:
+		return int(v), true
+	case uint64:
+		return int(v), true
+	case float64:
+		return int(v), true
+	}
+
+	return 0, false
+}
+
+func binaryUint64(v interface{}) (uint64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case float64:
+		return uint64(v), true
+	}
+
+	return 0, false
+}
+
+// numbers in Body are float64 as Body decoded from JSON
+func binaryBody(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = binaryBody(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = binaryBody(e)
+		}
+	}
+
+	return v
+}
+
+// decoder of binary msg
+type binaryDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *binaryDecoder) end() bool {
+	return d.pos >= len(d.data)
+}
+
+func (d *binaryDecoder) byte() (byte, error) {
+	if d.end() {
+		return 0, errBinaryTruncated
+	}
+
+	c := d.data[d.pos]
+	d.pos++
+
+	return c, nil
+}
+
+func (d *binaryDecoder) take(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errBinaryTruncated
+	}
+
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+
+	return b, nil
+}
+
+// n bytes unsigned integer in network byte order
+func (d *binaryDecoder) uint(n int) (uint64, error) {
+	b, err := d.take(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+
+	return v, nil
+}
+
+// every item in array or map has one byte at least, check count before
+// allocate
+func (d *binaryDecoder) count(n uint64, size uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos)/size {
+		return 0, errBinaryTruncated
+	}
+
+	return int(n), nil
+}
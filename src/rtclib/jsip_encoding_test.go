@@ -0,0 +1,381 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP encoding Test Case
+
+package rtclib
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+	"github.com/gorilla/websocket"
+)
+
+// connection negotiated binary encoding
+type testCodecConn struct {
+	golib.Conn
+	c jsipBinaryCodec
+}
+
+func (c *testCodecConn) codec() jsipBinaryCodec {
+	return c.c
+}
+
+// JSON equal, key order of objects ignored
+func jsonEqual(a []byte, b []byte) bool {
+	va, err := jsonTree(a)
+	if err != nil {
+		return false
+	}
+
+	vb, err := jsonTree(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestEncodingVectors(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestEncodingVectors")
+
+	v := map[string]interface{}{
+		"a": int64(1),
+		"b": []interface{}{true, nil, int64(-1), "x", int64(300), int64(-200),
+			1.5},
+	}
+
+	mp := []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x97, 0xc3, 0xc0, 0xff,
+		0xa1, 'x', 0xcd, 0x01, 0x2c, 0xd1, 0xff, 0x38,
+		0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}
+	cb := []byte{0xa2, 0x61, 'a', 0x01, 0x61, 'b', 0x87, 0xf5, 0xf6, 0x20,
+		0x61, 'x', 0x19, 0x01, 0x2c, 0x38, 0xc7,
+		0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}
+
+	for _, c := range []struct {
+		codec jsipBinaryCodec
+		data  []byte
+	}{{msgpackCodec{}, mp}, {cborCodec{}, cb}} {
+		b, err := appendBinaryValue(c.codec, nil, v)
+		assert(err == nil)
+		assert(bytes.Equal(b, c.data))
+
+		d, err := c.codec.decode(b)
+		assert(err == nil)
+		assert(reflect.DeepEqual(d, v))
+
+		// integral float and raw JSON
+		b, err = appendBinaryValue(c.codec, nil, jsipRaw(`{"b":[1,2.0],"a":1}`))
+		assert(err == nil)
+		d, err = c.codec.decode(b)
+		assert(err == nil)
+		assert(reflect.DeepEqual(d, map[string]interface{}{
+			"a": int64(1), "b": []interface{}{int64(1), int64(2)}}))
+
+		// 64-bit integers
+		for _, n := range []interface{}{int64(math.MinInt64),
+			int64(math.MaxInt64), uint64(math.MaxUint64)} {
+
+			b, err = appendBinaryValue(c.codec, nil, n)
+			assert(err == nil)
+			d, err = c.codec.decode(b)
+			assert(err == nil && d == n)
+		}
+	}
+
+	// encoded by other implementations
+	for _, c := range []struct {
+		codec jsipBinaryCodec
+		data  []byte
+		v     interface{}
+	}{
+		{msgpackCodec{}, []byte{0xca, 0x3f, 0xc0, 0, 0}, 1.5},
+		{msgpackCodec{}, []byte{0xc4, 0x01, 'a'}, "a"},
+		{msgpackCodec{}, []byte{0xd0, 0x80}, int64(-128)},
+		{msgpackCodec{}, []byte{0xde, 0x00, 0x01, 0xa1, 'a', 0x01},
+			map[string]interface{}{"a": int64(1)}},
+		{cborCodec{}, []byte{0xbf, 0x61, 'a', 0x01, 0xff},
+			map[string]interface{}{"a": int64(1)}},
+		{cborCodec{}, []byte{0x9f, 0x01, 0x9f, 0xff, 0xff},
+			[]interface{}{int64(1), []interface{}{}}},
+		{cborCodec{}, []byte{0x7f, 0x61, 'a', 0x61, 'b', 0xff}, "ab"},
+		{cborCodec{}, []byte{0x5f, 0x41, 'a', 0xff}, "a"},
+		{cborCodec{}, []byte{0xf9, 0x3c, 0x00}, 1.0},
+		{cborCodec{}, []byte{0xf9, 0x00, 0x01}, math.Ldexp(1, -24)},
+		{cborCodec{}, []byte{0xfa, 0x3f, 0xc0, 0, 0}, 1.5},
+		{cborCodec{}, []byte{0xc1, 0x1a, 0, 0, 0, 0x01}, int64(1)},
+		{cborCodec{}, []byte{0xf7}, nil},
+	} {
+		d, err := c.codec.decode(c.data)
+		assert(err == nil)
+		assert(reflect.DeepEqual(d, c.v))
+	}
+
+	deep := bytes.Repeat([]byte{0x91}, binaryMaxDepth+1)
+	for _, c := range []struct {
+		codec jsipBinaryCodec
+		data  []byte
+	}{
+		{msgpackCodec{}, nil},
+		{msgpackCodec{}, []byte{0xa2, 'a'}},
+		{msgpackCodec{}, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{msgpackCodec{}, []byte{0x81, 0x01, 0x01}},
+		{msgpackCodec{}, []byte{0xc0, 0xc0}},
+		{msgpackCodec{}, []byte{0xd4, 0x01, 0x01}},
+		{msgpackCodec{}, append(deep, 0xc0)},
+		{cborCodec{}, []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff}},
+		{cborCodec{}, []byte{0xbf, 0x61, 'a'}},
+		{cborCodec{}, []byte{0xa1, 0x01, 0x01}},
+		{cborCodec{}, []byte{0x7f, 0x41, 'a', 0xff}},
+		{cborCodec{}, []byte{0xff}},
+		{cborCodec{}, []byte{0x1c}},
+		{cborCodec{}, append(bytes.Repeat([]byte{0x81}, binaryMaxDepth+1),
+			0xf6)},
+	} {
+		_, err := c.codec.decode(c.data)
+		assert(err != nil)
+	}
+}
+
+func TestEncodingCodec(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestEncodingCodec")
+
+	req := JSIPMsgReq(INVITE, "jsip.com", "<alex>", "jsip", "dlg")
+	req.Router = []string{"r1", "r2"}
+	req.Body = map[string]interface{}{
+		"k": []interface{}{"v", float64(1), nil, true},
+		"i": 10,
+		"s": struct{ A int }{1},
+	}
+	req.SetUint("RelatedID", 3)
+	req.SetInt("X-Int", -3)
+	req.SetString("X-Str", "\x01\xff")
+	res := JSIPMsgRes(req, 603)
+
+	msgs := []*JSIP{req, res}
+	for _, data := range codecCorpus {
+		m := &JSIP{}
+		assert(m.Unmarshal([]byte(data)) == nil)
+		msgs = append(msgs, m)
+	}
+
+	for _, codec := range jsipBinaryCodecs {
+		conn := &testCodecConn{c: codec}
+
+		for _, m := range msgs {
+			wire, err := m.Marshal()
+			assert(err == nil)
+
+			m.conn = conn
+			data, err := m.Marshal()
+			m.conn = nil
+			assert(err == nil)
+			assert(data[0] != '{')
+
+			// msg decoded is the same as from JSON
+			b := &JSIP{conn: conn}
+			assert(b.Unmarshal(data) == nil)
+			out, err := b.Marshal()
+			assert(err == nil)
+			assert(bytes.Equal(out, data))
+
+			b.conn = nil
+			out, err = b.Marshal()
+			assert(err == nil)
+			assert(jsonEqual(out, wire))
+
+			j := &JSIP{}
+			assert(j.Unmarshal(wire) == nil)
+			assert(reflect.DeepEqual(b.Body, j.Body))
+			assert(b.CSeq == j.CSeq && reflect.DeepEqual(b.Router, j.Router))
+		}
+
+		for _, data := range [][]byte{nil, {0x01}, {0x80},
+			codec.appendMap(codec.appendString(codec.appendMap(nil, 1),
+				"Type"), 0)} {
+
+			m := &JSIP{conn: conn}
+			assert(m.Unmarshal(data) != nil)
+		}
+	}
+
+	// msg not negotiated is JSON
+	m := &JSIP{conn: &testCodecConn{}}
+	assert(m.Unmarshal([]byte(codecCorpus[0])) == nil)
+}
+
+func TestEncodingSubprotocol(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestEncodingSubprotocol")
+
+	assert(JSIPSubprotocol("json") == JSIPSubprotoJSON)
+	assert(JSIPSubprotocol("msgpack") == JSIPSubprotoMsgpack)
+	assert(JSIPSubprotocol("cbor") == JSIPSubprotoCBOR)
+	assert(JSIPSubprotocol("xml") == "")
+	assert(IsJSIPSubprotocol(JSIPSubprotoJSON))
+	assert(!IsJSIPBinarySubprotocol(JSIPSubprotoJSON))
+	assert(IsJSIPBinarySubprotocol(JSIPSubprotoCBOR))
+	assert(!IsJSIPSubprotocol("sip"))
+}
+
+// websocket server negotiate subprotocol as rtc server
+func testEncodingServer(subprotos bool, srvC chan *JSIP) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			subproto := ""
+			for _, p := range websocket.Subprotocols(req) {
+				if subprotos && IsJSIPSubprotocol(p) {
+					subproto = p
+					break
+				}
+			}
+
+			upgrader := websocket.Upgrader{}
+			if subproto != "" {
+				upgrader.Subprotocols = []string{subproto}
+			}
+
+			c, err := upgrader.Upgrade(w, req, nil)
+			assert(err == nil)
+
+			opts := &TransportOpts{
+				Qsize: 16,
+				Handler: func(c golib.Conn, data []byte) {
+					m := &JSIP{conn: c}
+					assert(m.Unmarshal(data) == nil)
+					srvC <- m
+
+					// echo in encoding negotiated
+					data, err := JSIPMsgRes(m, 200).Marshal()
+					assert(err == nil)
+					c.Send(data)
+				},
+				Log: tlog,
+			}
+
+			// text message if not binary encoding
+			NewWSServerConn("test", c, opts).Accept()
+		}))
+}
+
+func testEncodingDial(encoding string, subprotos bool, binary bool) {
+	srvC := make(chan *JSIP, 1)
+	cliC := make(chan []byte, 1)
+
+	s := testEncodingServer(subprotos, srvC)
+	defer s.Close()
+
+	opts := &TransportOpts{
+		Location:    "/rtc",
+		Timeout:     time.Second,
+		Retry:       1,
+		Qsize:       16,
+		Subprotocol: JSIPSubprotocol(encoding),
+		Handler: func(c golib.Conn, data []byte) {
+			cliC <- data
+		},
+		Log: tlog,
+	}
+
+	hostport := strings.TrimPrefix(s.URL, "http://")
+	c := GetTransport("ws").Dial("test", hostport, "test", opts)
+	assert(c != nil)
+	defer c.Close()
+
+	// encoded in JSON before connected, transcoded when sent
+	req := JSIPMsgReq(MESSAGE, "jsip.com", "alice", "bob", "dlg")
+	req.Body = map[string]interface{}{"n": float64(1)}
+	req.conn = c
+	data, err := req.Marshal()
+	assert(err == nil)
+	c.Send(data)
+
+	select {
+	case m := <-srvC:
+		assert(m.Type == MESSAGE && m.DialogueID == "dlg")
+		assert(reflect.DeepEqual(m.Body, req.Body))
+	case <-time.After(time.Second):
+		assert(false)
+	}
+
+	select {
+	case data := <-cliC:
+		assert((data[0] != '{') == binary)
+
+		m := &JSIP{conn: c}
+		assert(m.Unmarshal(data) == nil)
+		assert(m.Code == 200 && m.DialogueID == "dlg")
+	case <-time.After(time.Second):
+		assert(false)
+	}
+}
+
+func TestEncodingWebsocket(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestEncodingWebsocket")
+
+	testEncodingDial("msgpack", true, true)
+	testEncodingDial("cbor", true, true)
+
+	// peer not support subprotocols, fall back to JSON
+	testEncodingDial("cbor", false, false)
+}
+
+func FuzzJSIPBinaryCodec(f *testing.F) {
+	for _, data := range codecCorpus {
+		m := &JSIP{}
+		if m.Unmarshal([]byte(data)) != nil {
+			continue
+		}
+
+		for _, codec := range jsipBinaryCodecs {
+			m.conn = &testCodecConn{c: codec}
+			b, _ := m.Marshal()
+			f.Add(b)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, codec := range jsipBinaryCodecs {
+			conn := &testCodecConn{c: codec}
+
+			m := &JSIP{conn: conn}
+			if m.Unmarshal(data) != nil {
+				continue
+			}
+
+			// msgs decoded are encoded stable, and as JSON
+			out, err := m.Marshal()
+			if err != nil {
+				continue
+			}
+
+			b := &JSIP{conn: conn}
+			if b.Unmarshal(out) != nil {
+				t.Fatalf("decode encoded msg failed: %x", out)
+			}
+
+			again, err := b.Marshal()
+			if err != nil || !bytes.Equal(again, out) {
+				t.Fatalf("encode not stable: %x %x", out, again)
+			}
+
+			m.conn, b.conn = nil, nil
+			j1, err1 := m.Marshal()
+			j2, err2 := b.Marshal()
+			if (err1 == nil) != (err2 == nil) ||
+				(err1 == nil && !jsonEqual(j1, j2)) {
+
+				t.Fatalf("JSON differs: %s %s", j1, j2)
+			}
+		}
+	})
+}
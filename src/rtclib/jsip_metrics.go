@@ -0,0 +1,56 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Stack metrics
+
+package rtclib
+
+import (
+	"strconv"
+)
+
+var (
+	jsipRecvMsgs = NewCounter("jsip_msgs_received_total",
+		"JSIP messages received by type and class", "type", "class")
+
+	jsipSentMsgs = NewCounter("jsip_msgs_sent_total",
+		"JSIP messages sent by type and class", "type", "class")
+
+	jsipTransTimeouts = NewCounter("jsip_transaction_timeouts_total",
+		"JSIP transactions timeout by type", "type")
+
+	jsipSessions = NewGauge("jsip_sessions",
+		"JSIP INVITE sessions by state", "state")
+)
+
+// class of JSIP msg, request or response class as 2xx
+func jsipMsgClass(m *JSIP) string {
+	if m.Code == 0 {
+		return "request"
+	}
+
+	return strconv.Itoa(m.Code/100) + "xx"
+}
+
+func (s *JSIPStack) initMetrics() {
+	NewGaugeFunc("jsip_queue_length", "JSIP Stack queue length", "queue",
+		func() map[string]float64 {
+			queues := map[string]float64{}
+			for _, sh := range s.shards {
+				queues["recvq"] += float64(len(sh.recvq))
+				queues["sendq"] += float64(len(sh.sendq))
+				queues["transq"] += float64(len(sh.transq))
+				queues["sessq"] += float64(len(sh.sessq))
+			}
+
+			return queues
+		})
+
+	NewGaugeFunc("jsip_users", "Users connected to rtc server with userid", "",
+		func() map[string]float64 {
+			s.usersLock.RLock()
+			defer s.usersLock.RUnlock()
+
+			return map[string]float64{"": float64(len(s.users))}
+		})
+}
@@ -6,15 +6,11 @@
 package rtclib
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
-	"strings"
 
 	"github.com/alexwoo/golib"
-	"github.com/tidwall/gjson"
 )
 
 type JSIP struct {
@@ -31,9 +27,10 @@ type JSIP struct {
 	Userid string
 	Term   bool
 
-	conn   golib.Conn
-	rawMsg map[string]interface{}
-	recv   bool
+	conn     golib.Conn
+	rawMsg   map[string]interface{}
+	recv     bool
+	authUser string // user authenticated by JSIP auth
 }
 
 // for log ctx
@@ -71,130 +68,26 @@ func (m *JSIP) LogLevel() int {
 	return golib.LOGINFO
 }
 
-// Marshal JSIP Message to []byte
+// Marshal JSIP Message to []byte, in encoding negotiated by connection of
+// msg, JSON if not negotiated
 func (m *JSIP) Marshal() ([]byte, error) {
-	typ := JSIPRespType(m.Code)
-	if typ == JSIPResponseType(Unknown) {
-		return nil, errors.New("Invalid Code")
-	} else if typ == JSIPReq {
-		m.rawMsg["Type"] = m.Type.String()
-		if m.rawMsg["Type"] == "UNKNOWN" {
-			return nil, errors.New("Unknow Type")
-		}
-
-		if m.RequestURI == "" {
-			return nil, errors.New("No RequestURI")
-		}
-		m.rawMsg["Request-URI"] = m.RequestURI
-
-		router := ""
-		if len(m.Router) > 0 {
-			router = m.Router[0]
-			for i := 1; i < len(m.Router); i++ {
-				router += ", " + m.Router[i]
-			}
-		}
-
-		if router == "" {
-			delete(m.rawMsg, "Router")
-		} else {
-			m.rawMsg["Router"] = router
-		}
-	} else {
-		m.rawMsg["Type"] = "RESPONSE"
-		m.rawMsg["Code"] = m.Code
-		m.rawMsg["Desc"] = JSIPRespDesc(m.Code)
-	}
-
-	if m.From == "" {
-		return nil, errors.New("No From")
-	}
-	m.rawMsg["From"] = m.From
-
-	if m.To == "" {
-		return nil, errors.New("No To")
+	if c := connCodec(m.conn); c != nil {
+		return m.encodeBinary(c)
 	}
-	m.rawMsg["To"] = m.To
 
-	if m.CSeq == 0 {
-		return nil, errors.New("No CSeq")
-	}
-	m.rawMsg["CSeq"] = m.CSeq
-
-	if m.DialogueID == "" {
-		return nil, errors.New("No DialogueID")
-	}
-	m.rawMsg["DialogueID"] = m.DialogueID
-
-	if m.Body != nil {
-		m.rawMsg["Body"] = m.Body
-	}
-
-	return json.Marshal(m.rawMsg)
+	return m.encode()
 }
 
-// Unmarshal JSIP Message from []byte
+// Unmarshal JSIP Message from []byte, in encoding negotiated by connection of
+// msg, JSON if not negotiated
 func (m *JSIP) Unmarshal(raw []byte) error {
-	rawMsg, ok := gjson.ParseBytes(raw).Value().(map[string]interface{})
-	if !ok {
-		return errors.New("raw is not json object")
-	}
-
-	m.rawMsg = rawMsg
-
-	typ, ok := rawMsg["Type"].(string)
-	if !ok {
-		return errors.New("Type error")
-	}
-
-	if typ == "RESPONSE" {
-		if m.Code, ok = getJsonInt(rawMsg, "Code"); !ok {
-			return errors.New("Code error")
-		}
-
-		if JSIPRespType(m.Code) < JSIPProvisionalResp {
-			return errors.New("Invalid Code")
-		}
-	} else {
-		m.Type = NewJSIPType(typ)
-		if m.Type == JSIPType(Unknown) {
-			return errors.New("Unknown Type")
-		}
-
-		if m.RequestURI, ok = rawMsg["Request-URI"].(string); !ok {
-			return errors.New("Request-URI error")
-		}
-
-		if routers, ok := rawMsg["Router"].(string); ok {
-			m.Router = strings.Split(routers, ",")
-			for i := 0; i < len(m.Router); i++ {
-				m.Router[i] = strings.TrimSpace(m.Router[i])
-			}
-		}
-	}
-
-	if m.From, ok = rawMsg["From"].(string); !ok {
-		return errors.New("From error")
-	}
-
-	if m.To, ok = rawMsg["To"].(string); !ok {
-		return errors.New("To error")
-	}
+	m.rawMsg = nil
 
-	if m.CSeq, ok = getJsonUint64(rawMsg, "CSeq"); !ok {
-		return errors.New("CSeq error")
+	if c := connCodec(m.conn); c != nil {
+		return m.decodeBinary(c, raw)
 	}
 
-	if m.DialogueID, ok = rawMsg["DialogueID"].(string); !ok {
-		return errors.New("DialogueID error")
-	}
-
-	body := gjson.GetBytes(raw, "Body")
-	if body.Exists() {
-		m.Body = body.Value()
-	}
-
-	return nil
+	return m.decode(raw)
 }
 
 // Return JSIP Message Name, Request as INVITE, Response as INVITE_200
@@ -240,22 +133,40 @@ func (m *JSIP) String() string {
 
 // Get a header with int value from JSIP Message
 func (m *JSIP) GetInt(header string) (int64, bool) {
-	return getJsonInt64(m.rawMsg, header)
+	switch v := m.rawMsg[header].(type) {
+	case int64:
+		return v, true
+	case uint64:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	}
+
+	return 0, false
 }
 
 // Set a header with int value to JSIP Message
 func (m *JSIP) SetInt(header string, value int64) {
-	m.rawMsg[header] = float64(value)
+	m.setHeader(header, value)
 }
 
 // Get a header with uint value from JSIP Message
 func (m *JSIP) GetUint(header string) (uint64, bool) {
-	return getJsonUint64(m.rawMsg, header)
+	switch v := m.rawMsg[header].(type) {
+	case uint64:
+		return v, true
+	case int64:
+		return uint64(v), true
+	case float64:
+		return uint64(v), true
+	}
+
+	return 0, false
 }
 
 // Set a header with uint value to JSIP Message
 func (m *JSIP) SetUint(header string, value uint64) {
-	m.rawMsg[header] = float64(value)
+	m.setHeader(header, value)
 }
 
 // Get a header with string value from JSIP Message
@@ -267,7 +178,7 @@ func (m *JSIP) GetString(header string) (string, bool) {
 
 // Set a header with string value to JSIP Message
 func (m *JSIP) SetString(header string, value string) {
-	m.rawMsg[header] = value
+	m.setHeader(header, value)
 }
 
 // Delete a header from JSIP Message
@@ -6,6 +6,9 @@
 package rtclib
 
 import (
+	"encoding/json"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/alexwoo/golib"
@@ -56,13 +59,35 @@ type jsipSession struct {
 
 	inviteRecv     bool
 	updateRecv     bool
-	timer          *time.Timer
+	timer          *wheelTimer
 	sessionTimeout time.Duration
 	waitUpdateResp bool
 	failureCount   uint8
 
-	msgC      chan *JSIP
 	cancelled bool
+
+	// msgs and timer events are processed in caller goroutine one by one,
+	// no goroutine for each session
+	procLock sync.Mutex
+	ended    bool
+
+	// msgs to transaction layer or app layer wait for queue of shard
+	outLock  sync.Mutex
+	out      []sessionOut
+	flushing bool // msgs in out are sent by goroutine
+
+	raw      []byte // initial request marshalled for checkpoint
+	restored bool   // rehydrated from checkpoint after restart
+
+	created time.Time
+	expire  time.Time  // session timer expire time
+	lock    sync.Mutex // protect state and expire for runtime state query
+}
+
+// msg or term of session sent to shard
+type sessionOut struct {
+	msg  *JSIP
+	term bool
 }
 
 type jsipSessionInit struct {
@@ -73,6 +98,24 @@ type jsipSessionInit struct {
 	qsize               uint64
 	msg                 chan *JSIP
 	term                chan string
+
+	// store for checkpoint of established session, nil if not persisted
+	store StateStore
+	// userid of connection from peer, for restored session to find connection
+	peer string
+}
+
+// Checkpoint of established INVITE session
+type jsipSessionCheckpoint struct {
+	Req    json.RawMessage `json:"req"`
+	Recv   bool            `json:"recv"`
+	State  string          `json:"state"`
+	Expire int64           `json:"expire"` // unix nano of session timer expire
+	Peer   string          `json:"peer,omitempty"`
+}
+
+func sessionKey(dlg string) string {
+	return "sessions/" + dlg
 }
 
 func createSession(m *JSIP, init *jsipSessionInit, log *golib.Log) *jsipSession {
@@ -82,7 +125,7 @@ func createSession(m *JSIP, init *jsipSessionInit, log *golib.Log) *jsipSession
 		init:       init,
 		log:        log,
 		inviteRecv: m.recv,
-		msgC:       make(chan *JSIP, init.qsize),
+		created:    time.Now(),
 	}
 
 	if expire, ok := m.GetUint("Expire"); ok {
@@ -92,16 +135,160 @@ func createSession(m *JSIP, init *jsipSessionInit, log *golib.Log) *jsipSession
 		m.SetUint("Expire", uint64(s.init.sessionTimer.Seconds()))
 	}
 
+	// checkpoint is always JSON, whatever encoding of connection
+	if init.store != nil {
+		raw, err := m.encode()
+		if err != nil {
+			log.LogError(m, "Marshal INVITE for checkpoint err: %s", err.Error())
+		}
+		s.raw = raw
+	}
+
+	jsipSessions.Add(1, s.state.String())
+
+	s.procLock.Lock()
+	defer s.procLock.Unlock()
+
 	// make sure transaction timer trigger first
-	s.timer = time.NewTimer(s.init.prTimer)
+	s.timer = sharedWheel().AfterFunc(s.init.prTimer, s.onTimer)
+	s.expire = s.created.Add(s.init.prTimer)
 
-	go s.loop()
+	s.output(s.req)
 
 	return s
 }
 
+// rehydrate session in INVITE_ACK from checkpoint, connection of session is
+// bound when peer sends msg, or found by init.peer
+func restoreSession(data []byte, init *jsipSessionInit,
+	log *golib.Log) (*jsipSession, error) {
+
+	cp := &jsipSessionCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+
+	m := &JSIP{recv: cp.Recv}
+	if err := m.Unmarshal(cp.Req); err != nil {
+		return nil, err
+	}
+
+	if m.Type != INVITE || m.Code != 0 {
+		return nil, errors.New("checkpoint is not INVITE session")
+	}
+
+	init.peer = cp.Peer
+
+	s := &jsipSession{
+		req:        m,
+		state:      INVITE_ACK,
+		init:       init,
+		log:        log,
+		inviteRecv: m.recv,
+		raw:        cp.Req,
+		restored:   true,
+		created:    time.Now(),
+		expire:     time.Unix(0, cp.Expire),
+	}
+
+	if expire, ok := m.GetUint("Expire"); ok {
+		init.sessionTimer = time.Duration(expire) * time.Second
+	}
+
+	if s.req.recv { // Wait for UPDATE from peer
+		s.sessionTimeout = s.init.sessionTimer
+	} else { // Send UPDATE to peer
+		s.sessionTimeout = s.init.sessionTimer / 3
+	}
+
+	jsipSessions.Add(1, s.state.String())
+
+	s.procLock.Lock()
+	defer s.procLock.Unlock()
+
+	// UPDATE missed during restart is sent at once, initial request of
+	// restored session has been processed before restart
+	d := time.Until(s.expire)
+	if d < 0 {
+		d = 0
+		s.expire = s.created
+	}
+	s.timer = sharedWheel().AfterFunc(d, s.onTimer)
+
+	return s, nil
+}
+
 func (s *jsipSession) onMsg(m *JSIP) {
-	s.msgC <- m
+	s.procLock.Lock()
+	defer s.procLock.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	s.process(m)
+}
+
+// send msg to shard, must be called with procLock
+func (s *jsipSession) output(m *JSIP) {
+	s.send(sessionOut{msg: m})
+}
+
+// send msg or term to shard without blocking, shard loop may be blocked on
+// procLock. If queue of shard is full, msgs are queued in session and sent
+// in order by a new goroutine
+func (s *jsipSession) send(o sessionOut) {
+	s.outLock.Lock()
+	defer s.outLock.Unlock()
+
+	if !s.flushing && s.trySend(o) {
+		return
+	}
+
+	s.out = append(s.out, o)
+	if !s.flushing {
+		s.flushing = true
+		go s.drain()
+	}
+}
+
+func (s *jsipSession) trySend(o sessionOut) bool {
+	if o.term {
+		select {
+		case s.init.term <- s.req.DialogueID:
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case s.init.msg <- o.msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// send msgs queued in session, without procLock
+func (s *jsipSession) drain() {
+	s.outLock.Lock()
+	for len(s.out) > 0 {
+		o := s.out[0]
+		s.out = s.out[1:]
+		s.outLock.Unlock()
+
+		if o.term {
+			s.init.term <- s.req.DialogueID
+		} else {
+			s.init.msg <- o.msg
+		}
+
+		s.outLock.Lock()
+	}
+	s.out = nil
+	s.flushing = false
+	s.outLock.Unlock()
 }
 
 func (s *jsipSession) quit() {
@@ -109,98 +296,206 @@ func (s *jsipSession) quit() {
 	byeIn.recv = true
 	byeOut := JSIPMsgBye(s.req)
 
-	s.init.msg <- byeIn
-	s.msgC <- byeOut
+	s.output(byeIn)
+	s.process(byeOut)
 }
 
-func (s *jsipSession) loop() {
-	defer func() {
-		s.init.msg <- JSIPMsgTerm(s.req.DialogueID)
-		s.init.term <- s.req.DialogueID
-	}()
+func (s *jsipSession) setState(state jsipSessionState) {
+	if state == s.state {
+		return
+	}
 
-	s.init.msg <- s.req
+	jsipSessions.Add(-1, s.state.String())
+	jsipSessions.Add(1, state.String())
 
-	for {
-		select {
-		case msg := <-s.msgC:
-			if msg.Type == INFO {
-				s.init.msg <- msg
-				continue
-			}
-
-			process := s.getProcess()
-			if process == nil {
-				return
-			}
-
-			state, err := process(msg)
-			s.state = state
-
-			if err != nil {
-				if err.Error() != "Ignore" {
-					s.log.LogError(msg, "Process msg err: %s in %s", err.Error(), state.String())
-				}
-			} else {
-				s.init.msg <- msg
-			}
-
-			if s.state == INVITE_END {
-				return
-			}
-
-		case <-s.timer.C:
-			if s.state < INVITE_200 {
-				s.log.LogError(s.req, "Session Timeout at %s", s.state.String())
-
-				resp := JSIPMsgRes(s.req, 408)
-
-				if s.req.recv {
-					// Send CANCEL to app layer
-					cancel := JSIPMsgCancel(s.req)
-					cancel.recv = true
-
-					s.init.msg <- cancel
-
-					// Send 408 to peer
-					s.msgC <- resp
-				} else {
-					// Send 408 to app layer
-					resp.recv = true
-					s.init.msg <- resp
-
-					return
-				}
-
-				continue
-			}
-
-			if s.state >= INVITE_ERR {
-				return
-			}
-
-			// session Timeout
-			if s.req.recv { // Wait for session update from peer timeout
-				s.log.LogError(s.req, "Wait for session update from peer timeout")
-				s.quit()
-				continue
-			}
-
-			// failureCount will reset when receive UPDATE 200
-			s.failureCount++
-			if s.failureCount > s.init.sessionFailureCount {
-				s.log.LogError(s.req, "Wait for session update 200 failed")
-				s.quit()
-				continue
-			}
-
-			// send UPDATE
-			update := JSIPMsgUpdate(s.req)
-			update.SetUint("Expire", uint64(s.init.sessionTimer.Seconds()))
-
-			s.init.msg <- update
-
-			s.timer.Reset(s.sessionTimeout) // Set timer for send next UPDATE
+	s.lock.Lock()
+	s.state = state
+	s.lock.Unlock()
+
+	if state == INVITE_ACK {
+		s.checkpoint()
+	}
+}
+
+func (s *jsipSession) resetTimer(d time.Duration) {
+	s.timer.Reset(d)
+
+	s.lock.Lock()
+	s.expire = time.Now().Add(d)
+	s.lock.Unlock()
+
+	// session refreshed
+	if s.state >= INVITE_ACK && s.state < INVITE_ERR {
+		s.checkpoint()
+	}
+}
+
+// save established session into store, expired when peer gives up
+func (s *jsipSession) checkpoint() {
+	if s.init.store == nil || s.raw == nil {
+		return
+	}
+
+	s.lock.Lock()
+	cp := &jsipSessionCheckpoint{
+		Req:    s.raw,
+		Recv:   s.req.recv,
+		State:  s.state.String(),
+		Expire: s.expire.UnixNano(),
+		Peer:   s.init.peer,
+	}
+	ttl := time.Until(s.expire)
+	s.lock.Unlock()
+
+	// peer waits for UPDATE a whole session timer
+	if !s.req.recv {
+		ttl += s.init.sessionTimer - s.sessionTimeout
+	}
+
+	if ttl <= 0 {
+		s.forget()
+		return
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		s.log.LogError(s.req, "Marshal session checkpoint err: %s", err.Error())
+		return
+	}
+
+	if err := s.init.store.Set(sessionKey(s.req.DialogueID), data,
+		ttl); err != nil {
+
+		s.log.LogError(s.req, "Save session checkpoint err: %s", err.Error())
+	}
+}
+
+func (s *jsipSession) forget() {
+	if s.init.store == nil || s.raw == nil {
+		return
+	}
+
+	if err := s.init.store.Delete(sessionKey(s.req.DialogueID)); err != nil {
+		s.log.LogError(s.req, "Delete session checkpoint err: %s", err.Error())
+	}
+}
+
+func (s *jsipSession) info() *JSIPSessionInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	expire := time.Until(s.expire).Seconds()
+	if expire < 0 {
+		expire = 0
+	}
+
+	return &JSIPSessionInfo{
+		Dlg:    s.req.DialogueID,
+		State:  s.state.String(),
+		Age:    time.Since(s.created).Seconds(),
+		Expire: expire,
+	}
+}
+
+// session end, must be called with procLock
+func (s *jsipSession) end() {
+	s.ended = true
+	s.timer.Stop()
+
+	s.forget()
+	jsipSessions.Add(-1, s.state.String())
+	s.output(JSIPMsgTerm(s.req.DialogueID))
+	s.send(sessionOut{term: true})
+}
+
+// process msg, must be called with procLock
+func (s *jsipSession) process(msg *JSIP) {
+	if msg.Type == INFO {
+		s.output(msg)
+		return
+	}
+
+	process := s.getProcess()
+	if process == nil {
+		s.end()
+		return
+	}
+
+	state, err := process(msg)
+	s.setState(state)
+
+	if err != nil {
+		if err.Error() != "Ignore" {
+			s.log.LogError(msg, "Process msg err: %s in %s", err.Error(), state.String())
 		}
+	} else {
+		s.output(msg)
 	}
+
+	if s.state == INVITE_END {
+		s.end()
+	}
+}
+
+// session timer fired in goroutine of timing wheel
+func (s *jsipSession) onTimer() {
+	s.procLock.Lock()
+	defer s.procLock.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	if s.state < INVITE_200 {
+		s.log.LogError(s.req, "Session Timeout at %s", s.state.String())
+
+		resp := JSIPMsgRes(s.req, 408)
+
+		if s.req.recv {
+			// Send CANCEL to app layer
+			cancel := JSIPMsgCancel(s.req)
+			cancel.recv = true
+
+			s.output(cancel)
+
+			// Send 408 to peer
+			s.process(resp)
+		} else {
+			// Send 408 to app layer
+			resp.recv = true
+			s.output(resp)
+
+			s.end()
+		}
+
+		return
+	}
+
+	if s.state >= INVITE_ERR {
+		s.end()
+		return
+	}
+
+	// session Timeout
+	if s.req.recv { // Wait for session update from peer timeout
+		s.log.LogError(s.req, "Wait for session update from peer timeout")
+		s.quit()
+		return
+	}
+
+	// failureCount will reset when receive UPDATE 200
+	s.failureCount++
+	if s.failureCount > s.init.sessionFailureCount {
+		s.log.LogError(s.req, "Wait for session update 200 failed")
+		s.quit()
+		return
+	}
+
+	// send UPDATE
+	update := JSIPMsgUpdate(s.req)
+	update.SetUint("Expire", uint64(s.init.sessionTimer.Seconds()))
+
+	s.output(update)
+
+	s.resetTimer(s.sessionTimeout) // Set timer for send next UPDATE
 }
@@ -18,11 +18,11 @@ func (s *jsipSession) processSessionUpdate(m *JSIP) (jsipSessionState, error) {
 		return s.state, errors.New("Session update direction")
 	}
 
-	s.timer.Reset(s.sessionTimeout)
+	s.resetTimer(s.sessionTimeout)
 
 	// Send UPDATE 200 to peer
 	up200 := JSIPMsgRes(m, 200)
-	s.init.msg <- up200
+	s.output(up200)
 
 	return s.state, errors.New("Ignore")
 }
@@ -81,7 +81,7 @@ func (s *jsipSession) process2XX(m *JSIP) (jsipSessionState, error) {
 		s.sessionTimeout = s.init.sessionTimer / 3
 	}
 
-	s.timer.Reset(s.sessionTimeout)
+	s.resetTimer(s.sessionTimeout)
 
 	return INVITE_200, nil
 }
@@ -92,10 +92,10 @@ func (s *jsipSession) processErrResp(m *JSIP) (jsipSessionState, error) {
 	}
 
 	if m.recv {
-		s.init.msg <- JSIPMsgAck(m)
+		s.output(JSIPMsgAck(m))
 		return INVITE_END, nil
 	} else {
-		s.timer.Reset(s.init.transTimer)
+		s.resetTimer(s.init.transTimer)
 		return INVITE_ERR, nil
 	}
 }
@@ -118,10 +118,10 @@ func (s *jsipSession) processCancel(m *JSIP) (jsipSessionState, error) {
 	}
 
 	if m.recv {
-		s.init.msg <- JSIPMsgRes(m, 200)
-		s.init.msg <- JSIPMsgRes(s.req, 487)
+		s.output(JSIPMsgRes(m, 200))
+		s.output(JSIPMsgRes(s.req, 487))
 
-		s.timer.Reset(s.init.transTimer)
+		s.resetTimer(s.init.transTimer)
 
 		return INVITE_ERR, nil
 	} else {
@@ -202,7 +202,7 @@ func (s *jsipSession) processAck(m *JSIP) (jsipSessionState, error) {
 
 func (s *jsipSession) processBye(m *JSIP) (jsipSessionState, error) {
 	if m.recv {
-		s.init.msg <- JSIPMsgRes(m, 200)
+		s.output(JSIPMsgRes(m, 200))
 	}
 
 	return INVITE_END, nil
@@ -227,7 +227,7 @@ func (s *jsipSession) processReResp(m *JSIP) (jsipSessionState, error) {
 		return INVITE_RE200, nil
 	default: // Error Response will rollback
 		if m.recv {
-			s.init.msg <- JSIPMsgAck(m)
+			s.output(JSIPMsgAck(m))
 			return INVITE_ACK, nil
 		}
 
@@ -7,6 +7,8 @@ package rtclib
 
 import (
 	"fmt"
+	"runtime"
+	"strconv"
 	"testing"
 	"time"
 
@@ -1355,3 +1357,183 @@ func TestSessionTimeout(t *testing.T) {
 	}
 	testSession(m, ct, 9*time.Second)
 }
+
+func TestSessionCheckpoint(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSessionCheckpoint")
+
+	store := NewMemoryStore()
+
+	m := JSIPMsgReq(INVITE, "jsip.com", "jsip", "jsip", "checkpoint")
+	m.CSeq = 1
+	m.recv = true
+
+	init := &jsipSessionInit{
+		sessionFailureCount: 3,
+		sessionTimer:        time.Second * 10,
+		prTimer:             time.Second * 3,
+		transTimer:          time.Second * 1,
+		qsize:               1024,
+		msg:                 make(chan *JSIP, 1024),
+		term:                make(chan string, 1),
+		store:               store,
+		peer:                "peer",
+	}
+
+	s := createSession(m, init, slog)
+	assert(<-init.msg == m)
+
+	resp200 := JSIPMsgRes(m, 200)
+	s.onMsg(resp200)
+	assert(<-init.msg == resp200)
+
+	_, ok := store.Get(sessionKey(m.DialogueID))
+	assert(!ok)
+
+	ack := JSIPMsgAck(resp200)
+	ack.recv = true
+	s.onMsg(ack)
+	assert(<-init.msg == ack)
+
+	data, ok := store.Get(sessionKey(m.DialogueID))
+	assert(ok)
+
+	// store reloaded after gortc restart
+	store = NewMemoryStore()
+	store.Set(sessionKey(m.DialogueID), data, 0)
+
+	init = &jsipSessionInit{
+		sessionFailureCount: 3,
+		sessionTimer:        time.Second * 3,
+		prTimer:             time.Second * 3,
+		transTimer:          time.Second * 1,
+		qsize:               1024,
+		msg:                 make(chan *JSIP, 1024),
+		term:                make(chan string, 1),
+		store:               store,
+	}
+
+	_, err := restoreSession([]byte("{}"), init, slog)
+	assert(err != nil)
+
+	r, err := restoreSession(data, init, slog)
+	assert(err == nil)
+	assert(r.state == INVITE_ACK)
+	assert(r.req.recv)
+	assert(r.req.DialogueID == m.DialogueID)
+	assert(r.init.peer == "peer")
+	assert(r.init.sessionTimer == 10*time.Second)
+	assert(r.sessionTimeout == 10*time.Second)
+	assert(r.info().Expire > 9)
+
+	// UPDATE from peer answered by session layer
+	update := JSIPMsgUpdate(m)
+	update.CSeq = 2
+	update.recv = true
+	r.onMsg(update)
+	up200 := <-init.msg
+	assert(up200.Type == UPDATE && up200.Code == 200 && !up200.recv)
+
+	bye := JSIPMsgBye(m)
+	bye.CSeq = 3
+	bye.recv = true
+	r.onMsg(bye)
+	bye200 := <-init.msg
+	assert(bye200.Type == BYE && bye200.Code == 200 && !bye200.recv)
+	assert(<-init.msg == bye)
+
+	term := <-init.msg
+	assert(term.Type == TERM)
+	assert(<-init.term == m.DialogueID)
+
+	_, ok = store.Get(sessionKey(m.DialogueID))
+	assert(!ok)
+}
+
+func TestSessionNoGoroutine(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSessionNoGoroutine")
+
+	n := 1000
+
+	init := &jsipSessionInit{
+		sessionFailureCount: 3,
+		sessionTimer:        time.Second * 10,
+		prTimer:             time.Second * 3,
+		transTimer:          time.Second * 1,
+		qsize:               1024,
+		msg:                 make(chan *JSIP, 4*n),
+		term:                make(chan string, n),
+	}
+
+	sharedWheel()
+	before := runtime.NumGoroutine()
+
+	sessions := make([]*jsipSession, n)
+	for i := range sessions {
+		m := JSIPMsgReq(INVITE, "jsip.com", "jsip", "jsip",
+			"nogoroutine"+strconv.Itoa(i))
+		sessions[i] = createSession(m, init, slog)
+		assert(<-init.msg == m)
+	}
+
+	// sessions are driven by msgs and shared timing wheel
+	assert(runtime.NumGoroutine()-before < 10)
+
+	for _, s := range sessions {
+		resp := JSIPMsgRes(s.req, 486)
+		resp.recv = true
+		s.onMsg(resp)
+		assert((<-init.msg).Type == ACK)
+		assert(<-init.msg == resp)
+		assert((<-init.msg).Type == TERM)
+		<-init.term
+
+		// msgs after session end are dropped
+		s.onMsg(resp)
+		assert(len(init.msg) == 0)
+	}
+}
+
+func TestSessionNoBlock(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSessionNoBlock")
+
+	// queues of shard not read, as shard loop blocked in session
+	init := &jsipSessionInit{
+		sessionFailureCount: 3,
+		sessionTimer:        time.Second * 10,
+		prTimer:             time.Second * 3,
+		transTimer:          time.Second * 1,
+		qsize:               1024,
+		msg:                 make(chan *JSIP),
+		term:                make(chan string),
+	}
+
+	m := JSIPMsgReq(INVITE, "jsip.com", "jsip", "jsip", "noblock")
+	resp := JSIPMsgRes(m, 486)
+	resp.recv = true
+
+	done := make(chan *jsipSession)
+	go func() {
+		s := createSession(m, init, slog)
+		s.onMsg(resp)
+		s.onTimer()
+		done <- s
+	}()
+
+	var s *jsipSession
+	select {
+	case s = <-done:
+	case <-time.After(time.Second):
+		assert(false)
+	}
+
+	// msgs are sent in order when shard reads
+	assert(<-init.msg == m)
+	assert((<-init.msg).Type == ACK)
+	assert(<-init.msg == resp)
+	assert((<-init.msg).Type == TERM)
+	assert(<-init.term == "noblock")
+
+	s.outLock.Lock()
+	assert(len(s.out) == 0)
+	s.outLock.Unlock()
+}
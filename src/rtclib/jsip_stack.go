@@ -6,10 +6,14 @@
 package rtclib
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
-	"strconv"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,19 +30,53 @@ type jsipDConfig struct {
 	Realm        string        `default:"gortc.com"`
 	Location     string        `default:"/rtc"`
 	Qsize        uint64        `default:"1024"`
+	Shards       uint64        `default:"0"`
 	ConnTimeout  time.Duration `default:"3s"`
 	Retry        int64         `default:"10"`
+	Encoding     string        `default:"json"`
+	TimerTick    time.Duration `default:"10ms"`
 	TransTimer   time.Duration `default:"5s"`
 	PRTimer      time.Duration `default:"60s"`
+	SessionLayer bool          `default:"true"`
 	SessionTimer time.Duration `default:"600s"`
+	SessionStore string        `default:""`
+	TermNotify   bool          `default:"false"`
 }
 
 type JSIPStack struct {
 	log      *golib.Log
 	logLevel int
 
+	// protect config, tls and auth, which are replaced when reload
+	lock   sync.RWMutex
 	config *jsipDConfig
 
+	// msgs of a dialogue are processed in the shard selected by DialogueID
+	shards []*jsipShard
+
+	handler func(*JSIP)
+
+	tlsDefault  *tls.Config
+	tlsProfiles []*jsipTLSProfile
+
+	auth       *jsipAuth
+	authFilter func(*JSIP) string
+
+	respObserver func(*JSIP)
+	relayFilter  func(*JSIP) bool
+
+	store StateStore // checkpoint of established INVITE sessions
+
+	usersLock sync.RWMutex
+	users     map[string]golib.Conn
+	conns     map[golib.Conn]string // conn -> userid connected
+}
+
+// Shard of JSIP Stack, has its own queues, loop and tables of dialogues,
+// config, users and handlers are shared by all shards in stack
+type jsipShard struct {
+	*JSIPStack
+
 	recvq chan *JSIP
 
 	sendq chan *JSIP
@@ -49,22 +87,71 @@ type JSIPStack struct {
 	sessq    chan *JSIP
 	sessTerm chan string
 
-	handler func(*JSIP)
-
 	connLock     sync.Mutex
 	conns        map[string]golib.Conn
 	sessLock     sync.Mutex
 	sessions     map[string]*jsipSession
 	transLock    sync.Mutex
 	transactions map[string]*jsipTransaction
+
+	// INVITE dialogues answered with 2xx when session layer is closed,
+	// only accessed in loop
+	dialogues map[string]bool
+
+	// dialogues relayed without session when session layer is opened,
+	// only accessed in loop
+	relayed map[string]bool
+}
+
+func newJSIPShard(s *JSIPStack, qsize uint64) *jsipShard {
+	return &jsipShard{
+		JSIPStack:    s,
+		recvq:        make(chan *JSIP, qsize),
+		sendq:        make(chan *JSIP, qsize),
+		transq:       make(chan *JSIP, qsize),
+		tranTerm:     make(chan string, qsize),
+		sessq:        make(chan *JSIP, qsize),
+		sessTerm:     make(chan string, qsize),
+		conns:        map[string]golib.Conn{},
+		sessions:     map[string]*jsipSession{},
+		transactions: map[string]*jsipTransaction{},
+		dialogues:    map[string]bool{},
+		relayed:      map[string]bool{},
+	}
+}
+
+// create shards configured and start their loops, shards is number of CPUs
+// if not configured
+func (s *JSIPStack) initShards() {
+	n := int(s.config.Shards)
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	s.shards = make([]*jsipShard, n)
+	for i := range s.shards {
+		s.shards[i] = newJSIPShard(s, s.config.Qsize)
+		go s.shards[i].loop()
+	}
+}
+
+// shard processing msgs of dialogue dlg
+func (s *JSIPStack) shard(dlg string) *jsipShard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(dlg))
+
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
 }
 
 func JStackInstance() *JSIPStack {
 	once.Do(func() {
 		jstack = &JSIPStack{
-			conns:        map[string]golib.Conn{},
-			transactions: map[string]*jsipTransaction{},
-			sessions:     map[string]*jsipSession{},
+			users: map[string]golib.Conn{},
+			conns: map[golib.Conn]string{},
 		}
 
 		if err := jstack.loadDConfig(); err != nil {
@@ -72,17 +159,16 @@ func JStackInstance() *JSIPStack {
 			return
 		}
 
-		jstack.recvq = make(chan *JSIP, jstack.config.Qsize)
-
-		jstack.sendq = make(chan *JSIP, jstack.config.Qsize)
+		if err := jstack.openStore(); err != nil {
+			jstack = nil
+			return
+		}
 
-		jstack.transq = make(chan *JSIP, jstack.config.Qsize)
-		jstack.tranTerm = make(chan string, jstack.config.Qsize)
+		setTimerTick(jstack.config.TimerTick)
 
-		jstack.sessq = make(chan *JSIP, jstack.config.Qsize)
-		jstack.sessTerm = make(chan string, jstack.config.Qsize)
+		jstack.initShards()
 
-		go jstack.loop()
+		jstack.initMetrics()
 	})
 
 	return jstack
@@ -96,11 +182,106 @@ func (s *JSIPStack) loadDConfig() error {
 	if err != nil {
 		return fmt.Errorf("Parse dconfig %s Failed, %s", confPath, err)
 	}
+
+	if JSIPSubprotocol(config.Encoding) == "" {
+		return fmt.Errorf("Unsupported encoding %s", config.Encoding)
+	}
+
+	tlsDefault, tlsProfiles, err := loadTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	prev := s.auth
+	s.lock.Unlock()
+
+	auth, err := loadAuthConfig(config.Realm, prev)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	// qsize, shards, timertick, sessionstore and sessionlayer can not be
+	// reload, sessions created can not change layer
+	if s.config != nil {
+		config.Qsize = s.config.Qsize
+		config.Shards = s.config.Shards
+		config.TimerTick = s.config.TimerTick
+		config.SessionStore = s.config.SessionStore
+		config.SessionLayer = s.config.SessionLayer
+	}
 	s.config = config
+	s.tlsDefault = tlsDefault
+	s.tlsProfiles = tlsProfiles
+	s.auth = auth
+	s.lock.Unlock()
 
 	return nil
 }
 
+// Reload realm, timers, retry and other dynamic config, applied to new
+// transactions, sessions and connections
+func (s *JSIPStack) Reload() error {
+	return s.loadDConfig()
+}
+
+// current config, replaced as a whole when reload
+func (s *JSIPStack) conf() *jsipDConfig {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.config
+}
+
+func (s *JSIPStack) openStore() error {
+	if s.config.SessionStore == "" {
+		return nil
+	}
+
+	store, err := NewFileStore(FullPath(s.config.SessionStore))
+	if err != nil {
+		return fmt.Errorf("Open session store %s Failed, %s",
+			s.config.SessionStore, err)
+	}
+	s.store = store
+
+	return nil
+}
+
+// Rehydrate INVITE sessions established before restart in INVITE_ACK, session
+// refresh and BYE of these sessions keep working. Must be called after
+// handler set, return number of sessions restored
+func (s *JSIPStack) RestoreSessions() int {
+	if s.store == nil {
+		return 0
+	}
+
+	n := 0
+	for _, key := range s.store.Keys(sessionKey("")) {
+		data, ok := s.store.Get(key)
+		if !ok {
+			continue
+		}
+
+		sh := s.shard(strings.TrimPrefix(key, sessionKey("")))
+		sess, err := restoreSession(data, sh.sessionInit(), s.log)
+		if err != nil {
+			s.log.LogError((*JSIP)(nil), "Restore session %s err: %s", key,
+				err.Error())
+			s.store.Delete(key)
+			continue
+		}
+
+		sh.sessLock.Lock()
+		sh.sessions[sess.req.DialogueID] = sess
+		sh.sessLock.Unlock()
+		n++
+	}
+
+	return n
+}
+
 func (s *JSIPStack) SetLog(log *golib.Log, logLevel int) {
 	s.log = log
 	s.logLevel = logLevel
@@ -110,34 +291,151 @@ func (s *JSIPStack) SetHandler(h func(*JSIP)) {
 	s.handler = h
 }
 
-func (s *JSIPStack) State() string {
-	output := ""
+// Set observer of final responses sent by application layer
+func (s *JSIPStack) SetRespObserver(f func(*JSIP)) {
+	s.respObserver = f
+}
+
+// Set filter of in-dialogue requests without session when session layer is
+// opened, f returns true if dialogue is relayed between nodes in cluster,
+// msgs of dialogue relayed are exchanged with app layer directly, as session
+// layer is closed
+func (s *JSIPStack) SetRelayFilter(f func(*JSIP) bool) {
+	s.relayFilter = f
+}
+
+// Transaction in runtime state
+type JSIPTransInfo struct {
+	ID    string  `json:"id"`
+	Dlg   string  `json:"dlg"`
+	Type  string  `json:"type"`
+	State string  `json:"state"`
+	Age   float64 `json:"age"` // seconds since transaction created
+	Conn  string  `json:"conn"`
+}
+
+// Session in runtime state
+type JSIPSessionInfo struct {
+	Dlg    string  `json:"dlg"`
+	State  string  `json:"state"`
+	Age    float64 `json:"age"`    // seconds since session created
+	Expire float64 `json:"expire"` // seconds remaining of session timer
+	Conn   string  `json:"conn"`
+}
+
+// Dialogue connection in runtime state
+type JSIPConnInfo struct {
+	Dlg  string `json:"dlg"`
+	Conn string `json:"conn"`
+}
+
+// Local user in runtime state
+type JSIPUserInfo struct {
+	Userid string `json:"userid"`
+	Conn   string `json:"conn"`
+}
+
+// Runtime state of JSIP Stack, every part is paginated by filter
+type JSIPStackState struct {
+	Connections  StatePage
+	Users        StatePage
+	Sessions     StatePage
+	Transactions StatePage
+}
 
+func (s *jsipShard) dlgConn(dlg string) string {
 	s.connLock.Lock()
-	output += "!!!!! connections: " + strconv.Itoa(len(s.conns)) + "\n"
-	for dlg := range s.conns {
-		output += fmt.Sprintf("\t%s\n", dlg)
+	defer s.connLock.Unlock()
+
+	return connName(s.conns[dlg])
+}
+
+// Runtime state of JSIP Stack, dlg filter is used for connections, sessions
+// and transactions, state filter is used for sessions and transactions
+func (s *JSIPStack) State(f *StateFilter) *JSIPStackState {
+	state := &JSIPStackState{}
+
+	conns := []*JSIPConnInfo{}
+	for _, sh := range s.shards {
+		sh.connLock.Lock()
+		for dlg, conn := range sh.conns {
+			if f.matchDlg(dlg) {
+				conns = append(conns, &JSIPConnInfo{Dlg: dlg,
+					Conn: connName(conn)})
+			}
+		}
+		sh.connLock.Unlock()
 	}
-	s.connLock.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Dlg < conns[j].Dlg })
+	start, end := f.Page(len(conns))
+	state.Connections = StatePage{Total: len(conns), Items: conns[start:end]}
+
+	users := []*JSIPUserInfo{}
+	s.usersLock.RLock()
+	for userid, conn := range s.users {
+		users = append(users, &JSIPUserInfo{Userid: userid, Conn: connName(conn)})
+	}
+	s.usersLock.RUnlock()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Userid < users[j].Userid
+	})
+	start, end = f.Page(len(users))
+	state.Users = StatePage{Total: len(users), Items: users[start:end]}
+
+	sessions := []*JSIPSessionInfo{}
+	for _, sh := range s.shards {
+		sh.sessLock.Lock()
+		for dlg, sess := range sh.sessions {
+			if !f.matchDlg(dlg) {
+				continue
+			}
 
-	s.sessLock.Lock()
-	output += "!!!!! sessions: " + strconv.Itoa(len(s.sessions)) + "\n"
-	for dlg := range s.sessions {
-		output += fmt.Sprintf("\t%s\n", dlg)
+			info := sess.info()
+			if f.matchState(info.State) {
+				sessions = append(sessions, info)
+			}
+		}
+		sh.sessLock.Unlock()
 	}
-	s.sessLock.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Dlg < sessions[j].Dlg
+	})
+	start, end = f.Page(len(sessions))
+	total := len(sessions)
+	sessions = sessions[start:end]
+	for _, info := range sessions {
+		info.Conn = s.shard(info.Dlg).dlgConn(info.Dlg)
+	}
+	state.Sessions = StatePage{Total: total, Items: sessions}
 
-	s.transLock.Lock()
-	output += "!!!!! transactions: " + strconv.Itoa(len(s.transactions)) + "\n"
-	for tid := range s.transactions {
-		output += fmt.Sprintf("\t%s\n", tid)
+	trans := []*JSIPTransInfo{}
+	for _, sh := range s.shards {
+		sh.transLock.Lock()
+		for tid, t := range sh.transactions {
+			if !f.matchDlg(t.req.DialogueID) {
+				continue
+			}
+
+			info := t.info(tid)
+			if f.matchState(info.State) {
+				trans = append(trans, info)
+			}
+		}
+		sh.transLock.Unlock()
 	}
-	s.transLock.Unlock()
+	sort.Slice(trans, func(i, j int) bool { return trans[i].ID < trans[j].ID })
+	start, end = f.Page(len(trans))
+	total = len(trans)
+	trans = trans[start:end]
+	for _, info := range trans {
+		info.Conn = s.shard(info.Dlg).dlgConn(info.Dlg)
+	}
+	state.Transactions = StatePage{Total: total, Items: trans}
 
-	return output
+	return state
 }
 
-func (s *JSIPStack) processTransaction(msg *JSIP) {
+func (s *jsipShard) processTransaction(msg *JSIP) {
 	tid := transactionID(msg.DialogueID, msg.CSeq)
 	s.transLock.Lock()
 	trans := s.transactions[tid]
@@ -149,16 +447,20 @@ func (s *JSIPStack) processTransaction(msg *JSIP) {
 			return
 		}
 
+		config := s.conf()
 		init := &jsipTransInit{
-			transTimer: s.config.TransTimer,
-			prTimer:    s.config.PRTimer,
-			qsize:      s.config.Qsize,
+			transTimer: config.TransTimer,
+			prTimer:    config.PRTimer,
+			qsize:      config.Qsize,
+			noSession:  !config.SessionLayer || s.relayed[msg.DialogueID],
 			msg:        s.transq,
 			term:       s.tranTerm,
 		}
 
 		if msg.conn != nil {
-			if msg.Type == INVITE || !msg.inviteSession() {
+			if msg.Type == INVITE || !msg.inviteSession() ||
+				s.relayed[msg.DialogueID] {
+
 				s.connLock.Lock()
 				s.conns[msg.DialogueID] = msg.conn
 				s.connLock.Unlock()
@@ -184,8 +486,38 @@ func (s *JSIPStack) processTransaction(msg *JSIP) {
 	}
 }
 
+// requests received in dialogue but final response not sent
+func (s *JSIPStack) unanswered(dlg string) []*JSIP {
+	return s.shard(dlg).unanswered(dlg)
+}
+
+func (s *jsipShard) unanswered(dlg string) []*JSIP {
+	reqs := []*JSIP{}
+
+	s.transLock.Lock()
+	for _, t := range s.transactions {
+		req := t.req
+		if req.DialogueID != dlg || !req.recv || req.Type == ACK ||
+			req.Type == TERM {
+
+			continue
+		}
+
+		t.lock.Lock()
+		state := t.state
+		t.lock.Unlock()
+
+		if state < TRANS_SUCCESSESP {
+			reqs = append(reqs, req)
+		}
+	}
+	s.transLock.Unlock()
+
+	return reqs
+}
+
 // pre process msg from application layer
-func (s *JSIPStack) preProcess(msg *JSIP) error {
+func (s *jsipShard) preProcess(msg *JSIP) error {
 	msg.recv = false
 
 	if msg.rawMsg == nil {
@@ -196,8 +528,12 @@ func (s *JSIPStack) preProcess(msg *JSIP) error {
 		return errors.New("msg no DialogueID")
 	}
 
+	// connection set by application, as location binding, used only if
+	// dialogue has no connection
 	s.connLock.Lock()
-	msg.conn = s.conns[msg.DialogueID]
+	if conn := s.conns[msg.DialogueID]; conn != nil {
+		msg.conn = conn
+	}
 	s.connLock.Unlock()
 
 	typ := JSIPRespType(msg.Code)
@@ -254,20 +590,15 @@ func (s *JSIPStack) preProcess(msg *JSIP) error {
 	}
 }
 
-func (s *JSIPStack) processSession(msg *JSIP) {
+func (s *jsipShard) processSession(msg *JSIP) {
 	s.sessLock.Lock()
 	sess := s.sessions[msg.DialogueID]
 	s.sessLock.Unlock()
 	if sess == nil {
 		if msg.Type == INVITE && msg.Code == 0 {
-			init := &jsipSessionInit{
-				sessionFailureCount: 3,
-				sessionTimer:        s.config.SessionTimer,
-				prTimer:             s.config.PRTimer,
-				transTimer:          s.config.TransTimer,
-				qsize:               s.config.Qsize,
-				msg:                 s.sessq,
-				term:                s.sessTerm,
+			init := s.sessionInit()
+			if s.store != nil && msg.recv {
+				init.peer = s.connUser(msg.conn)
 			}
 
 			sess = createSession(msg, init, s.log)
@@ -303,12 +634,126 @@ func (s *JSIPStack) processSession(msg *JSIP) {
 		}
 	}
 
-	msg.conn = sess.req.conn
+	if sess.restored {
+		// connection of restored session is the one peer reconnected with
+		if msg.recv && msg.conn != nil {
+			s.connLock.Lock()
+			if s.conns[msg.DialogueID] == nil {
+				s.conns[msg.DialogueID] = msg.conn
+			}
+			s.connLock.Unlock()
+		}
+	} else {
+		msg.conn = sess.req.conn
+	}
 
 	sess.onMsg(msg)
 }
 
-func (s *JSIPStack) connect(msg *JSIP) golib.Conn {
+func (s *jsipShard) sessionInit() *jsipSessionInit {
+	config := s.conf()
+
+	return &jsipSessionInit{
+		sessionFailureCount: 3,
+		sessionTimer:        config.SessionTimer,
+		prTimer:             config.PRTimer,
+		transTimer:          config.TransTimer,
+		qsize:               config.Qsize,
+		msg:                 s.sessq,
+		term:                s.sessTerm,
+		store:               s.store,
+	}
+}
+
+// userid of local user connected or registered with conn, "" if not found
+func (s *JSIPStack) connUser(conn golib.Conn) string {
+	if conn == nil {
+		return ""
+	}
+
+	s.usersLock.RLock()
+	userid := s.conns[conn]
+	s.usersLock.RUnlock()
+
+	if userid == "" && location != nil {
+		userid = location.connUser(conn)
+	}
+
+	return userid
+}
+
+// connection of peer of restored session in dlg, peer reconnected as local
+// user after restart
+func (s *jsipShard) peerConn(dlg string) golib.Conn {
+	s.sessLock.Lock()
+	sess := s.sessions[dlg]
+	s.sessLock.Unlock()
+
+	if sess == nil || !sess.restored || sess.init.peer == "" {
+		return nil
+	}
+
+	conn := s.localConn(sess.init.peer)
+	if conn != nil {
+		s.connLock.Lock()
+		s.conns[dlg] = conn
+		s.connLock.Unlock()
+	}
+
+	return conn
+}
+
+// mark dialogue of in-dialogue request without session as relayed, if relay
+// filter returns true when session layer is opened
+func (s *jsipShard) checkRelayed(msg *JSIP) {
+	if s.relayFilter == nil || !s.conf().SessionLayer || msg.Code != 0 ||
+		msg.Type == INVITE || !msg.inviteSession() ||
+		s.relayed[msg.DialogueID] {
+
+		return
+	}
+
+	s.sessLock.Lock()
+	sess := s.sessions[msg.DialogueID]
+	s.sessLock.Unlock()
+
+	if sess == nil && s.relayFilter(msg) {
+		s.relayed[msg.DialogueID] = true
+	}
+}
+
+// session layer closed or dialogue relayed, transactions of INVITE session
+// are exchanged with app layer directly
+func (s *jsipShard) noSession(msg *JSIP) bool {
+	return msg.inviteSession() &&
+		(!s.conf().SessionLayer || s.relayed[msg.DialogueID])
+}
+
+// whether INVITE dialogue terminates by msg when session layer is closed,
+// dialogue terminates when BYE answered or initial INVITE failed
+func (s *jsipShard) dialogueEnd(msg *JSIP) bool {
+	if msg.Code < 200 {
+		return false
+	}
+
+	switch msg.Type {
+	case INVITE:
+		if msg.Code < 300 {
+			s.dialogues[msg.DialogueID] = true
+			return false
+		}
+
+		// re-INVITE failed
+		return !s.dialogues[msg.DialogueID]
+	case BYE:
+		delete(s.dialogues, msg.DialogueID)
+		return true
+	}
+
+	return false
+}
+
+func (s *jsipShard) connect(msg *JSIP) golib.Conn {
 	s.connLock.Lock()
 	conn := s.conns[msg.DialogueID]
 	s.connLock.Unlock()
@@ -316,6 +761,10 @@ func (s *JSIPStack) connect(msg *JSIP) golib.Conn {
 		return conn
 	}
 
+	if conn := s.peerConn(msg.DialogueID); conn != nil {
+		return conn
+	}
+
 	if msg.Code != 0 {
 		s.log.LogError(msg, "Response cannot find connection to send")
 		return nil
@@ -332,56 +781,208 @@ func (s *JSIPStack) connect(msg *JSIP) golib.Conn {
 		return nil
 	}
 
+	// request to user in realm, send over connection user connected
+	if len(msg.Router) == 0 {
+		if conn, local := s.userConn(jsipUri); local {
+			if conn == nil {
+				s.log.LogError(msg, "User %s is offline", jsipUri.User)
+				s.unavailable(msg)
+			}
+
+			return conn
+		}
+	}
+
+	config := s.conf()
+
 	userid := msg.Userid
 	if msg.Userid == "" {
-		userid = s.config.Realm
+		userid = config.Realm
+	}
+
+	name, ok := jsipUri.Paras["transport"]
+	if !ok || name == "" {
+		name = "ws"
 	}
 
-	url := "ws://" + jsipUri.HostportString() + s.config.Location + "?userid=" + userid
-	timeout := s.config.ConnTimeout
-	retry := int(s.config.Retry)
-	qsize := s.config.Qsize
+	t := GetTransport(name)
+	if t == nil {
+		s.log.LogError(msg, "Unsupported transport %s", name)
+		return nil
+	}
 
-	return golib.NewWSClient(jsipUri.UserHostString(), url, timeout, retry, qsize, RecvMsg, s.log, s.logLevel)
+	tlsConfig, err := s.tlsConfig(jsipUri)
+	if err != nil {
+		s.log.LogError(msg, "Get TLS config err: %s", err.Error())
+		return nil
+	}
+
+	// encoding negotiated over websocket, para encoding of jsip uri first
+	encoding, ok := jsipUri.Paras["encoding"]
+	if !ok || encoding == "" {
+		encoding = config.Encoding
+	}
+
+	subproto := JSIPSubprotocol(encoding)
+	if subproto == "" {
+		s.log.LogError(msg, "Unsupported encoding %s", encoding)
+		return nil
+	}
+
+	opts := &TransportOpts{
+		Location:    config.Location,
+		TLS:         tlsConfig,
+		Timeout:     config.ConnTimeout,
+		Retry:       int(config.Retry),
+		Qsize:       config.Qsize,
+		Subprotocol: subproto,
+		Handler:     RecvMsg,
+		Log:         s.log,
+		LogLevel:    s.logLevel,
+	}
+
+	return t.Dial(jsipUri.UserHostString(), jsipUri.HostportString(), userid,
+		opts)
 }
 
-func (s *JSIPStack) send(msg *JSIP) {
-	if msg.conn == nil {
-		if msg.conn = s.connect(msg); msg.conn == nil {
-			return
+func (s *JSIPStack) addUser(userid string, conn golib.Conn) {
+	s.usersLock.Lock()
+	if old := s.users[userid]; old != nil && s.conns[old] == userid {
+		delete(s.conns, old)
+	}
+	s.users[userid] = conn
+	s.conns[conn] = userid
+	s.usersLock.Unlock()
+}
+
+func (s *JSIPStack) delUser(userid string, conn golib.Conn) {
+	s.usersLock.Lock()
+	if s.users[userid] == conn {
+		delete(s.users, userid)
+	}
+	if s.conns[conn] == userid {
+		delete(s.conns, conn)
+	}
+	s.usersLock.Unlock()
+
+	unbindConn(conn)
+}
+
+// whether user userid connected with conn
+func (s *JSIPStack) connected(userid string, conn golib.Conn) bool {
+	if conn == nil {
+		return false
+	}
+
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+
+	return s.users[userid] == conn
+}
+
+// Get connection of user in uri, local is true if uri is user in realm,
+// user connected with userid first, then user registered in location
+func (s *JSIPStack) userConn(uri *JSIPUri) (golib.Conn, bool) {
+	if uri.User == "" || uri.Hostport.Host != s.conf().Realm {
+		return nil, false
+	}
+
+	return s.localConn(uri.User), true
+}
+
+// connection of local user userid, connected first, then registered
+func (s *JSIPStack) localConn(userid string) golib.Conn {
+	s.usersLock.RLock()
+	conn := s.users[userid]
+	s.usersLock.RUnlock()
+
+	if conn == nil && location != nil {
+		if b := location.Lookup(userid); b != nil {
+			conn = b.conn
 		}
 	}
 
+	return conn
+}
+
+// response 480 to application layer for request to user offline
+func (s *jsipShard) unavailable(msg *JSIP) {
+	if msg.Code != 0 || msg.Type == ACK {
+		return
+	}
+
+	resp := JSIPMsgRes(msg, 480)
+	resp.recv = true
+
+	go func() {
+		s.recvq <- resp
+	}()
+}
+
+func (s *jsipShard) send(msg *JSIP) {
+	if msg.conn == nil {
+		msg.conn = s.connect(msg)
+	}
+
+	s.trace(msg, TraceTransaction)
+
+	if msg.conn == nil {
+		return
+	}
+
 	data, err := msg.Marshal()
 	if err != nil {
 		s.log.LogError(msg, "Marshal JSIP err: %s", err.Error())
+		return
 	}
 
+	jsipSentMsgs.Inc(msg.Type.String(), jsipMsgClass(msg))
+
 	msg.conn.Send(data)
 }
 
-func (s *JSIPStack) loop() {
+func (s *jsipShard) loop() {
 	for {
 		select {
 		case msg := <-s.recvq:
+			if !s.authenticate(msg) {
+				continue
+			}
+
+			s.checkRelayed(msg)
+
 			// TODO replace DialogueID
 			s.processTransaction(msg)
 
+			jsipRecvMsgs.Inc(msg.Type.String(), jsipMsgClass(msg))
+
 		case msg := <-s.sendq:
 			if err := s.preProcess(msg); err != nil {
 				s.log.LogError(msg, "Pre process msg from applicaion layer error: %s", err.Error())
 				continue
 			}
 
-			if msg.inviteSession() {
+			s.trace(msg, TraceApp)
+
+			if msg.Code >= 200 && s.respObserver != nil {
+				s.respObserver(msg)
+			}
+
+			s.checkRelayed(msg)
+
+			if msg.inviteSession() && !s.noSession(msg) {
 				s.processSession(msg)
 			} else {
 				s.processTransaction(msg)
 			}
 
 		case msg := <-s.transq:
+			noSession := s.noSession(msg)
+
 			if msg.recv {
-				if msg.inviteSession() {
+				s.trace(msg, TraceTransaction)
+
+				if msg.inviteSession() && !noSession {
 					s.processSession(msg)
 				} else {
 					s.handler(msg)
@@ -390,6 +991,14 @@ func (s *JSIPStack) loop() {
 				s.send(msg)
 			}
 
+			if noSession && s.dialogueEnd(msg) {
+				term := JSIPMsgTerm(msg.DialogueID)
+				s.trace(term, TraceTransaction)
+				s.handler(term)
+				delete(s.relayed, msg.DialogueID)
+				msg = term
+			}
+
 			if msg.Type == TERM {
 				s.connLock.Lock()
 				delete(s.conns, msg.DialogueID)
@@ -402,6 +1011,8 @@ func (s *JSIPStack) loop() {
 			s.transLock.Unlock()
 
 		case msg := <-s.sessq:
+			s.trace(msg, TraceSession)
+
 			if msg.recv {
 				s.handler(msg)
 			} else {
@@ -423,7 +1034,7 @@ func (s *JSIPStack) loop() {
 }
 
 func Realm() string {
-	return jstack.config.Realm
+	return jstack.conf().Realm
 }
 
 func RecvMsg(conn golib.Conn, data []byte) {
@@ -437,7 +1048,18 @@ func RecvMsg(conn golib.Conn, data []byte) {
 		return
 	}
 
-	jstack.recvq <- m
+	jstack.recv(m)
+}
+
+// Add connection of user connected to this rtc server,
+// request to userid@realm will be sent over this connection
+func AddUser(userid string, conn golib.Conn) {
+	jstack.addUser(userid, conn)
+}
+
+// Delete connection of user, connection not equal to the added is ignored
+func DelUser(userid string, conn golib.Conn) {
+	jstack.delUser(userid, conn)
 }
 
 func SendMsg(m *JSIP) {
@@ -446,5 +1068,15 @@ func SendMsg(m *JSIP) {
 		return
 	}
 
-	jstack.sendq <- m
+	// dialogue between tasks in process
+	if sendInner(m) {
+		return
+	}
+
+	jstack.shard(m.DialogueID).sendq <- m
+}
+
+// msg received from peer
+func (s *JSIPStack) recv(m *JSIP) {
+	s.shard(m.DialogueID).recvq <- m
 }
@@ -0,0 +1,407 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Stack Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+func TestLocalUser(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestLocalUser")
+
+	s := newJSIPShard(&JSIPStack{
+		log:    golib.NewLog("stack.log"),
+		config: &jsipDConfig{Realm: "test.com"},
+		users:  map[string]golib.Conn{},
+		conns:  map[golib.Conn]string{},
+	}, 10)
+
+	alice := &sipTestConn{}
+	s.addUser("alice", alice)
+	assert(s.connUser(alice) == "alice")
+
+	// user connected
+	m := JSIPMsgReq(INVITE, "alice@test.com", "bob@test.com",
+		"alice@test.com", "dlg1")
+	assert(s.connect(m) == alice)
+
+	// user offline
+	m = JSIPMsgReq(INVITE, "carol@test.com", "bob@test.com",
+		"carol@test.com", "dlg2")
+	assert(s.connect(m) == nil)
+
+	select {
+	case resp := <-s.recvq:
+		assert(resp.Code == 480 && resp.CSeq == m.CSeq && resp.recv)
+		assert(resp.Type == INVITE && resp.DialogueID == "dlg2")
+	case <-time.After(time.Second):
+		assert(false)
+	}
+
+	// ACK to user offline has no response
+	ack := JSIPMsgReq(ACK, "carol@test.com", "bob@test.com",
+		"carol@test.com", "dlg2")
+	assert(s.connect(ack) == nil)
+
+	select {
+	case <-s.recvq:
+		assert(false)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// other connection of alice cannot delete alice
+	other := &sipTestConn{}
+	s.delUser("alice", other)
+	assert(s.connect(JSIPMsgReq(MESSAGE, "alice@test.com", "bob@test.com",
+		"alice@test.com", "dlg3")) == alice)
+
+	// alice reconnected with other connection
+	s.addUser("alice", other)
+	assert(s.connUser(alice) == "" && s.connUser(other) == "alice")
+	s.addUser("alice", alice)
+	assert(s.connUser(alice) == "alice" && s.connUser(other) == "")
+
+	s.delUser("alice", alice)
+	assert(s.connUser(alice) == "")
+	assert(s.connect(JSIPMsgReq(MESSAGE, "alice@test.com", "bob@test.com",
+		"alice@test.com", "dlg4")) == nil)
+	<-s.recvq
+
+	// uri not in realm or with router is not local user
+	conn, local := s.userConn(&JSIPUri{User: "alice",
+		Hostport: &JSIPUriHostport{Host: "other.com"}})
+	assert(conn == nil && !local)
+}
+
+func TestTransactionOnly(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTransactionOnly")
+
+	s := newJSIPShard(&JSIPStack{
+		config: &jsipDConfig{Realm: "test.com"},
+	}, 10)
+
+	invite := JSIPMsgReq(INVITE, "alice@test.com", "bob@test.com",
+		"alice@test.com", "dlg1")
+
+	// initial INVITE failed
+	assert(!s.dialogueEnd(invite))
+	assert(!s.dialogueEnd(JSIPMsgRes(invite, 180)))
+	assert(s.dialogueEnd(JSIPMsgRes(invite, 486)))
+
+	// re-INVITE failed does not terminate dialogue
+	assert(!s.dialogueEnd(JSIPMsgRes(invite, 200)))
+	assert(!s.dialogueEnd(JSIPMsgRes(invite, 491)))
+
+	update := JSIPMsgUpdate(invite)
+	assert(!s.dialogueEnd(JSIPMsgRes(update, 200)))
+
+	bye := JSIPMsgBye(invite)
+	assert(s.dialogueEnd(JSIPMsgRes(bye, 200)))
+	assert(len(s.dialogues) == 0)
+
+	// BYE response received is sent to app layer
+	init := &jsipTransInit{
+		transTimer: time.Second * 5,
+		prTimer:    time.Second * 60,
+		qsize:      1024,
+		noSession:  true,
+		msg:        make(chan *JSIP, 1024),
+		term:       make(chan string, 1024),
+	}
+
+	bye.CSeq = 1
+	trans := createTransaction(bye, init, golib.NewLog("stack.log"))
+	assert(<-init.msg == bye)
+
+	bye200 := JSIPMsgRes(bye, 200)
+	bye200.recv = true
+	trans.onMsg(bye200)
+	assert(<-init.msg == bye200)
+	assert(<-init.term == transactionID("dlg1", 1))
+}
+
+func TestShard(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestShard")
+
+	s := &JSIPStack{config: &jsipDConfig{Shards: 4, Qsize: 10}}
+	s.initShards()
+	assert(len(s.shards) == 4)
+
+	// msgs of a dialogue are always processed in the same shard
+	used := map[*jsipShard]bool{}
+	for i := 0; i < 100; i++ {
+		dlg := fmt.Sprintf("dlg%d", i)
+		assert(s.shard(dlg) == s.shard(dlg))
+		used[s.shard(dlg)] = true
+	}
+	assert(len(used) == 4)
+
+	s = &JSIPStack{config: &jsipDConfig{Qsize: 10}}
+	s.initShards()
+	assert(len(s.shards) == runtime.NumCPU())
+}
+
+// connection between nodes for test, msgs sent are received by stack s from
+// peer, or saved in msgs if s is nil
+type nodeTestConn struct {
+	s    *JSIPStack
+	peer *nodeTestConn
+	msgs chan *JSIP
+}
+
+func (c *nodeTestConn) Send(data []byte) {
+	m := &JSIP{}
+	assert(m.Unmarshal(data) == nil)
+
+	if c.s == nil {
+		c.msgs <- m
+		return
+	}
+
+	m.recv = true
+	m.conn = c.peer
+	c.s.recv(m)
+}
+
+func (c *nodeTestConn) Close() {
+}
+
+func (c *nodeTestConn) Prefix() string {
+	return "[nodetest]"
+}
+
+func (c *nodeTestConn) Suffix() string {
+	return ""
+}
+
+func (c *nodeTestConn) LogLevel() int {
+	return golib.LOGDEBUG
+}
+
+func newNodeTestStack(realm string) *JSIPStack {
+	s := &JSIPStack{
+		log: golib.NewLog("stack.log"),
+		config: &jsipDConfig{
+			Realm:        realm,
+			Qsize:        100,
+			Shards:       1,
+			SessionLayer: true,
+			TransTimer:   5 * time.Second,
+			PRTimer:      60 * time.Second,
+		},
+		users: map[string]golib.Conn{},
+		conns: map[golib.Conn]string{},
+	}
+	s.initShards()
+
+	return s
+}
+
+func TestRelayDialogue(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestRelayDialogue")
+
+	// dialogue dlgD owned by node b, in-dialog requests from peer arrive at
+	// node c, relayed to b with dlgO and relid in Router
+	c := newNodeTestStack("c.com")
+	b := newNodeTestStack("b.com")
+
+	peer := &nodeTestConn{msgs: make(chan *JSIP, 10)} // c to peer
+	cToB := &nodeTestConn{s: b}
+	bToC := &nodeTestConn{s: c, peer: cToB}
+	cToB.peer = bToC
+
+	hasRelid := func(m *JSIP) bool {
+		return len(m.Router) > 0 && m.Router[0] == "b.com;relid=dlgD"
+	}
+	c.SetRelayFilter(func(m *JSIP) bool {
+		return m.DialogueID == "dlgD" || hasRelid(m)
+	})
+	b.SetRelayFilter(hasRelid)
+
+	// relay of c, only accessed in loop of c
+	reqs := map[uint64]*JSIP{}
+	cTerms := make(chan string, 10)
+	c.SetHandler(func(m *JSIP) {
+		switch {
+		case m.Type == TERM:
+			cTerms <- m.DialogueID
+		case m.DialogueID == "dlgD" && m.Code == 0:
+			req := JSIPMsgClone(m, "dlgO")
+			req.Router = []string{"b.com;relid=dlgD"}
+			req.conn = cToB // connection to node b by Router
+			reqs[req.CSeq] = m
+			c.shard("dlgO").sendq <- req
+		case m.DialogueID == "dlgO" && m.Code >= 200:
+			res := JSIPMsgClone(m, "dlgD")
+			res.CSeq = reqs[m.CSeq].CSeq
+			c.shard("dlgD").sendq <- res
+		}
+	})
+
+	// owner task of b answers requests
+	bMsgs := make(chan *JSIP, 10)
+	b.SetHandler(func(m *JSIP) {
+		bMsgs <- m
+		if m.Code == 0 && m.Type != TERM {
+			b.shard(m.DialogueID).sendq <- JSIPMsgRes(m, 200)
+		}
+	})
+
+	recvPeer := func() *JSIP {
+		select {
+		case m := <-peer.msgs:
+			return m
+		case <-time.After(time.Second):
+			assert(false)
+		}
+		return nil
+	}
+
+	recvB := func() *JSIP {
+		select {
+		case m := <-bMsgs:
+			return m
+		case <-time.After(time.Second):
+			assert(false)
+		}
+		return nil
+	}
+
+	// NOTIFY crossing nodes
+	notify := JSIPMsgReq(NOTIFY, "alice@test.com", "bob@test.com",
+		"alice@test.com", "dlgD")
+	notify.recv = true
+	notify.conn = peer
+	c.recv(notify)
+
+	m := recvB()
+	assert(m.Type == NOTIFY && m.DialogueID == "dlgO" && hasRelid(m))
+	m = recvPeer()
+	assert(m.Code == 200 && m.CSeq == notify.CSeq)
+	assert(recvB().Type == TERM)
+
+	// BYE crossing nodes with session layer opened, not answered with 481
+	bye := JSIPMsgReq(BYE, "alice@test.com", "bob@test.com",
+		"alice@test.com", "dlgD")
+	bye.recv = true
+	bye.conn = peer
+	c.recv(bye)
+
+	m = recvB()
+	assert(m.Type == BYE && m.DialogueID == "dlgO" && hasRelid(m))
+	m = recvPeer()
+	assert(m.Code == 200 && m.CSeq == bye.CSeq)
+
+	// dialogue terminated on both nodes
+	m = recvB()
+	assert(m.Type == TERM && m.DialogueID == "dlgO")
+
+	terms := map[string]bool{}
+	for len(terms) < 2 {
+		select {
+		case dlg := <-cTerms:
+			terms[dlg] = true
+		case <-time.After(time.Second):
+			assert(false)
+		}
+	}
+	assert(terms["dlgD"] && terms["dlgO"])
+
+	// relayed dialogue without session answered with 481 when no filter
+	c.SetRelayFilter(nil)
+	bye = JSIPMsgReq(BYE, "alice@test.com", "bob@test.com",
+		"alice@test.com", "dlgD")
+	bye.recv = true
+	bye.conn = peer
+	c.recv(bye)
+
+	m = recvPeer()
+	assert(m.Code == 481 && m.CSeq == bye.CSeq)
+}
+
+// connection of benchmark client, notified when response sent
+type benchConn struct {
+	done chan bool
+}
+
+func (c *benchConn) Send(data []byte) {
+	c.done <- true
+}
+
+func (c *benchConn) Close() {
+}
+
+func (c *benchConn) Prefix() string {
+	return "[bench]"
+}
+
+func (c *benchConn) Suffix() string {
+	return ""
+}
+
+func (c *benchConn) LogLevel() int {
+	return golib.LOGERROR
+}
+
+// MESSAGE received and answered with 200 by app layer, every client waits
+// for response before sending next request, as dialogues in real world
+func benchmarkStack(b *testing.B, shards uint64) {
+	s := &JSIPStack{
+		log: golib.NewLog("bench.log"),
+		config: &jsipDConfig{
+			Realm:        "test.com",
+			Qsize:        1024,
+			Shards:       shards,
+			SessionLayer: true,
+			TransTimer:   5 * time.Second,
+			PRTimer:      60 * time.Second,
+		},
+		users: map[string]golib.Conn{},
+		conns: map[golib.Conn]string{},
+	}
+	s.SetHandler(func(m *JSIP) {
+		if m.Type == MESSAGE && m.Code == 0 {
+			s.shard(m.DialogueID).sendq <- JSIPMsgRes(m, 200)
+		}
+	})
+	s.initShards()
+
+	var clients int64
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		conn := &benchConn{done: make(chan bool, 1)}
+		client := atomic.AddInt64(&clients, 1)
+		seq := uint64(0)
+
+		for pb.Next() {
+			seq++
+			m := JSIPMsgReq(MESSAGE, "alice@test.com", "bob@test.com",
+				"alice@test.com", fmt.Sprintf("dlg%d_%d", client, seq))
+			m.CSeq = seq
+			m.recv = true
+			m.conn = conn
+
+			s.recv(m)
+			<-conn.done
+		}
+	})
+}
+
+func BenchmarkStackOneShard(b *testing.B) {
+	benchmarkStack(b, 1)
+}
+
+// run with -cpu 1,2,4,8 for scaling with GOMAXPROCS
+func BenchmarkStackShards(b *testing.B) {
+	benchmarkStack(b, uint64(runtime.GOMAXPROCS(0)))
+}
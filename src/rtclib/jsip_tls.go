@@ -0,0 +1,158 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Stack TLS config for connecting to next rtc server
+
+package rtclib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/alexwoo/golib"
+)
+
+type jsipTLSDConfig struct {
+	Profiles           string // only used in JSIPStackTLS section
+	Realm              string
+	CA                 string
+	Cert               string
+	Key                string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+type jsipTLSProfile struct {
+	name   string
+	realm  string
+	config *tls.Config
+}
+
+func newTLSConfig(c *jsipTLSDConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CA != "" {
+		path := FullPath("certs/" + c.CA)
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read ca %s failed, %s", path, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no cert in ca %s", path)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, fmt.Errorf("cert(%s) or key(%s) configured error",
+				c.Cert, c.Key)
+		}
+
+		cert, err := tls.LoadX509KeyPair(FullPath("certs/"+c.Cert),
+			FullPath("certs/"+c.Key))
+		if err != nil {
+			return nil, fmt.Errorf("load cert(%s) or key(%s) failed, %s",
+				c.Cert, c.Key, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+func loadTLSConfig() (*tls.Config, []*jsipTLSProfile, error) {
+	confPath := FullPath("conf/gortc.ini")
+
+	config := &jsipTLSDConfig{}
+	err := golib.ConfigFile(confPath, "JSIPStackTLS", config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Parse dconfig %s Failed, %s", confPath,
+			err)
+	}
+
+	tlsDefault, err := newTLSConfig(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("JSIPStackTLS config error, %s", err)
+	}
+
+	profiles := []*jsipTLSProfile{}
+	for _, name := range strings.Split(config.Profiles, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		section := "JSIPStackTLS." + name
+		pconf := &jsipTLSDConfig{}
+		err := golib.ConfigFile(confPath, section, pconf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Parse dconfig %s %s Failed, %s",
+				confPath, section, err)
+		}
+
+		c, err := newTLSConfig(pconf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s config error, %s", section, err)
+		}
+
+		profiles = append(profiles, &jsipTLSProfile{
+			name:   name,
+			realm:  pconf.Realm,
+			config: c,
+		})
+	}
+
+	return tlsDefault, profiles, nil
+}
+
+// Get TLS config for connecting to uri,
+// select profile by uri para tls, or by realm matching uri host,
+// if no profile matched, use default TLS config
+func (s *JSIPStack) tlsConfig(uri *JSIPUri) (*tls.Config, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if name, ok := uri.Paras["tls"]; ok && name != "" {
+		for _, p := range s.tlsProfiles {
+			if p.name == name {
+				return p.config, nil
+			}
+		}
+
+		return nil, errors.New("TLS profile " + name + " not configured")
+	}
+
+	host := uri.Hostport.Host
+
+	var profile *jsipTLSProfile
+	for _, p := range s.tlsProfiles {
+		if p.realm == "" {
+			continue
+		}
+
+		if host != p.realm && !strings.HasSuffix(host, "."+p.realm) {
+			continue
+		}
+
+		// longest realm matched
+		if profile == nil || len(p.realm) > len(profile.realm) {
+			profile = p
+		}
+	}
+
+	if profile != nil {
+		return profile.config, nil
+	}
+
+	return s.tlsDefault, nil
+}
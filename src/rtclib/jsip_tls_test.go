@@ -0,0 +1,57 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Stack TLS config Test Case
+
+package rtclib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTLSConfig")
+
+	_, err := newTLSConfig(&jsipTLSDConfig{Cert: "client.crt"})
+	assert(err != nil)
+
+	_, err = newTLSConfig(&jsipTLSDConfig{CA: "notexist.crt"})
+	assert(err != nil)
+
+	def, err := newTLSConfig(&jsipTLSDConfig{})
+	assert(err == nil && def.RootCAs == nil && len(def.Certificates) == 0)
+
+	dc2 := &tls.Config{ServerName: "dc2"}
+	edge := &tls.Config{ServerName: "edge"}
+	named := &tls.Config{ServerName: "named"}
+
+	s := &JSIPStack{
+		tlsDefault: def,
+		tlsProfiles: []*jsipTLSProfile{
+			&jsipTLSProfile{name: "dc2", realm: "dc2.test.com", config: dc2},
+			&jsipTLSProfile{name: "edge", realm: "edge.dc2.test.com", config: edge},
+			&jsipTLSProfile{name: "named", config: named},
+		},
+	}
+
+	check := func(uri string, config *tls.Config) {
+		u, err := NewJSIPUri(uri)
+		assert(err == nil)
+
+		c, err := s.tlsConfig(u)
+		assert(err == nil && c == config)
+	}
+
+	check("dc2.test.com:8443;transport=wss", dc2)
+	check("a@sig.dc2.test.com;transport=wss", dc2)
+	check("a@sig.edge.dc2.test.com;transport=wss", edge)
+	check("dc3.test.com;transport=wss", def)
+	check("xdc2.test.com;transport=wss", def)
+	check("dc2.test.com;transport=wss;tls=named", named)
+
+	u, _ := NewJSIPUri("dc2.test.com;transport=wss;tls=unknown")
+	_, err = s.tlsConfig(u)
+	assert(err != nil)
+}
@@ -0,0 +1,394 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP message trace, capture full messages of dialogs matched by rules
+// into JSON-lines trace file
+
+package rtclib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+var (
+	traceOnce sync.Once
+
+	tracer *Tracer
+)
+
+// layers emit JSIP msg in trace record
+const (
+	TraceTransaction = "transaction"
+	TraceSession     = "session"
+	TraceApp         = "app"
+)
+
+type traceDConfig struct {
+	File       string `default:"logs/trace.log"`
+	MaxSize    uint64 `default:"100"`
+	MaxBackups uint64 `default:"5"`
+	Qsize      uint64 `default:"4096"`
+}
+
+// Trace rule, msg matched by rule starts tracing of its dialog, empty field
+// in rule matches any msg
+type TraceRule struct {
+	ID     string `json:"id"`
+	Userid string `json:"userid"` // Userid, user of From or To
+	Dlg    string `json:"dlg"`    // DialogueID
+	Uri    string `json:"uri"`    // regexp of RequestURI
+
+	uri *regexp.Regexp
+}
+
+// One line in trace file
+type TraceRecord struct {
+	Time   time.Time       `json:"time"`
+	Rule   string          `json:"rule"`
+	Dlg    string          `json:"dlg"`
+	Layer  string          `json:"layer"`  // layer emit the msg
+	Dir    string          `json:"dir"`    // in: to app, out: to network
+	Remote string          `json:"remote"` // connection of dialogue
+	Type   string          `json:"type"`
+	Code   int             `json:"code"`
+	CSeq   uint64          `json:"cseq"`
+	Msg    json.RawMessage `json:"msg,omitempty"` // marshalled JSIP msg
+}
+
+type Tracer struct {
+	config *traceDConfig
+
+	log      *golib.Log
+	logLevel int
+
+	lock    sync.RWMutex
+	seq     uint64
+	rules   map[string]*TraceRule
+	dialogs map[string]string // DialogueID traced -> rule id
+
+	records chan []byte
+	file    *os.File
+	size    int64
+}
+
+func TracerInstance() *Tracer {
+	traceOnce.Do(func() {
+		tracer = &Tracer{
+			rules:   make(map[string]*TraceRule),
+			dialogs: make(map[string]string),
+		}
+
+		if err := tracer.loadDConfig(); err != nil {
+			tracer = nil
+			return
+		}
+
+		tracer.records = make(chan []byte, tracer.config.Qsize)
+
+		go tracer.write()
+	})
+
+	return tracer
+}
+
+func (t *Tracer) loadDConfig() error {
+	confPath := FullPath("conf/gortc.ini")
+
+	config := &traceDConfig{}
+	err := golib.ConfigFile(confPath, "JSIPTrace", config)
+	if err != nil {
+		return fmt.Errorf("Parse dconfig %s Failed, %s", confPath, err)
+	}
+	t.config = config
+
+	return nil
+}
+
+func (t *Tracer) SetLog(log *golib.Log, logLevel int) {
+	t.log = log
+	t.logLevel = logLevel
+}
+
+// Add trace rule, at least one of userid, dlg and uri should be set
+func (t *Tracer) AddRule(userid string, dlg string, uri string) (*TraceRule,
+	error) {
+
+	if userid == "" && dlg == "" && uri == "" {
+		return nil, errors.New("rule need userid, dlg or uri")
+	}
+
+	rule := &TraceRule{
+		Userid: userid,
+		Dlg:    dlg,
+		Uri:    uri,
+	}
+
+	if uri != "" {
+		re, err := regexp.Compile(uri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uri pattern %s, %s", uri, err)
+		}
+		rule.uri = re
+	}
+
+	t.lock.Lock()
+	t.seq++
+	rule.ID = strconv.FormatUint(t.seq, 10)
+	t.rules[rule.ID] = rule
+	t.lock.Unlock()
+
+	return rule, nil
+}
+
+// Delete trace rule, dialogs traced by the rule will stop tracing
+func (t *Tracer) DelRule(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.rules[id] == nil {
+		return false
+	}
+
+	delete(t.rules, id)
+	for dlg, rule := range t.dialogs {
+		if rule == id {
+			delete(t.dialogs, dlg)
+		}
+	}
+
+	return true
+}
+
+// Trace rules sorted by id
+func (t *Tracer) Rules() []*TraceRule {
+	t.lock.RLock()
+	rules := make([]*TraceRule, 0, len(t.rules))
+	for _, rule := range t.rules {
+		rules = append(rules, rule)
+	}
+	t.lock.RUnlock()
+
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].ID) != len(rules[j].ID) {
+			return len(rules[i].ID) < len(rules[j].ID)
+		}
+
+		return rules[i].ID < rules[j].ID
+	})
+
+	return rules
+}
+
+func uriUser(uri string) string {
+	u, err := NewJSIPUri(uri)
+	if err != nil {
+		return ""
+	}
+
+	return u.User
+}
+
+func (r *TraceRule) match(m *JSIP) bool {
+	if r.Dlg != "" && r.Dlg != m.DialogueID {
+		return false
+	}
+
+	if r.uri != nil && (m.Code != 0 || !r.uri.MatchString(m.RequestURI)) {
+		return false
+	}
+
+	if r.Userid != "" && r.Userid != m.Userid && r.Userid != uriUser(m.From) &&
+		r.Userid != uriUser(m.To) {
+
+		return false
+	}
+
+	return true
+}
+
+// rule id which msg traced by, "" if msg not traced
+func (t *Tracer) traced(m *JSIP) string {
+	t.lock.RLock()
+	id := t.dialogs[m.DialogueID]
+	traced := id != ""
+	if !traced {
+		for _, rule := range t.rules {
+			if rule.match(m) {
+				id = rule.ID
+				break
+			}
+		}
+	}
+	t.lock.RUnlock()
+
+	// write lock only for dialog starts or stops tracing
+	if id == "" || traced == (m.Type != TERM) {
+		return id
+	}
+
+	t.lock.Lock()
+	if traced {
+		delete(t.dialogs, m.DialogueID)
+	} else if t.rules[id] != nil { // rule may be deleted after matched
+		t.dialogs[m.DialogueID] = id
+	}
+	t.lock.Unlock()
+
+	return id
+}
+
+// remote address of connection
+func connRemote(c golib.Conn) string {
+	if c == nil {
+		return ""
+	}
+
+	r, ok := c.(interface{ RemoteAddr() net.Addr })
+	if ok && r.RemoteAddr() != nil {
+		return r.RemoteAddr().String()
+	}
+
+	return connName(c)
+}
+
+// Trace msg emitted by layer if msg matched by rules
+func (t *Tracer) trace(m *JSIP, layer string) {
+	id := t.traced(m)
+	if id == "" {
+		return
+	}
+
+	r := &TraceRecord{
+		Time:   time.Now(),
+		Rule:   id,
+		Dlg:    m.DialogueID,
+		Layer:  layer,
+		Dir:    "out",
+		Remote: connRemote(m.conn),
+		Type:   m.Type.String(),
+		Code:   m.Code,
+		CSeq:   m.CSeq,
+	}
+
+	if m.recv {
+		r.Dir = "in"
+	}
+
+	// trace record is JSON, whatever encoding of connection
+	if data, err := m.encode(); err == nil {
+		r.Msg = data
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		t.log.LogError(m, "Marshal trace record err: %s", err.Error())
+		return
+	}
+
+	select {
+	case t.records <- append(line, '\n'):
+	default:
+		t.log.LogError(m, "Trace queue full, record dropped")
+	}
+}
+
+func (s *JSIPStack) trace(m *JSIP, layer string) {
+	if tracer != nil {
+		tracer.trace(m, layer)
+	}
+}
+
+func (t *Tracer) open() error {
+	path := FullPath(t.config.File)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	t.file = f
+	t.size = info.Size()
+
+	return nil
+}
+
+// rotate trace file to file.1, file.1 to file.2, ..., keep MaxBackups files
+func (t *Tracer) rotate() error {
+	t.file.Close()
+	t.file = nil
+
+	path := FullPath(t.config.File)
+
+	if t.config.MaxBackups == 0 {
+		os.Remove(path)
+		return t.open()
+	}
+
+	for i := t.config.MaxBackups - 1; i > 0; i-- {
+		os.Rename(path+"."+strconv.FormatUint(i, 10),
+			path+"."+strconv.FormatUint(i+1, 10))
+	}
+	os.Rename(path, path+".1")
+
+	return t.open()
+}
+
+func (t *Tracer) write() {
+	for line := range t.records {
+		if t.file == nil {
+			if err := t.open(); err != nil {
+				t.log.LogError(t, "Open trace file err: %s", err.Error())
+				continue
+			}
+		}
+
+		// MaxSize 0 means trace file not rotated
+		maxSize := int64(t.config.MaxSize) * 1024 * 1024
+		if maxSize > 0 && t.size > 0 && t.size+int64(len(line)) > maxSize {
+			if err := t.rotate(); err != nil {
+				t.log.LogError(t, "Rotate trace file err: %s", err.Error())
+				continue
+			}
+		}
+
+		n, err := t.file.Write(line)
+		t.size += int64(n)
+		if err != nil {
+			t.log.LogError(t, "Write trace file err: %s", err.Error())
+		}
+	}
+}
+
+// for log ctx
+
+// Log ctx Prefix
+func (t *Tracer) Prefix() string {
+	return "[trace]"
+}
+
+// Log ctx Suffix
+func (t *Tracer) Suffix() string {
+	return ""
+}
+
+// Log ctx LogLevel
+func (t *Tracer) LogLevel() int {
+	return t.logLevel
+}
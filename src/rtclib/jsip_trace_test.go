@@ -0,0 +1,152 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP trace Test Case
+
+package rtclib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/alexwoo/golib"
+)
+
+func newTraceTest(file string, maxBackups uint64) *Tracer {
+	return &Tracer{
+		config: &traceDConfig{
+			File:       file,
+			MaxSize:    1,
+			MaxBackups: maxBackups,
+		},
+		log:     golib.NewLog("trace.log"),
+		rules:   make(map[string]*TraceRule),
+		dialogs: make(map[string]string),
+		records: make(chan []byte, 100),
+	}
+}
+
+func TestTraceRule(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTraceRule")
+
+	tr := newTraceTest("", 0)
+
+	_, err := tr.AddRule("", "", "")
+	assert(err != nil)
+	_, err = tr.AddRule("", "", "(")
+	assert(err != nil)
+
+	r1, _ := tr.AddRule("alice", "", "")
+	r2, _ := tr.AddRule("", "", "^room@chatroom")
+	assert(r1.ID == "1" && r2.ID == "2")
+
+	rules := tr.Rules()
+	assert(len(rules) == 2 && rules[0] == r1 && rules[1] == r2)
+
+	// not matched
+	m := JSIPMsgReq(INVITE, "carol@test.com", "bob@test.com",
+		"carol@test.com", "dlg1")
+	assert(tr.traced(m) == "")
+
+	// matched by user in From, and dialog traced
+	m = JSIPMsgReq(INVITE, "bob@test.com", "alice@test.com", "bob@test.com",
+		"dlg2")
+	assert(tr.traced(m) == r1.ID)
+	assert(tr.traced(JSIPMsgRes(m, 200)) == r1.ID)
+
+	// matched by RequestURI
+	m = JSIPMsgReq(MESSAGE, "room@chatroom.test.com", "bob@test.com",
+		"room@chatroom.test.com", "dlg3")
+	assert(tr.traced(m) == r2.ID)
+
+	// TERM stop tracing dialog
+	assert(tr.traced(JSIPMsgTerm("dlg3")) == r2.ID)
+	assert(tr.traced(JSIPMsgRes(m, 200)) == "")
+
+	// delete rule stop tracing dialogs by rule
+	assert(tr.DelRule(r1.ID) && !tr.DelRule(r1.ID))
+	assert(tr.traced(JSIPMsgRes(JSIPMsgReq(INVITE, "bob@test.com",
+		"alice@test.com", "bob@test.com", "dlg2"), 200)) == "")
+}
+
+func TestTraceFile(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTraceFile")
+
+	dir, err := ioutil.TempDir("", "trace")
+	assert(err == nil)
+	defer os.RemoveAll(dir)
+
+	file := dir + "/trace.log"
+	tr := newTraceTest(file, 2)
+	tr.AddRule("", "dlg1", "")
+
+	m := JSIPMsgReq(INVITE, "bob@test.com", "alice@test.com", "bob@test.com",
+		"dlg1")
+	m.SetString("X-Test", "abc")
+	m.recv = true
+	m.conn = &sipTestConn{}
+	tr.trace(m, TraceTransaction)
+	tr.trace(JSIPMsgRes(m, 200), TraceApp)
+	tr.trace(JSIPMsgTerm("dlg1"), TraceSession)
+	close(tr.records)
+	tr.write()
+
+	f, err := os.Open(file)
+	assert(err == nil)
+	records := []*TraceRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := &TraceRecord{}
+		assert(json.Unmarshal(scanner.Bytes(), r) == nil)
+		records = append(records, r)
+	}
+	f.Close()
+
+	assert(len(records) == 3)
+	assert(records[0].Layer == TraceTransaction && records[0].Dir == "in")
+	assert(records[0].Type == "INVITE" && records[0].Rule == "1")
+	assert(records[1].Layer == TraceApp && records[1].Dir == "out")
+	assert(records[1].Code == 200 && records[1].CSeq == m.CSeq)
+	assert(records[2].Type == "TERM" && records[2].Msg == nil)
+
+	// full msg
+	msg := &JSIP{}
+	assert(msg.Unmarshal(records[0].Msg) == nil)
+	header, _ := msg.GetString("X-Test")
+	assert(msg.DialogueID == "dlg1" && header == "abc")
+
+	// origin msg not modified by trace
+	_, ok := m.rawMsg["Request-URI"]
+	assert(!ok)
+
+	// rotate
+	for i := 0; i < 3; i++ {
+		assert(tr.rotate() == nil)
+	}
+	tr.file.Close()
+
+	_, err = os.Stat(file + ".1")
+	assert(err == nil)
+	_, err = os.Stat(file + ".2")
+	assert(err == nil)
+	_, err = os.Stat(file + ".3")
+	assert(os.IsNotExist(err))
+
+	// MaxSize 0, not rotated
+	tr = newTraceTest(file, 2)
+	tr.config.MaxSize = 0
+	tr.AddRule("", "dlg1", "")
+	tr.trace(m, TraceTransaction)
+	tr.trace(JSIPMsgRes(m, 200), TraceApp)
+	close(tr.records)
+	tr.write()
+	tr.file.Close()
+
+	data, err := ioutil.ReadFile(file)
+	assert(err == nil && bytes.Count(data, []byte("\n")) == 2)
+}
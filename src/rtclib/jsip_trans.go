@@ -8,6 +8,7 @@ package rtclib
 import (
 	"errors"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/alexwoo/golib"
@@ -42,16 +43,20 @@ type jsipTransInit struct {
 	transTimer time.Duration
 	prTimer    time.Duration
 	qsize      uint64
+	noSession  bool // session layer closed, all responses sent to app layer
 	msg        chan *JSIP
 	term       chan string
 }
 
 type jsipTransaction struct {
-	req   *JSIP
-	state jsipTransState
-	init  *jsipTransInit
-	timer *golib.Timer
-	log   *golib.Log
+	req     *JSIP
+	state   jsipTransState
+	init    *jsipTransInit
+	timer   *wheelTimer
+	log     *golib.Log
+	created time.Time
+
+	lock sync.Mutex // protect state for runtime state query
 }
 
 func transactionID(dlg string, seq uint64) string {
@@ -64,10 +69,11 @@ func createTransaction(m *JSIP, init *jsipTransInit, log *golib.Log) *jsipTransa
 	}
 
 	t := &jsipTransaction{
-		req:   m,
-		state: TRANS_INIT,
-		init:  init,
-		log:   log,
+		req:     m,
+		state:   TRANS_INIT,
+		init:    init,
+		log:     log,
+		created: time.Now(),
 	}
 
 	t.init.msg <- t.req
@@ -76,10 +82,12 @@ func createTransaction(m *JSIP, init *jsipTransInit, log *golib.Log) *jsipTransa
 		tid := transactionID(t.req.DialogueID, t.req.CSeq)
 		t.init.term <- tid
 	} else {
+		// timerHandle reads t.timer, schedule after t.timer set
+		t.timer = sharedWheel().NewTimer(t.timerHandle)
 		if m.Type == INVITE {
-			t.timer = golib.NewTimer(2*t.init.prTimer, t.timerHandle, nil)
+			t.timer.Reset(2 * t.init.prTimer)
 		} else {
-			t.timer = golib.NewTimer(t.init.transTimer, t.timerHandle, nil)
+			t.timer.Reset(t.init.transTimer)
 		}
 	}
 
@@ -147,9 +155,12 @@ func (t *jsipTransaction) onMsg(m *JSIP) {
 		}
 	}
 
+	t.lock.Lock()
 	t.state = state
+	t.lock.Unlock()
 
-	if (t.req.Type != BYE && t.req.Type != CANCEL) || !m.recv { // Recv BYE response will not send to session layer
+	if (t.req.Type != BYE && t.req.Type != CANCEL) || !m.recv ||
+		t.init.noSession { // Recv BYE response will not send to session layer
 		t.init.msg <- m
 	}
 
@@ -169,10 +180,12 @@ func (t *jsipTransaction) quit() {
 	t.init.term <- tid
 }
 
-func (t *jsipTransaction) timerHandle(d interface{}) {
+func (t *jsipTransaction) timerHandle() {
 	t.log.LogError(t.req, "%s Transaction timeout", t.req.Type.String())
+	jsipTransTimeouts.Inc(t.req.Type.String())
 
-	if (t.req.Type != BYE && t.req.Type != CANCEL) || t.req.recv { // Recv BYE response will not send to session layer
+	if (t.req.Type != BYE && t.req.Type != CANCEL) || t.req.recv ||
+		t.init.noSession { // Recv BYE response will not send to session layer
 		resp := JSIPMsgRes(t.req, 408)
 		resp.recv = !t.req.recv
 
@@ -181,3 +194,17 @@ func (t *jsipTransaction) timerHandle(d interface{}) {
 
 	t.quit()
 }
+
+func (t *jsipTransaction) info(tid string) *JSIPTransInfo {
+	t.lock.Lock()
+	state := t.state
+	t.lock.Unlock()
+
+	return &JSIPTransInfo{
+		ID:    tid,
+		Dlg:   t.req.DialogueID,
+		Type:  t.req.Type.String(),
+		State: state.String(),
+		Age:   time.Since(t.created).Seconds(),
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Location service, bindings of userid to connection created by REGISTER
+
+package rtclib
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+var (
+	locOnce sync.Once
+
+	location *Location
+)
+
+type locationDConfig struct {
+	MinExpire    time.Duration `default:"60s"`
+	MaxExpire    time.Duration `default:"3600s"`
+	ReapInterval time.Duration `default:"10s"`
+}
+
+// Binding of userid to connection
+type Binding struct {
+	Userid  string
+	Realm   string
+	Contact string
+	Expires time.Time
+
+	conn golib.Conn
+}
+
+// Connection user registered from
+func (b *Binding) Conn() golib.Conn {
+	return b.conn
+}
+
+// Send JSIP msg to user by connection user registered from
+func (b *Binding) Send(m *JSIP) {
+	m.conn = b.conn
+
+	SendMsg(m)
+}
+
+type Location struct {
+	config *locationDConfig
+
+	log      *golib.Log
+	logLevel int
+
+	lock     sync.RWMutex
+	bindings map[string]*Binding
+	conns    map[golib.Conn]map[string]bool // conn -> userids registered
+}
+
+func LocationInstance() *Location {
+	locOnce.Do(func() {
+		location = &Location{
+			bindings: make(map[string]*Binding),
+			conns:    make(map[golib.Conn]map[string]bool),
+		}
+
+		if err := location.loadDConfig(); err != nil {
+			location = nil
+			return
+		}
+
+		go location.reap()
+	})
+
+	return location
+}
+
+func (l *Location) loadDConfig() error {
+	confPath := FullPath("conf/gortc.ini")
+
+	config := &locationDConfig{}
+	err := golib.ConfigFile(confPath, "Location", config)
+	if err != nil {
+		return fmt.Errorf("Parse dconfig %s Failed, %s", confPath, err)
+	}
+	l.config = config
+
+	return nil
+}
+
+func (l *Location) SetLog(log *golib.Log, logLevel int) {
+	l.log = log
+	l.logLevel = logLevel
+}
+
+// Process REGISTER, create or refresh binding of userid in To,
+// remove binding if Expire is 0, return response for REGISTER
+func (l *Location) Register(m *JSIP) *JSIP {
+	if m.Type != REGISTER || m.Code != 0 {
+		return nil
+	}
+
+	to, err := NewJSIPUri(m.To)
+	if err != nil || to.User == "" {
+		return JSIPMsgRes(m, 400)
+	}
+
+	// userid can only be bound by request authenticated as userid, or from
+	// connection of user connected with userid
+	if m.authUser != to.User &&
+		(jstack == nil || !jstack.connected(to.User, m.conn)) {
+
+		return JSIPMsgRes(m, 403)
+	}
+
+	expire := l.config.MaxExpire
+	if e, ok := m.GetUint("Expire"); ok {
+		expire = time.Duration(e) * time.Second
+	}
+
+	if expire == 0 {
+		l.lock.Lock()
+		l.unbind(to.User)
+		l.lock.Unlock()
+
+		resp := JSIPMsgRes(m, 200)
+		resp.SetUint("Expire", 0)
+
+		return resp
+	}
+
+	if expire < l.config.MinExpire {
+		resp := JSIPMsgRes(m, 423)
+		resp.SetUint("Min-Expire", uint64(l.config.MinExpire.Seconds()))
+
+		return resp
+	}
+
+	if expire > l.config.MaxExpire {
+		expire = l.config.MaxExpire
+	}
+
+	contact, ok := m.GetString("Contact")
+	if !ok || contact == "" {
+		contact = m.From
+	}
+
+	b := &Binding{
+		Userid:  to.User,
+		Realm:   to.Hostport.Host,
+		Contact: contact,
+		Expires: time.Now().Add(expire),
+		conn:    m.conn,
+	}
+
+	l.lock.Lock()
+	l.bind(b)
+	l.lock.Unlock()
+
+	resp := JSIPMsgRes(m, 200)
+	resp.SetUint("Expire", uint64(expire.Seconds()))
+
+	return resp
+}
+
+// Lookup binding of userid, return nil if not registered or expired
+func (l *Location) Lookup(userid string) *Binding {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	b := l.bindings[userid]
+	if b == nil || time.Now().After(b.Expires) {
+		return nil
+	}
+
+	return b
+}
+
+// Remove binding of userid, return false if not registered
+func (l *Location) Kick(userid string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.unbind(userid)
+}
+
+// Remove bindings registered from conn, called when conn closed
+func (l *Location) Unbind(conn golib.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for userid := range l.conns[conn] {
+		l.unbind(userid)
+	}
+}
+
+// userid registered from conn, the least one if more than one registered,
+// "" if not found
+func (l *Location) connUser(conn golib.Conn) string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	user := ""
+	for userid := range l.conns[conn] {
+		if user == "" || userid < user {
+			user = userid
+		}
+	}
+
+	return user
+}
+
+// add or replace binding, with lock held
+func (l *Location) bind(b *Binding) {
+	l.unbind(b.Userid)
+
+	l.bindings[b.Userid] = b
+
+	users := l.conns[b.conn]
+	if users == nil {
+		users = make(map[string]bool)
+		l.conns[b.conn] = users
+	}
+	users[b.Userid] = true
+}
+
+// remove binding of userid, with lock held, return false if not registered
+func (l *Location) unbind(userid string) bool {
+	b := l.bindings[userid]
+	if b == nil {
+		return false
+	}
+
+	delete(l.bindings, userid)
+
+	users := l.conns[b.conn]
+	delete(users, userid)
+	if len(users) == 0 {
+		delete(l.conns, b.conn)
+	}
+
+	return true
+}
+
+// All bindings sorted by userid
+func (l *Location) Bindings() []*Binding {
+	l.lock.RLock()
+	bindings := make([]*Binding, 0, len(l.bindings))
+	for _, b := range l.bindings {
+		bindings = append(bindings, b)
+	}
+	l.lock.RUnlock()
+
+	sort.Slice(bindings, func(i, j int) bool {
+		return bindings[i].Userid < bindings[j].Userid
+	})
+
+	return bindings
+}
+
+func (l *Location) State() string {
+	ret := "userid\t\trealm\t\tcontact\t\texpires\n"
+	ret += "------------------------------------------------------------\n"
+	for _, b := range l.Bindings() {
+		ret += fmt.Sprintf("%s\t%s\t%s\t%s\n", b.Userid, b.Realm, b.Contact,
+			b.Expires.Format("2006-01-02 15:04:05.000"))
+	}
+	ret += "------------------------------------------------------------\n"
+
+	return ret
+}
+
+// remove location bindings registered from conn closed
+func unbindConn(conn golib.Conn) {
+	if location != nil {
+		location.Unbind(conn)
+	}
+}
+
+func (l *Location) reapExpired(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for userid, b := range l.bindings {
+		if now.After(b.Expires) {
+			l.unbind(userid)
+		}
+	}
+}
+
+func (l *Location) reap() {
+	t := time.NewTicker(l.config.ReapInterval)
+	defer t.Stop()
+
+	for now := range t.C {
+		l.reapExpired(now)
+	}
+}
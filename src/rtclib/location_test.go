@@ -0,0 +1,116 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Location service Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+func TestLocation(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestLocation")
+
+	l := &Location{
+		config: &locationDConfig{
+			MinExpire: 60 * time.Second,
+			MaxExpire: 3600 * time.Second,
+		},
+		bindings: make(map[string]*Binding),
+		conns:    make(map[golib.Conn]map[string]bool),
+	}
+
+	conn := &sipTestConn{}
+
+	old := jstack
+	jstack = &JSIPStack{
+		users: map[string]golib.Conn{
+			"alice": conn, "bob": conn, "carol": conn,
+		},
+	}
+	defer func() { jstack = old }()
+
+	register := func(userid string, expire int64) *JSIP {
+		m := JSIPMsgReq(REGISTER, "test.com", userid+"@test.com",
+			userid+"@test.com", "dlg_"+userid)
+		m.conn = conn
+		if expire >= 0 {
+			m.SetInt("Expire", expire)
+		}
+
+		return l.Register(m)
+	}
+
+	resp := register("alice", 120)
+	expire, _ := resp.GetUint("Expire")
+	assert(resp.Code == 200 && expire == 120)
+
+	b := l.Lookup("alice")
+	assert(b != nil && b.Conn() == conn && b.Realm == "test.com")
+	assert(b.Contact == "alice@test.com")
+	assert(l.Lookup("bob") == nil)
+
+	// no Expire and Expire too large use max expire
+	resp = register("bob", -1)
+	expire, _ = resp.GetUint("Expire")
+	assert(resp.Code == 200 && expire == 3600)
+
+	resp = register("bob", 7200)
+	expire, _ = resp.GetUint("Expire")
+	assert(resp.Code == 200 && expire == 3600)
+
+	resp = register("carol", 10)
+	minExpire, _ := resp.GetUint("Min-Expire")
+	assert(resp.Code == 423 && minExpire == 60)
+	assert(l.Lookup("carol") == nil)
+
+	bindings := l.Bindings()
+	assert(len(bindings) == 2 && bindings[0].Userid == "alice" &&
+		bindings[1].Userid == "bob")
+	assert(l.connUser(conn) == "alice")
+
+	// unregister
+	resp = register("alice", 0)
+	assert(resp.Code == 200 && l.Lookup("alice") == nil)
+
+	// expired
+	register("alice", 120)
+	l.reapExpired(time.Now().Add(200 * time.Second))
+	assert(l.Lookup("alice") == nil && l.Lookup("bob") != nil)
+
+	assert(l.Kick("bob") && !l.Kick("bob"))
+	assert(len(l.Bindings()) == 0)
+
+	m := JSIPMsgReq(REGISTER, "test.com", "test.com", "test.com", "dlg")
+	assert(l.Register(m).Code == 400)
+
+	// register other user from conn not connected with userid
+	other := &sipTestConn{}
+	m = JSIPMsgReq(REGISTER, "test.com", "alice@test.com", "alice@test.com",
+		"dlg_other")
+	m.conn = other
+	assert(l.Register(m).Code == 403 && l.Lookup("alice") == nil)
+
+	// authenticated request
+	m.authUser = "alice"
+	assert(l.Register(m).Code == 200 && l.Lookup("alice").Conn() == other)
+
+	m.authUser = "bob"
+	m.To = "carol@test.com"
+	assert(l.Register(m).Code == 403 && l.Lookup("carol") == nil)
+
+	// bindings removed when conn closed
+	register("bob", 120)
+	assert(l.connUser(other) == "alice" && l.connUser(conn) == "bob")
+	l.Unbind(other)
+	assert(l.Lookup("alice") == nil && l.Lookup("bob") != nil)
+	assert(l.connUser(other) == "" && len(l.conns) == 1)
+
+	l.Unbind(conn)
+	assert(len(l.bindings) == 0 && len(l.conns) == 0)
+}
@@ -0,0 +1,385 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Metrics in prometheus text format
+
+package rtclib
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+var (
+	metricsLock sync.Mutex
+	metrics     []metric
+	metricNames = map[string]bool{}
+)
+
+func registerMetric(name string, m metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if metricNames[name] {
+		panic("metric " + name + " registered")
+	}
+
+	metricNames[name] = true
+	metrics = append(metrics, m)
+}
+
+// Return all metrics registered in prometheus text format
+func Metrics() string {
+	metricsLock.Lock()
+	ms := make([]metric, len(metrics))
+	copy(ms, metrics)
+	metricsLock.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, m := range ms {
+		m.write(buf)
+	}
+
+	return buf.String()
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = n + "=\"" + escapeLabel(values[i]) + "\""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(buf *bytes.Buffer, name string, help string, typ string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+}
+
+// values of metric with labels
+type metricVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64 // label values joined with \xff -> value
+}
+
+func (v *metricVec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s need %d label values, but %d", v.name,
+			len(v.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+func (v *metricVec) add(delta float64, values []string) {
+	k := v.key(values)
+
+	v.lock.Lock()
+	v.values[k] += delta
+	v.lock.Unlock()
+}
+
+func (v *metricVec) set(value float64, values []string) {
+	k := v.key(values)
+
+	v.lock.Lock()
+	v.values[k] = value
+	v.lock.Unlock()
+}
+
+func (v *metricVec) get(values []string) float64 {
+	k := v.key(values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.values[k]
+}
+
+func (v *metricVec) writeValues(buf *bytes.Buffer, typ string) {
+	writeHeader(buf, v.name, v.help, typ)
+
+	v.lock.Lock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		values := []string{}
+		if len(v.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+
+		fmt.Fprintf(buf, "%s%s %s\n", v.name, formatLabels(v.labels, values),
+			formatValue(v.values[k]))
+	}
+	v.lock.Unlock()
+}
+
+// Counter only increase
+type Counter struct {
+	metricVec
+}
+
+// Create and register a counter with label names
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		metricVec: metricVec{
+			name:   name,
+			help:   help,
+			labels: labels,
+			values: make(map[string]float64),
+		},
+	}
+
+	registerMetric(name, c)
+
+	return c
+}
+
+// Increase counter with label values by 1
+func (c *Counter) Inc(values ...string) {
+	c.add(1, values)
+}
+
+// Get counter value with label values
+func (c *Counter) Get(values ...string) float64 {
+	return c.get(values)
+}
+
+func (c *Counter) write(buf *bytes.Buffer) {
+	c.writeValues(buf, "counter")
+}
+
+// Gauge can increase and decrease
+type Gauge struct {
+	metricVec
+}
+
+// Create and register a gauge with label names
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		metricVec: metricVec{
+			name:   name,
+			help:   help,
+			labels: labels,
+			values: make(map[string]float64),
+		},
+	}
+
+	registerMetric(name, g)
+
+	return g
+}
+
+// Set gauge with label values
+func (g *Gauge) Set(value float64, values ...string) {
+	g.set(value, values)
+}
+
+// Add delta to gauge with label values
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.add(delta, values)
+}
+
+// Get gauge value with label values
+func (g *Gauge) Get(values ...string) float64 {
+	return g.get(values)
+}
+
+func (g *Gauge) write(buf *bytes.Buffer) {
+	g.writeValues(buf, "gauge")
+}
+
+// Gauge collected when metrics output
+type GaugeFunc struct {
+	name  string
+	help  string
+	label string
+	f     func() map[string]float64
+}
+
+// Create and register a gauge func, f return label value -> gauge value,
+// if label is "", f should return value with key ""
+func NewGaugeFunc(name string, help string, label string,
+	f func() map[string]float64) *GaugeFunc {
+
+	g := &GaugeFunc{
+		name:  name,
+		help:  help,
+		label: label,
+		f:     f,
+	}
+
+	registerMetric(name, g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(buf *bytes.Buffer) {
+	writeHeader(buf, g.name, g.help, "gauge")
+
+	values := g.f()
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		labels := ""
+		if g.label != "" {
+			labels = formatLabels([]string{g.label}, []string{k})
+		}
+
+		fmt.Fprintf(buf, "%s%s %s\n", g.name, labels, formatValue(values[k]))
+	}
+}
+
+// Default buckets for histogram of latency in seconds
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5,
+	5, 10}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram count observations in buckets
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogramValue
+}
+
+// Create and register a histogram with buckets and label names,
+// DefBuckets is used if buckets is nil
+func NewHistogram(name string, help string, buckets []float64,
+	labels ...string) *Histogram {
+
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+
+	registerMetric(name, h)
+
+	return h
+}
+
+// Observe a value with label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	if len(values) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s need %d label values, but %d", h.name,
+			len(h.labels), len(values)))
+	}
+
+	k := strings.Join(values, "\xff")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	hv := h.values[k]
+	if hv == nil {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Observe duration since start in seconds with label values
+func (h *Histogram) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	writeHeader(buf, h.name, h.help, "histogram")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	names := make([]string, len(h.labels), len(h.labels)+1)
+	copy(names, h.labels)
+	names = append(names, "le")
+	for _, k := range keys {
+		values := []string{}
+		if len(h.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name,
+				formatLabels(names, append(values, formatValue(b))),
+				hv.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name,
+			formatLabels(names, append(values, "+Inf")), hv.count)
+
+		labels := formatLabels(h.labels, values)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, labels, formatValue(hv.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, labels, hv.count)
+	}
+}
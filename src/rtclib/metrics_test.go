@@ -0,0 +1,66 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Metrics Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestMetrics")
+
+	c := NewCounter("test_counter_total", "test counter", "type")
+	c.Inc("a")
+	c.Inc("a")
+	c.Inc("b")
+	assert(c.Get("a") == 2 && c.Get("b") == 1 && c.Get("c") == 0)
+
+	g := NewGauge("test_gauge", "test gauge")
+	g.Set(10)
+	g.Add(-3)
+	assert(g.Get() == 7)
+
+	NewGaugeFunc("test_gauge_func", "test gauge func", "queue",
+		func() map[string]float64 {
+			return map[string]float64{"q1": 1, "q\"2": 2}
+		})
+
+	h := NewHistogram("test_histogram", "test histogram", []float64{0.1, 1},
+		"api")
+	h.Observe(0.05, "x")
+	h.Observe(0.5, "x")
+	h.Observe(5, "x")
+
+	out := Metrics()
+	for _, line := range []string{
+		"# TYPE test_counter_total counter",
+		`test_counter_total{type="a"} 2`,
+		`test_counter_total{type="b"} 1`,
+		"# TYPE test_gauge gauge",
+		"test_gauge 7",
+		`test_gauge_func{queue="q1"} 1`,
+		`test_gauge_func{queue="q\"2"} 2`,
+		"# TYPE test_histogram histogram",
+		`test_histogram_bucket{api="x",le="0.1"} 1`,
+		`test_histogram_bucket{api="x",le="1"} 2`,
+		`test_histogram_bucket{api="x",le="+Inf"} 3`,
+		`test_histogram_sum{api="x"} 5.55`,
+		`test_histogram_count{api="x"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			fmt.Println(out)
+			assert(false)
+		}
+	}
+
+	// duplicate metric name
+	defer func() {
+		assert(recover() != nil)
+	}()
+	NewGauge("test_gauge", "duplicate")
+}
@@ -0,0 +1,276 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// MessagePack encoding of JSIP msg, websocket subprotocol jsip.msgpack
+// bin is decoded as str, ext types are not supported
+
+package rtclib
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) appendNil(b []byte) []byte {
+	return append(b, 0xc0)
+}
+
+func (msgpackCodec) appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+
+	return append(b, 0xc2)
+}
+
+func (c msgpackCodec) appendInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return c.appendUint(b, uint64(v))
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return appendBE(append(b, 0xd1), uint64(v), 2)
+	case v >= math.MinInt32:
+		return appendBE(append(b, 0xd2), uint64(v), 4)
+	}
+
+	return appendBE(append(b, 0xd3), uint64(v), 8)
+}
+
+func (msgpackCodec) appendUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 0x80:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return appendBE(append(b, 0xcd), v, 2)
+	case v <= math.MaxUint32:
+		return appendBE(append(b, 0xce), v, 4)
+	}
+
+	return appendBE(append(b, 0xcf), v, 8)
+}
+
+func (msgpackCodec) appendFloat(b []byte, v float64) []byte {
+	return appendBE(append(b, 0xcb), math.Float64bits(v), 8)
+}
+
+func (msgpackCodec) appendString(b []byte, s string) []byte {
+	n := uint64(len(s))
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = appendBE(append(b, 0xda), n, 2)
+	default:
+		b = appendBE(append(b, 0xdb), n, 4)
+	}
+
+	return append(b, s...)
+}
+
+func (msgpackCodec) appendArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return appendBE(append(b, 0xdc), uint64(n), 2)
+	}
+
+	return appendBE(append(b, 0xdd), uint64(n), 4)
+}
+
+func (msgpackCodec) appendMap(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return appendBE(append(b, 0xde), uint64(n), 2)
+	}
+
+	return appendBE(append(b, 0xdf), uint64(n), 4)
+}
+
+// append low n bytes of v in network byte order
+func appendBE(b []byte, v uint64, n int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+
+	return append(b, buf[8-n:]...)
+}
+
+func (msgpackCodec) decode(data []byte) (interface{}, error) {
+	d := &binaryDecoder{data: data}
+
+	v, err := d.msgpackValue(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.end() {
+		return nil, errors.New("msgpack extra data")
+	}
+
+	return v, nil
+}
+
+func (d *binaryDecoder) msgpackValue(depth int) (interface{}, error) {
+	c, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c < 0x80: // positive fixint
+		return int64(c), nil
+	case c >= 0xe0: // negative fixint
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80: // fixmap
+		return d.msgpackMap(uint64(c&0x0f), depth)
+	case c&0xf0 == 0x90: // fixarray
+		return d.msgpackArray(uint64(c&0x0f), depth)
+	case c&0xe0 == 0xa0: // fixstr
+		return d.msgpackString(uint64(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9: // bin 8, str 8
+		return d.msgpackSized(1, d.msgpackString)
+	case 0xc5, 0xda:
+		return d.msgpackSized(2, d.msgpackString)
+	case 0xc6, 0xdb:
+		return d.msgpackSized(4, d.msgpackString)
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (c - 0xcc))
+		if v <= math.MaxInt64 {
+			return int64(v), err
+		}
+		return v, err
+	case 0xd0:
+		v, err := d.uint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.uint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.uint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.uint(8)
+		return int64(v), err
+	case 0xdc:
+		return d.msgpackSized(2, func(n uint64) (interface{}, error) {
+			return d.msgpackArray(n, depth)
+		})
+	case 0xdd:
+		return d.msgpackSized(4, func(n uint64) (interface{}, error) {
+			return d.msgpackArray(n, depth)
+		})
+	case 0xde:
+		return d.msgpackSized(2, func(n uint64) (interface{}, error) {
+			return d.msgpackMap(n, depth)
+		})
+	case 0xdf:
+		return d.msgpackSized(4, func(n uint64) (interface{}, error) {
+			return d.msgpackMap(n, depth)
+		})
+	}
+
+	return nil, errors.New("msgpack type not supported")
+}
+
+// read length in size bytes, then decode value of length
+func (d *binaryDecoder) msgpackSized(size int,
+	f func(n uint64) (interface{}, error)) (interface{}, error) {
+
+	n, err := d.uint(size)
+	if err != nil {
+		return nil, err
+	}
+
+	return f(n)
+}
+
+func (d *binaryDecoder) msgpackString(n uint64) (interface{}, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (d *binaryDecoder) msgpackArray(n uint64, depth int) (interface{},
+	error) {
+
+	if depth >= binaryMaxDepth {
+		return nil, errBinaryDepth
+	}
+
+	l, err := d.count(n, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	a := make([]interface{}, l)
+	for i := range a {
+		if a[i], err = d.msgpackValue(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (d *binaryDecoder) msgpackMap(n uint64, depth int) (interface{},
+	error) {
+
+	if depth >= binaryMaxDepth {
+		return nil, errBinaryDepth
+	}
+
+	l, err := d.count(n, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{}, l)
+	for i := 0; i < l; i++ {
+		k, err := d.msgpackValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return nil, errBinaryKey
+		}
+
+		if m[key], err = d.msgpackValue(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
@@ -0,0 +1,372 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Route Table for relid and DialogueID
+
+package rtclib
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Route Table records which gortc node owns a relid or DialogueID,
+// so a gortc cluster can send msg to the node which created the task
+type RouteTable interface {
+	// Set id owned by node
+	Set(id string, node string)
+
+	// Get node which owns id
+	Get(id string) (string, bool)
+
+	// Delete id from route table
+	Del(id string)
+
+	// All ids and nodes in route table
+	Routes() map[string]string
+
+	// Release route table resources
+	Close()
+}
+
+// In memory route table, only used by single gortc node
+type MemRouteTable struct {
+	lock   sync.RWMutex
+	routes map[string]string
+}
+
+// New a in memory route table
+func NewMemRouteTable() *MemRouteTable {
+	return &MemRouteTable{
+		routes: make(map[string]string),
+	}
+}
+
+func (t *MemRouteTable) Set(id string, node string) {
+	t.lock.Lock()
+	t.routes[id] = node
+	t.lock.Unlock()
+}
+
+func (t *MemRouteTable) Get(id string) (string, bool) {
+	t.lock.RLock()
+	node, ok := t.routes[id]
+	t.lock.RUnlock()
+
+	return node, ok
+}
+
+func (t *MemRouteTable) Del(id string) {
+	t.lock.Lock()
+	delete(t.routes, id)
+	t.lock.Unlock()
+}
+
+func (t *MemRouteTable) Routes() map[string]string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	routes := make(map[string]string, len(t.routes))
+	for id, node := range t.routes {
+		routes[id] = node
+	}
+
+	return routes
+}
+
+func (t *MemRouteTable) Close() {
+}
+
+// Route update exchanged between gossip route tables
+type RouteUpdate struct {
+	ID      string `json:"id"`
+	Node    string `json:"node"`
+	Version uint64 `json:"version"`
+	Deleted bool   `json:"deleted"`
+}
+
+// newer returns whether u should replace o, last writer wins,
+// if version is same, use node as tie-breaker
+func (u *RouteUpdate) newer(o *RouteUpdate) bool {
+	if u.Version != o.Version {
+		return u.Version > o.Version
+	}
+
+	return u.Node > o.Node
+}
+
+// Peer of gossip route table
+type RoutePeer interface {
+	// Push route updates from node to peer
+	Push(from string, updates []*RouteUpdate) error
+}
+
+type gossipRoute struct {
+	RouteUpdate
+	time time.Time
+}
+
+// Gossip route table, every gortc node holds a full replica of route table,
+// route updates are pushed to all peers periodically, and full route table
+// is pushed every syncInterval for repairing lost updates
+type GossipRouteTable struct {
+	node  string
+	clock uint64
+
+	lock    sync.RWMutex
+	routes  map[string]*gossipRoute
+	pending []*RouteUpdate
+
+	peerLock sync.RWMutex
+	peers    []RoutePeer
+
+	interval     time.Duration
+	syncInterval time.Duration
+	tombstone    time.Duration
+	onErr        func(err error)
+
+	quit chan bool
+}
+
+// New a gossip route table for node,
+// updates are pushed to peers every interval,
+// full route table is pushed to peers every syncInterval
+func NewGossipRouteTable(node string, interval time.Duration,
+	syncInterval time.Duration) *GossipRouteTable {
+
+	t := &GossipRouteTable{
+		node:         node,
+		routes:       make(map[string]*gossipRoute),
+		interval:     interval,
+		syncInterval: syncInterval,
+		tombstone:    syncInterval * 2,
+		quit:         make(chan bool, 1),
+	}
+
+	go t.loop()
+
+	return t
+}
+
+// Add a peer for pushing route updates
+func (t *GossipRouteTable) AddPeer(p RoutePeer) {
+	t.peerLock.Lock()
+	t.peers = append(t.peers, p)
+	t.peerLock.Unlock()
+}
+
+// Set handler for peer push error
+func (t *GossipRouteTable) OnError(h func(err error)) {
+	t.onErr = h
+}
+
+// Node name of gossip route table
+func (t *GossipRouteTable) Node() string {
+	return t.node
+}
+
+func (t *GossipRouteTable) update(id string, node string, deleted bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.clock++
+
+	u := RouteUpdate{
+		ID:      id,
+		Node:    node,
+		Version: t.clock,
+		Deleted: deleted,
+	}
+
+	t.routes[id] = &gossipRoute{
+		RouteUpdate: u,
+		time:        time.Now(),
+	}
+	t.pending = append(t.pending, &u)
+}
+
+func (t *GossipRouteTable) Set(id string, node string) {
+	t.update(id, node, false)
+}
+
+func (t *GossipRouteTable) Get(id string) (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	r := t.routes[id]
+	if r == nil || r.Deleted {
+		return "", false
+	}
+
+	return r.Node, true
+}
+
+func (t *GossipRouteTable) Del(id string) {
+	t.lock.RLock()
+	r := t.routes[id]
+	t.lock.RUnlock()
+
+	if r == nil || r.Deleted {
+		return
+	}
+
+	t.update(id, r.Node, true)
+}
+
+func (t *GossipRouteTable) Routes() map[string]string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	routes := make(map[string]string, len(t.routes))
+	for id, r := range t.routes {
+		if !r.Deleted {
+			routes[id] = r.Node
+		}
+	}
+
+	return routes
+}
+
+// Merge route updates pushed from peer, implement RoutePeer interface,
+// so gossip route tables in same process can be peers of each other
+func (t *GossipRouteTable) Push(from string, updates []*RouteUpdate) error {
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, u := range updates {
+		if u.Version > t.clock {
+			t.clock = u.Version
+		}
+
+		r := t.routes[u.ID]
+		if r != nil && !u.newer(&r.RouteUpdate) {
+			continue
+		}
+
+		t.routes[u.ID] = &gossipRoute{
+			RouteUpdate: *u,
+			time:        now,
+		}
+	}
+
+	return nil
+}
+
+func (t *GossipRouteTable) Close() {
+	t.quit <- true
+}
+
+func (t *GossipRouteTable) snapshot() []*RouteUpdate {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	updates := make([]*RouteUpdate, 0, len(t.routes))
+	for id, r := range t.routes {
+		// tombstone has been pushed for enough times, purge it
+		if r.Deleted && now.Sub(r.time) > t.tombstone {
+			delete(t.routes, id)
+			continue
+		}
+
+		u := r.RouteUpdate
+		updates = append(updates, &u)
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Version < updates[j].Version
+	})
+
+	return updates
+}
+
+func (t *GossipRouteTable) push(updates []*RouteUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+
+	t.peerLock.RLock()
+	peers := t.peers
+	t.peerLock.RUnlock()
+
+	for _, p := range peers {
+		if err := p.Push(t.node, updates); err != nil && t.onErr != nil {
+			t.onErr(err)
+		}
+	}
+}
+
+// Flush pending route updates to peers immediately
+func (t *GossipRouteTable) Flush() {
+	t.lock.Lock()
+	updates := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+
+	t.push(updates)
+}
+
+func (t *GossipRouteTable) loop() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	lastSync := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+			if time.Since(lastSync) >= t.syncInterval {
+				lastSync = time.Now()
+
+				t.lock.Lock()
+				t.pending = nil
+				t.lock.Unlock()
+
+				t.push(t.snapshot())
+			} else {
+				t.Flush()
+			}
+
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// Route peer using gortc api server
+type httpRoutePeer struct {
+	url     string
+	timeout time.Duration
+}
+
+// New a route peer, route updates will be posted to url
+func NewHTTPRoutePeer(url string, timeout time.Duration) RoutePeer {
+	return &httpRoutePeer{
+		url:     url,
+		timeout: timeout,
+	}
+}
+
+func (p *httpRoutePeer) Push(from string, updates []*RouteUpdate) error {
+	body := map[string]interface{}{
+		"node":   from,
+		"routes": updates,
+	}
+
+	req := NewAPIRequest("POST", p.url, nil, &body, p.timeout)
+	resp, err := req.Do()
+	if err != nil {
+		return err
+	}
+
+	if resp.APICode() != 0 {
+		return fmt.Errorf("push routes to %s failed, code %d", p.url,
+			resp.APICode())
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Route Table Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemRouteTable(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestMemRouteTable")
+
+	rt := NewMemRouteTable()
+	defer rt.Close()
+
+	rt.Set("relid1", "node1")
+	node, ok := rt.Get("relid1")
+	assert(ok && node == "node1")
+
+	_, ok = rt.Get("relid2")
+	assert(!ok)
+
+	assert(len(rt.Routes()) == 1)
+
+	rt.Del("relid1")
+	_, ok = rt.Get("relid1")
+	assert(!ok)
+}
+
+func TestGossipRouteTable(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestGossipRouteTable")
+
+	t1 := NewGossipRouteTable("node1", time.Hour, time.Hour)
+	t2 := NewGossipRouteTable("node2", time.Hour, time.Hour)
+	t3 := NewGossipRouteTable("node3", time.Hour, time.Hour)
+	defer t1.Close()
+	defer t2.Close()
+	defer t3.Close()
+
+	tables := []*GossipRouteTable{t1, t2, t3}
+	for _, a := range tables {
+		for _, b := range tables {
+			if a != b {
+				a.AddPeer(b)
+			}
+		}
+	}
+
+	t1.Set("relid1", t1.Node())
+	t2.Set("dlg1", t2.Node())
+	t1.Flush()
+	t2.Flush()
+
+	for _, rt := range tables {
+		node, ok := rt.Get("relid1")
+		assert(ok && node == "node1")
+
+		node, ok = rt.Get("dlg1")
+		assert(ok && node == "node2")
+	}
+
+	// delete from other node
+	t3.Del("relid1")
+	t3.Flush()
+	for _, rt := range tables {
+		_, ok := rt.Get("relid1")
+		assert(!ok)
+		assert(len(rt.Routes()) == 1)
+	}
+
+	// older update will be ignored
+	t1.Push("node1", []*RouteUpdate{
+		&RouteUpdate{ID: "dlg1", Node: "node1", Version: 1},
+	})
+	node, ok := t1.Get("dlg1")
+	assert(ok && node == "node2")
+}
+
+func TestGossipRouteTableSync(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestGossipRouteTableSync")
+
+	t1 := NewGossipRouteTable("node1", 10*time.Millisecond,
+		50*time.Millisecond)
+	t2 := NewGossipRouteTable("node2", 10*time.Millisecond,
+		50*time.Millisecond)
+	defer t1.Close()
+	defer t2.Close()
+
+	// t2 join after t1 set routes, routes will be synced by full sync
+	t1.Set("relid1", t1.Node())
+	t1.Flush()
+
+	t1.AddPeer(t2)
+	t2.AddPeer(t1)
+
+	time.Sleep(200 * time.Millisecond)
+
+	node, ok := t2.Get("relid1")
+	assert(ok && node == "node1")
+}
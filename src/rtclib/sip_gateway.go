@@ -0,0 +1,682 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// SIP over WebSocket (RFC 7118) gateway, translate between SIP and JSIP
+
+package rtclib
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alexwoo/golib"
+	uuid "github.com/satori/go.uuid"
+	"github.com/tidwall/gjson"
+)
+
+// SIP transaction mapped to JSIP transaction
+type sipTrans struct {
+	jsipCSeq uint64
+	sipCSeq  uint64
+	method   string
+	branch   string
+	code     int     // final response code
+	req      *SIPMsg // SIP request received, for creating SIP response
+}
+
+// SIP dialog mapped to JSIP DialogueID
+type sipDialog struct {
+	dlg       string
+	callID    string
+	invite    bool // dialog created by INVITE
+	failed    bool // INVITE failed, wait for ACK
+	localTag  string
+	remoteTag string
+	localURI  string
+	remoteURI string
+	target    string // remote target in Contact
+	cseq      uint64 // local SIP CSeq
+
+	// SIP transaction key "CSeq METHOD" -> trans
+	recvTrans map[string]*sipTrans
+	sentTrans map[string]*sipTrans
+
+	// JSIP CSeq -> trans
+	recvJSIP map[uint64]*sipTrans
+	sentJSIP map[uint64]*sipTrans
+}
+
+// SIP connection on websocket, implement golib.Conn for JSIP Stack,
+// JSIP msg send to SIPConn will be translated to SIP msg,
+// SIP msg received will be translated to JSIP msg and sent to JSIP Stack
+type SIPConn struct {
+	id       string // unique id of connection, prefix of DialogueID
+	name     string
+	host     string
+	secure   bool
+	log      *golib.Log
+	logLevel int
+
+	conn golib.Conn
+	recv func(*JSIP)
+
+	lock    sync.Mutex
+	dialogs map[string]*sipDialog // JSIP DialogueID -> dialog
+	callids map[string]*sipDialog // SIP Call-ID -> dialog
+}
+
+// Create a SIP connection, name is used for log ctx,
+// secure indicates SIP over secure websocket
+func NewSIPConn(name string, secure bool, log *golib.Log,
+	logLevel int) *SIPConn {
+
+	host := "gortc.invalid"
+	if jstack != nil {
+		host = Realm()
+	}
+
+	u4, _ := uuid.NewV4()
+
+	return &SIPConn{
+		id:       u4.String(),
+		name:     name,
+		host:     host,
+		secure:   secure,
+		log:      log,
+		logLevel: logLevel,
+		recv: func(m *JSIP) {
+			jstack.recv(m)
+		},
+		dialogs: make(map[string]*sipDialog),
+		callids: make(map[string]*sipDialog),
+	}
+}
+
+// Set websocket connection for sending SIP msg
+func (c *SIPConn) SetConn(conn golib.Conn) {
+	c.conn = conn
+}
+
+func sipRand() string {
+	return strconv.FormatUint(uint64(rand.Uint32()), 16)
+}
+
+func sipTransKey(seq uint64, method string) string {
+	return strconv.FormatUint(seq, 10) + " " + method
+}
+
+func (c *SIPConn) newDialog(dlg string, callID string) *sipDialog {
+	d := &sipDialog{
+		dlg:       dlg,
+		callID:    callID,
+		localTag:  sipRand(),
+		cseq:      uint64(rand.Uint32() & 0xffff),
+		recvTrans: make(map[string]*sipTrans),
+		sentTrans: make(map[string]*sipTrans),
+		recvJSIP:  make(map[uint64]*sipTrans),
+		sentJSIP:  make(map[uint64]*sipTrans),
+	}
+
+	c.dialogs[dlg] = d
+	c.callids[callID] = d
+
+	return d
+}
+
+func (c *SIPConn) delDialog(d *sipDialog) {
+	delete(c.dialogs, d.dlg)
+	delete(c.callids, d.callID)
+}
+
+// dialog finished after final response for transaction
+func (c *SIPConn) checkDialog(d *sipDialog, t *sipTrans) {
+	if t.method == "BYE" {
+		c.delDialog(d)
+		return
+	}
+
+	if t.method == "INVITE" && t.code >= 300 {
+		d.failed = true
+		return
+	}
+
+	if d.invite {
+		return
+	}
+
+	for _, t := range d.recvTrans {
+		if t.code == 0 {
+			return
+		}
+	}
+
+	for _, t := range d.sentTrans {
+		if t.code == 0 {
+			return
+		}
+	}
+
+	c.delDialog(d)
+}
+
+func (c *SIPConn) via() string {
+	transport := "WS"
+	if c.secure {
+		transport = "WSS"
+	}
+
+	return "SIP/2.0/" + transport + " " + c.host + ";branch=z9hG4bK" +
+		sipRand()
+}
+
+func (c *SIPConn) contact() string {
+	return "<sip:" + c.host + ";transport=ws>"
+}
+
+// Receive SIP msg from websocket
+func (c *SIPConn) RecvMsg(conn golib.Conn, data []byte) {
+	// keepalive
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return
+	}
+
+	sm, err := ParseSIPMsg(data)
+	if err != nil {
+		c.log.LogError(c, "Parse SIP msg error: %s", err.Error())
+		return
+	}
+
+	var m *JSIP
+
+	c.lock.Lock()
+	if sm.Method != "" {
+		m = c.recvRequest(sm)
+	} else {
+		m = c.recvResponse(sm)
+	}
+	c.lock.Unlock()
+
+	if m != nil {
+		c.recv(m)
+	}
+}
+
+func (c *SIPConn) sendSIPResponse(req *SIPMsg, code int, tag string) {
+	resp := NewSIPResponse(code, JSIPRespDesc(code))
+
+	for _, v := range req.HeaderValues("Via") {
+		resp.AddHeader("Via", v)
+	}
+	resp.AddHeader("From", req.Header("From"))
+
+	to := req.Header("To")
+	if a, err := ParseSIPAddr(to); err == nil && tag != "" && code > 100 &&
+		a.Params["tag"] == "" {
+
+		a.Params["tag"] = tag
+		to = a.String()
+	}
+	resp.AddHeader("To", to)
+	resp.AddHeader("Call-ID", req.Header("Call-ID"))
+	resp.AddHeader("CSeq", req.Header("CSeq"))
+
+	c.send(resp)
+}
+
+func (c *SIPConn) send(sm *SIPMsg) {
+	if c.conn == nil {
+		c.log.LogError(c, "send SIP msg but websocket not set")
+		return
+	}
+
+	c.conn.Send(sm.Bytes())
+}
+
+func (c *SIPConn) recvRequest(sm *SIPMsg) *JSIP {
+	typ := NewJSIPType(sm.Method)
+	if typ == JSIPType(Unknown) || typ == TERM {
+		c.sendSIPResponse(sm, 501, "")
+		return nil
+	}
+
+	from, err := ParseSIPAddr(sm.Header("From"))
+	if err != nil {
+		c.sendSIPResponse(sm, 400, "")
+		return nil
+	}
+
+	to, err := ParseSIPAddr(sm.Header("To"))
+	if err != nil {
+		c.sendSIPResponse(sm, 400, "")
+		return nil
+	}
+
+	seq, _, _ := sm.CSeq()
+	callID := sm.Header("Call-ID")
+
+	d := c.callids[callID]
+	if d == nil {
+		switch typ {
+		case ACK:
+			return nil
+		case BYE, CANCEL, UPDATE, PRACK, INFO:
+			c.sendSIPResponse(sm, 481, "")
+			return nil
+		}
+
+		// Call-ID is chosen by client, DialogueID is unique per connection
+		d = c.newDialog("sip_"+c.id+"_"+callID, callID)
+		d.invite = typ == INVITE
+		d.remoteTag = from.Params["tag"]
+		d.localURI = to.URI
+		d.remoteURI = from.URI
+		d.target = from.URI
+	}
+
+	if contact, err := ParseSIPAddr(sm.Header("Contact")); err == nil {
+		d.target = contact.URI
+	}
+
+	m := &JSIP{
+		Type:       typ,
+		RequestURI: sipToJSIPUri(sm.RequestURI),
+		From:       sipToJSIPUri(from.URI),
+		To:         sipToJSIPUri(to.URI),
+		CSeq:       seq,
+		DialogueID: d.dlg,
+
+		conn:   c,
+		recv:   true,
+		rawMsg: make(map[string]interface{}),
+	}
+
+	switch typ {
+	case ACK, CANCEL:
+		// ACK and CANCEL use CSeq of INVITE in SIP, but new CSeq in JSIP
+		m.CSeq = uint64(rand.Uint32())
+
+		inv := d.recvTrans[sipTransKey(seq, "INVITE")]
+		if inv == nil {
+			if typ == CANCEL {
+				c.sendSIPResponse(sm, 481, d.localTag)
+			}
+
+			return nil
+		}
+		m.SetUint("RelatedID", inv.jsipCSeq)
+
+		if typ == ACK {
+			if d.failed {
+				c.delDialog(d)
+			}
+
+			break
+		}
+
+		fallthrough
+	default:
+		t := &sipTrans{
+			jsipCSeq: m.CSeq,
+			sipCSeq:  seq,
+			method:   sm.Method,
+			req:      sm,
+		}
+		d.recvTrans[sipTransKey(seq, sm.Method)] = t
+		d.recvJSIP[m.CSeq] = t
+	}
+
+	sipToJSIPHeaders(sm, m)
+
+	return m
+}
+
+func (c *SIPConn) recvResponse(sm *SIPMsg) *JSIP {
+	seq, method, _ := sm.CSeq()
+
+	d := c.callids[sm.Header("Call-ID")]
+	if d == nil {
+		c.log.LogError(c, "Receive SIP response %d but dialog not exist",
+			sm.Code)
+		return nil
+	}
+
+	t := d.sentTrans[sipTransKey(seq, method)]
+	if t == nil {
+		c.log.LogError(c, "Receive SIP response %d but transaction not exist",
+			sm.Code)
+		return nil
+	}
+
+	if t.code != 0 {
+		// retransmission
+		return nil
+	}
+
+	from, err := ParseSIPAddr(sm.Header("From"))
+	if err != nil {
+		return nil
+	}
+
+	to, err := ParseSIPAddr(sm.Header("To"))
+	if err != nil {
+		return nil
+	}
+
+	if d.remoteTag == "" && to.Params["tag"] != "" {
+		d.remoteTag = to.Params["tag"]
+	}
+
+	if contact, err := ParseSIPAddr(sm.Header("Contact")); err == nil {
+		d.target = contact.URI
+	}
+
+	m := &JSIP{
+		Type:       NewJSIPType(method),
+		Code:       sm.Code,
+		From:       sipToJSIPUri(from.URI),
+		To:         sipToJSIPUri(to.URI),
+		CSeq:       t.jsipCSeq,
+		DialogueID: d.dlg,
+
+		conn:   c,
+		recv:   true,
+		rawMsg: make(map[string]interface{}),
+	}
+
+	sipToJSIPHeaders(sm, m)
+
+	if sm.Code >= 200 {
+		t.code = sm.Code
+		c.checkDialog(d, t)
+	}
+
+	return m
+}
+
+// Send JSIP msg to websocket as SIP msg, called by JSIP Stack
+func (c *SIPConn) Send(data []byte) {
+	m := &JSIP{}
+	if err := m.Unmarshal(data); err != nil {
+		c.log.LogError(c, "Unmarshal JSIP msg error: %s", err.Error())
+		return
+	}
+
+	var sm *SIPMsg
+
+	c.lock.Lock()
+	if m.Code == 0 {
+		sm = c.sendRequest(m)
+	} else {
+		sm = c.sendResponse(m)
+	}
+	c.lock.Unlock()
+
+	if sm != nil {
+		c.send(sm)
+	}
+}
+
+func (c *SIPConn) sendRequest(m *JSIP) *SIPMsg {
+	method := m.Type.String()
+
+	d := c.dialogs[m.DialogueID]
+	if d == nil {
+		switch m.Type {
+		case ACK, BYE, CANCEL, UPDATE, PRACK, INFO:
+			c.log.LogError(m, "Send %s but SIP dialog not exist", method)
+			return nil
+		}
+
+		d = c.newDialog(m.DialogueID, m.DialogueID)
+		d.invite = m.Type == INVITE
+		d.localURI = jsipToSIPUri(m.From)
+		d.remoteURI = jsipToSIPUri(m.To)
+		d.target = jsipToSIPUri(m.RequestURI)
+	}
+
+	branch := ""
+	var seq uint64
+
+	switch m.Type {
+	case ACK, CANCEL:
+		rel, _ := m.GetUint("RelatedID")
+		inv := d.sentJSIP[rel]
+		if inv == nil {
+			c.log.LogError(m, "Send %s but INVITE not exist", method)
+			return nil
+		}
+
+		// CANCEL and ACK for non 2xx response use the same branch as INVITE
+		seq = inv.sipCSeq
+		if m.Type == CANCEL || inv.code >= 300 {
+			branch = inv.branch
+		}
+	default:
+		d.cseq++
+		seq = d.cseq
+	}
+
+	via := c.via()
+	if branch != "" {
+		via = via[:strings.Index(via, ";branch=")] + ";branch=" + branch
+	}
+
+	sm := NewSIPRequest(method, d.target)
+	sm.AddHeader("Via", via)
+	sm.AddHeader("Max-Forwards", "70")
+
+	from := &SIPAddr{URI: d.localURI, Params: map[string]string{
+		"tag": d.localTag,
+	}}
+	sm.AddHeader("From", from.String())
+
+	to := &SIPAddr{URI: d.remoteURI, Params: map[string]string{}}
+	if d.remoteTag != "" {
+		to.Params["tag"] = d.remoteTag
+	}
+	sm.AddHeader("To", to.String())
+	sm.AddHeader("Call-ID", d.callID)
+	sm.AddHeader("CSeq", strconv.FormatUint(seq, 10)+" "+method)
+
+	switch m.Type {
+	case INVITE, UPDATE, SUBSCRIBE, NOTIFY, REGISTER:
+		sm.AddHeader("Contact", c.contact())
+	}
+
+	jsipToSIPHeaders(m, sm)
+
+	if m.Type == ACK {
+		if d.failed {
+			c.delDialog(d)
+		}
+
+		return sm
+	}
+
+	t := &sipTrans{
+		jsipCSeq: m.CSeq,
+		sipCSeq:  seq,
+		method:   method,
+		branch:   via[strings.Index(via, ";branch=")+len(";branch="):],
+	}
+	d.sentTrans[sipTransKey(seq, method)] = t
+	d.sentJSIP[m.CSeq] = t
+
+	return sm
+}
+
+func (c *SIPConn) sendResponse(m *JSIP) *SIPMsg {
+	d := c.dialogs[m.DialogueID]
+	if d == nil {
+		c.log.LogError(m, "Send response but SIP dialog not exist")
+		return nil
+	}
+
+	t := d.recvJSIP[m.CSeq]
+	if t == nil {
+		c.log.LogError(m, "Send response but SIP transaction not exist")
+		return nil
+	}
+
+	sm := NewSIPResponse(m.Code, JSIPRespDesc(m.Code))
+
+	req := t.req
+	for _, v := range req.HeaderValues("Via") {
+		sm.AddHeader("Via", v)
+	}
+	sm.AddHeader("From", req.Header("From"))
+
+	to := req.Header("To")
+	if a, err := ParseSIPAddr(to); err == nil && m.Code > 100 &&
+		a.Params["tag"] == "" {
+
+		a.Params["tag"] = d.localTag
+		to = a.String()
+	}
+	sm.AddHeader("To", to)
+	sm.AddHeader("Call-ID", req.Header("Call-ID"))
+	sm.AddHeader("CSeq", req.Header("CSeq"))
+
+	if m.Code > 100 && m.Code < 300 {
+		switch t.method {
+		case "INVITE", "UPDATE", "SUBSCRIBE":
+			sm.AddHeader("Contact", c.contact())
+		}
+	}
+
+	jsipToSIPHeaders(m, sm)
+
+	if m.Code >= 200 {
+		t.code = m.Code
+		c.checkDialog(d, t)
+	}
+
+	return sm
+}
+
+// headers for authentication, same in SIP and JSIP
+var sipAuthHeaders = []string{"Authorization", "WWW-Authenticate"}
+
+// SIP headers and body to JSIP
+func sipToJSIPHeaders(sm *SIPMsg, m *JSIP) {
+	if v := sm.Header("Session-Expires"); v != "" {
+		v = strings.TrimSpace(strings.SplitN(v, ";", 2)[0])
+		if expire, err := strconv.ParseUint(v, 10, 64); err == nil {
+			m.SetUint("Expire", expire)
+		}
+	} else if v := sm.Header("Expires"); v != "" {
+		if expire, err := strconv.ParseUint(v, 10, 64); err == nil {
+			m.SetUint("Expire", expire)
+		}
+	}
+
+	if pai, err := ParseSIPAddr(sm.Header("P-Asserted-Identity")); err == nil {
+		m.SetString("P-Asserted-Identity", sipToJSIPUri(pai.URI))
+	}
+
+	for _, h := range sipAuthHeaders {
+		if v := sm.Header(h); v != "" {
+			m.SetString(h, v)
+		}
+	}
+
+	if len(sm.Body) == 0 {
+		return
+	}
+
+	ct := sm.Header("Content-Type")
+	if ct != "" {
+		m.SetString("Content-Type", ct)
+	}
+
+	if strings.HasPrefix(strings.ToLower(ct), "application/json") {
+		if body := gjson.ParseBytes(sm.Body).Value(); body != nil {
+			m.Body = body
+			return
+		}
+	}
+
+	m.Body = string(sm.Body)
+}
+
+// JSIP headers and body to SIP
+func jsipToSIPHeaders(m *JSIP, sm *SIPMsg) {
+	if expire, ok := m.GetUint("Expire"); ok {
+		if m.inviteSession() {
+			sm.AddHeader("Session-Expires", strconv.FormatUint(expire, 10))
+		} else {
+			sm.AddHeader("Expires", strconv.FormatUint(expire, 10))
+		}
+	}
+
+	if pai, ok := m.GetString("P-Asserted-Identity"); ok {
+		sm.AddHeader("P-Asserted-Identity", "<"+jsipToSIPUri(pai)+">")
+	}
+
+	for _, h := range sipAuthHeaders {
+		if v, ok := m.GetString(h); ok {
+			sm.AddHeader(h, v)
+		}
+	}
+
+	if m.Body == nil {
+		return
+	}
+
+	ct, _ := m.GetString("Content-Type")
+
+	switch body := m.Body.(type) {
+	case string:
+		sm.Body = []byte(body)
+		if ct == "" {
+			if strings.HasPrefix(body, "v=0") {
+				ct = "application/sdp"
+			} else {
+				ct = "text/plain"
+			}
+		}
+	default:
+		data, err := json.Marshal(body)
+		if err != nil {
+			return
+		}
+
+		sm.Body = data
+		if ct == "" {
+			ct = "application/json"
+		}
+	}
+
+	sm.AddHeader("Content-Type", ct)
+}
+
+// Close SIP connection, all SIP dialogs will be cleared
+func (c *SIPConn) Close() {
+	c.lock.Lock()
+	c.dialogs = make(map[string]*sipDialog)
+	c.callids = make(map[string]*sipDialog)
+	c.lock.Unlock()
+
+	unbindConn(c)
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// for log ctx
+
+func (c *SIPConn) Prefix() string {
+	return "[sip]"
+}
+
+func (c *SIPConn) Suffix() string {
+	return c.name
+}
+
+func (c *SIPConn) LogLevel() int {
+	return c.logLevel
+}
@@ -0,0 +1,253 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// SIP over WebSocket gateway Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alexwoo/golib"
+)
+
+var siplog = golib.NewLog("sip.log")
+
+// websocket connection for test, save msg sent
+type sipTestConn struct {
+	msgs []*SIPMsg
+}
+
+func (c *sipTestConn) Send(data []byte) {
+	m, err := ParseSIPMsg(data)
+	assert(err == nil)
+	c.msgs = append(c.msgs, m)
+}
+
+func (c *sipTestConn) Close() {
+}
+
+func (c *sipTestConn) Prefix() string {
+	return "[siptest]"
+}
+
+func (c *sipTestConn) Suffix() string {
+	return ""
+}
+
+func (c *sipTestConn) LogLevel() int {
+	return golib.LOGDEBUG
+}
+
+func (c *sipTestConn) last() *SIPMsg {
+	return c.msgs[len(c.msgs)-1]
+}
+
+func newSIPTestConn() (*SIPConn, *sipTestConn, *[]*JSIP) {
+	msgs := []*JSIP{}
+
+	ws := &sipTestConn{}
+	c := NewSIPConn("test", true, siplog, golib.LOGDEBUG)
+	c.SetConn(ws)
+	c.recv = func(m *JSIP) {
+		msgs = append(msgs, m)
+	}
+
+	return c, ws, &msgs
+}
+
+func sipSendJSIP(c *SIPConn, m *JSIP) {
+	if m.rawMsg == nil {
+		m.rawMsg = make(map[string]interface{})
+	}
+
+	data, err := m.Marshal()
+	assert(err == nil)
+	c.Send(data)
+}
+
+func TestSIPGatewayIncoming(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSIPGatewayIncoming")
+
+	c, ws, msgs := newSIPTestConn()
+
+	invite := "INVITE sip:bob@gortc.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@gortc.com>;tag=a1\r\n" +
+		"To: <sip:bob@gortc.com>\r\n" +
+		"Call-ID: call1\r\n" +
+		"CSeq: 10 INVITE\r\n" +
+		"Contact: <sip:alice@df7jal23ls0d.invalid;transport=ws>\r\n" +
+		"Session-Expires: 90;refresher=uac\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"\r\n" +
+		"v=0\r\n"
+	c.RecvMsg(ws, []byte(invite))
+
+	assert(len(*msgs) == 1)
+	m := (*msgs)[0]
+	assert(m.Type == INVITE && m.RequestURI == "bob@gortc.com")
+	assert(m.From == "alice@gortc.com" && m.To == "bob@gortc.com")
+	assert(m.CSeq == 10 && m.recv)
+	assert(m.DialogueID == "sip_"+c.id+"_call1")
+	assert(m.Body.(string) == "v=0\r\n")
+	expire, ok := m.GetUint("Expire")
+	assert(ok && expire == 90)
+
+	// 200 from JSIP
+	resp := JSIPMsgRes(m, 200)
+	resp.Body = "v=0\r\n"
+	sipSendJSIP(c, resp)
+
+	assert(len(ws.msgs) == 1)
+	sm := ws.last()
+	assert(sm.Code == 200 && sm.Header("Call-ID") == "call1")
+	assert(sm.Header("CSeq") == "10 INVITE")
+	assert(sm.Header("Via") ==
+		"SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK776asdhds")
+	assert(sm.Header("Contact") != "")
+	assert(sm.Header("Content-Type") == "application/sdp")
+	to, _ := ParseSIPAddr(sm.Header("To"))
+	tag := to.Params["tag"]
+	assert(tag != "")
+
+	// ACK
+	ack := "ACK sip:bob@gortc.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK2\r\n" +
+		"From: <sip:alice@gortc.com>;tag=a1\r\n" +
+		"To: <sip:bob@gortc.com>;tag=" + tag + "\r\n" +
+		"Call-ID: call1\r\n" +
+		"CSeq: 10 ACK\r\n\r\n"
+	c.RecvMsg(ws, []byte(ack))
+
+	assert(len(*msgs) == 2)
+	m = (*msgs)[1]
+	relid, ok := m.GetUint("RelatedID")
+	assert(m.Type == ACK && m.CSeq != 10 && ok && relid == 10)
+
+	// BYE from JSIP, sent to remote target
+	bye := JSIPMsgReq(BYE, "alice@gortc.com", "bob@gortc.com",
+		"alice@gortc.com", m.DialogueID)
+	sipSendJSIP(c, bye)
+
+	assert(len(ws.msgs) == 2)
+	sm = ws.last()
+	assert(sm.Method == "BYE")
+	assert(sm.RequestURI == "sip:alice@df7jal23ls0d.invalid;transport=ws")
+	from, _ := ParseSIPAddr(sm.Header("From"))
+	to, _ = ParseSIPAddr(sm.Header("To"))
+	assert(from.Params["tag"] == tag && to.Params["tag"] == "a1")
+	assert(sm.Header("Call-ID") == "call1")
+	seq, _, _ := sm.CSeq()
+
+	c.RecvMsg(ws, []byte(fmt.Sprintf("SIP/2.0 200 OK\r\n"+
+		"Call-ID: call1\r\nCSeq: %d BYE\r\n"+
+		"From: %s\r\nTo: %s\r\n\r\n", seq, sm.Header("From"),
+		sm.Header("To"))))
+
+	assert(len(*msgs) == 3)
+	m = (*msgs)[2]
+	assert(m.Type == BYE && m.Code == 200 && m.CSeq == bye.CSeq)
+	assert(len(c.dialogs) == 0 && len(c.callids) == 0)
+
+	// Unknown method and request out of dialog
+	c.RecvMsg(ws, []byte("PUBLISH sip:bob@gortc.com SIP/2.0\r\n"+
+		"From: <sip:alice@gortc.com>;tag=a1\r\nTo: <sip:bob@gortc.com>\r\n"+
+		"Call-ID: call2\r\nCSeq: 1 PUBLISH\r\n\r\n"))
+	assert(ws.last().Code == 501)
+
+	c.RecvMsg(ws, []byte("BYE sip:bob@gortc.com SIP/2.0\r\n"+
+		"From: <sip:alice@gortc.com>;tag=a1\r\nTo: <sip:bob@gortc.com>\r\n"+
+		"Call-ID: call3\r\nCSeq: 1 BYE\r\n\r\n"))
+	assert(ws.last().Code == 481)
+	assert(len(*msgs) == 3)
+}
+
+func TestSIPGatewayOutgoing(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSIPGatewayOutgoing")
+
+	c, ws, msgs := newSIPTestConn()
+
+	invite := JSIPMsgReq(INVITE, "bob@gortc.com", "alice@gortc.com",
+		"bob@gortc.com", "dlg1")
+	invite.Body = "v=0\r\n"
+	sipSendJSIP(c, invite)
+
+	assert(len(ws.msgs) == 1)
+	sm := ws.last()
+	assert(sm.Method == "INVITE" && sm.RequestURI == "sip:bob@gortc.com")
+	assert(sm.Header("Call-ID") == "dlg1" && sm.Header("Contact") != "")
+	assert(sm.Header("Content-Type") == "application/sdp")
+	seq, _, _ := sm.CSeq()
+	branch := sm.Header("Via")
+
+	// CANCEL use the same branch and CSeq number as INVITE
+	sipSendJSIP(c, JSIPMsgCancel(invite))
+	assert(len(ws.msgs) == 2)
+	cancel := ws.last()
+	assert(cancel.Method == "CANCEL" && cancel.Header("Via") == branch)
+	assert(cancel.Header("CSeq") == fmt.Sprintf("%d CANCEL", seq))
+
+	c.RecvMsg(ws, []byte(fmt.Sprintf("SIP/2.0 200 OK\r\n"+
+		"Call-ID: dlg1\r\nCSeq: %d CANCEL\r\n"+
+		"From: %s\r\nTo: %s;tag=b1\r\n\r\n", seq, sm.Header("From"),
+		sm.Header("To"))))
+	assert(len(*msgs) == 1 && (*msgs)[0].Type == CANCEL)
+
+	c.RecvMsg(ws, []byte(fmt.Sprintf("SIP/2.0 487 Request Terminated\r\n"+
+		"Call-ID: dlg1\r\nCSeq: %d INVITE\r\n"+
+		"From: %s\r\nTo: %s;tag=b1\r\n\r\n", seq, sm.Header("From"),
+		sm.Header("To"))))
+	assert(len(*msgs) == 2)
+	m := (*msgs)[1]
+	assert(m.Type == INVITE && m.Code == 487 && m.CSeq == invite.CSeq)
+	assert(m.DialogueID == "dlg1")
+
+	// ACK for non 2xx response
+	sipSendJSIP(c, JSIPMsgAck(m))
+	assert(len(ws.msgs) == 3)
+	ack := ws.last()
+	assert(ack.Method == "ACK" && ack.Header("Via") == branch)
+	assert(ack.Header("CSeq") == fmt.Sprintf("%d ACK", seq))
+	to, _ := ParseSIPAddr(ack.Header("To"))
+	assert(to.Params["tag"] == "b1")
+	assert(len(c.dialogs) == 0 && len(c.callids) == 0)
+
+	// MESSAGE with json body
+	msg := JSIPMsgReq(MESSAGE, "bob@gortc.com", "alice@gortc.com",
+		"bob@gortc.com", "dlg2")
+	msg.Body = map[string]interface{}{"text": "hello"}
+	sipSendJSIP(c, msg)
+
+	sm = ws.last()
+	assert(sm.Method == "MESSAGE" && string(sm.Body) == `{"text":"hello"}`)
+	assert(sm.Header("Content-Type") == "application/json")
+
+	c.RecvMsg(ws, []byte(fmt.Sprintf("SIP/2.0 200 OK\r\n"+
+		"Call-ID: dlg2\r\nCSeq: %s\r\n"+
+		"From: %s\r\nTo: %s;tag=b2\r\n\r\n", sm.Header("CSeq"),
+		sm.Header("From"), sm.Header("To"))))
+	assert(len(*msgs) == 3 && (*msgs)[2].Code == 200)
+	assert(len(c.dialogs) == 0)
+}
+
+func TestSIPGatewayCallID(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSIPGatewayCallID")
+
+	invite := "INVITE sip:bob@gortc.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK776asdhds\r\n" +
+		"From: <sip:alice@gortc.com>;tag=a1\r\n" +
+		"To: <sip:bob@gortc.com>\r\n" +
+		"Call-ID: call1\r\n" +
+		"CSeq: 10 INVITE\r\n\r\n"
+
+	// same Call-ID from different connections are different dialogs
+	c1, ws1, msgs1 := newSIPTestConn()
+	c1.RecvMsg(ws1, []byte(invite))
+	c2, ws2, msgs2 := newSIPTestConn()
+	c2.RecvMsg(ws2, []byte(invite))
+
+	assert(len(*msgs1) == 1 && len(*msgs2) == 1)
+	assert((*msgs1)[0].DialogueID != (*msgs2)[0].DialogueID)
+}
@@ -0,0 +1,379 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// SIP Message (RFC 3261) codec
+
+package rtclib
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SIP header
+type SIPHeader struct {
+	Name  string
+	Value string
+}
+
+// SIP Message
+type SIPMsg struct {
+	// Request
+	Method     string
+	RequestURI string
+
+	// Response
+	Code   int
+	Reason string
+
+	Headers []*SIPHeader
+	Body    []byte
+}
+
+// compact form of SIP header name
+var sipCompactHeader = map[string]string{
+	"i": "Call-ID",
+	"m": "Contact",
+	"e": "Content-Encoding",
+	"l": "Content-Length",
+	"c": "Content-Type",
+	"f": "From",
+	"s": "Subject",
+	"k": "Supported",
+	"t": "To",
+	"v": "Via",
+	"o": "Event",
+}
+
+var sipCanonicalHeader = map[string]string{
+	"call-id":             "Call-ID",
+	"cseq":                "CSeq",
+	"www-authenticate":    "WWW-Authenticate",
+	"p-asserted-identity": "P-Asserted-Identity",
+}
+
+// canonical SIP header name, as Content-Type
+func sipHeaderName(name string) string {
+	name = strings.TrimSpace(name)
+
+	if n, ok := sipCompactHeader[strings.ToLower(name)]; ok {
+		return n
+	}
+
+	if n, ok := sipCanonicalHeader[strings.ToLower(name)]; ok {
+		return n
+	}
+
+	parts := strings.Split(strings.ToLower(name), "-")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+
+	return strings.Join(parts, "-")
+}
+
+// Create a SIP Request
+func NewSIPRequest(method string, uri string) *SIPMsg {
+	return &SIPMsg{
+		Method:     method,
+		RequestURI: uri,
+	}
+}
+
+// Create a SIP Response
+func NewSIPResponse(code int, reason string) *SIPMsg {
+	return &SIPMsg{
+		Code:   code,
+		Reason: reason,
+	}
+}
+
+// Parse SIP Message from []byte
+func ParseSIPMsg(raw []byte) (*SIPMsg, error) {
+	var head, body []byte
+
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		head = raw[:i]
+		body = raw[i+4:]
+	} else if i := bytes.Index(raw, []byte("\n\n")); i >= 0 {
+		head = raw[:i]
+		body = raw[i+2:]
+	} else {
+		head = raw
+	}
+
+	lines := strings.Split(strings.Replace(string(head), "\r\n", "\n", -1),
+		"\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return nil, errors.New("No start line")
+	}
+
+	m := &SIPMsg{}
+
+	start := strings.SplitN(lines[0], " ", 3)
+	if len(start) != 3 {
+		return nil, errors.New("Start line error")
+	}
+
+	if start[0] == "SIP/2.0" {
+		code, err := strconv.Atoi(start[1])
+		if err != nil || code < 100 || code > 699 {
+			return nil, errors.New("Status code error")
+		}
+
+		m.Code = code
+		m.Reason = start[2]
+	} else {
+		if start[2] != "SIP/2.0" {
+			return nil, errors.New("SIP version error")
+		}
+
+		m.Method = start[0]
+		m.RequestURI = start[1]
+	}
+
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+
+		// header folding
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(m.Headers) == 0 {
+				return nil, errors.New("Header folding error")
+			}
+
+			h := m.Headers[len(m.Headers)-1]
+			h.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Header error: " + line)
+		}
+
+		m.Headers = append(m.Headers, &SIPHeader{
+			Name:  sipHeaderName(kv[0]),
+			Value: strings.TrimSpace(kv[1]),
+		})
+	}
+
+	if l := m.Header("Content-Length"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(body) {
+			return nil, errors.New("Content-Length error")
+		}
+
+		body = body[:n]
+	}
+
+	if len(body) > 0 {
+		m.Body = body
+	}
+
+	if m.Header("Call-ID") == "" {
+		return nil, errors.New("No Call-ID")
+	}
+
+	if _, _, err := m.CSeq(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Get first value of SIP header
+func (m *SIPMsg) Header(name string) string {
+	name = sipHeaderName(name)
+
+	for _, h := range m.Headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+
+	return ""
+}
+
+// Get all values of SIP header
+func (m *SIPMsg) HeaderValues(name string) []string {
+	name = sipHeaderName(name)
+
+	values := []string{}
+	for _, h := range m.Headers {
+		if h.Name == name {
+			values = append(values, h.Value)
+		}
+	}
+
+	return values
+}
+
+// Add a SIP header
+func (m *SIPMsg) AddHeader(name string, value string) {
+	m.Headers = append(m.Headers, &SIPHeader{
+		Name:  sipHeaderName(name),
+		Value: value,
+	})
+}
+
+// Set a SIP header, replace all values
+func (m *SIPMsg) SetHeader(name string, value string) {
+	m.DelHeader(name)
+	m.AddHeader(name, value)
+}
+
+// Delete a SIP header
+func (m *SIPMsg) DelHeader(name string) {
+	name = sipHeaderName(name)
+
+	headers := m.Headers[:0]
+	for _, h := range m.Headers {
+		if h.Name != name {
+			headers = append(headers, h)
+		}
+	}
+	m.Headers = headers
+}
+
+// Get CSeq number and method
+func (m *SIPMsg) CSeq() (uint64, string, error) {
+	split := strings.Fields(m.Header("CSeq"))
+	if len(split) != 2 {
+		return 0, "", errors.New("CSeq error")
+	}
+
+	seq, err := strconv.ParseUint(split[0], 10, 32)
+	if err != nil {
+		return 0, "", errors.New("CSeq error")
+	}
+
+	return seq, split[1], nil
+}
+
+// Marshal SIP Message to []byte, Content-Length is set by body
+func (m *SIPMsg) Bytes() []byte {
+	buf := &bytes.Buffer{}
+
+	if m.Method != "" {
+		buf.WriteString(m.Method + " " + m.RequestURI + " SIP/2.0\r\n")
+	} else {
+		buf.WriteString("SIP/2.0 " + strconv.Itoa(m.Code) + " " + m.Reason +
+			"\r\n")
+	}
+
+	for _, h := range m.Headers {
+		if h.Name == "Content-Length" {
+			continue
+		}
+
+		buf.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+
+	buf.WriteString("Content-Length: " + strconv.Itoa(len(m.Body)) + "\r\n")
+	buf.WriteString("\r\n")
+	buf.Write(m.Body)
+
+	return buf.Bytes()
+}
+
+// SIP name-addr or addr-spec, as "Alice" <sip:alice@a.com>;tag=123
+type SIPAddr struct {
+	Display string
+	URI     string
+	Params  map[string]string
+}
+
+// Parse SIP name-addr or addr-spec
+func ParseSIPAddr(raw string) (*SIPAddr, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, errors.New("Null addr")
+	}
+
+	a := &SIPAddr{
+		Params: map[string]string{},
+	}
+
+	paras := ""
+	if l := strings.Index(raw, "<"); l >= 0 {
+		r := strings.Index(raw, ">")
+		if r < l {
+			return nil, errors.New("Addr error")
+		}
+
+		a.Display = strings.Trim(strings.TrimSpace(raw[:l]), "\"")
+		a.URI = raw[l+1 : r]
+		paras = raw[r+1:]
+	} else {
+		// addr-spec, params after uri are header params
+		split := strings.SplitN(raw, ";", 2)
+		a.URI = split[0]
+		if len(split) == 2 {
+			paras = ";" + split[1]
+		}
+	}
+
+	for _, p := range strings.Split(paras, ";") {
+		if para, err := NewJSIPUriPara(p); err == nil {
+			a.Params[para.Key] = para.Value
+		}
+	}
+
+	return a, nil
+}
+
+// return SIP addr as string
+func (a *SIPAddr) String() string {
+	output := "<" + a.URI + ">"
+	if a.Display != "" {
+		output = "\"" + a.Display + "\" " + output
+	}
+
+	keys := make([]string, 0, len(a.Params))
+	for k := range a.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		output += ";" + (&JSIPUriPara{Key: k, Value: a.Params[k]}).String()
+	}
+
+	return output
+}
+
+// SIP uri to JSIP uri, sip:alice@a.com:5060;transport=ws -> alice@a.com:5060
+func sipToJSIPUri(uri string) string {
+	uri = strings.TrimSpace(uri)
+
+	if i := strings.Index(uri, ":"); i >= 0 {
+		scheme := strings.ToLower(uri[:i])
+		if scheme == "sip" || scheme == "sips" {
+			uri = uri[i+1:]
+		}
+	}
+
+	if i := strings.IndexAny(uri, ";?"); i >= 0 {
+		uri = uri[:i]
+	}
+
+	return uri
+}
+
+// JSIP uri to SIP uri, alice@a.com -> sip:alice@a.com
+func jsipToSIPUri(uri string) string {
+	uri = strings.TrimSpace(uri)
+
+	if strings.HasPrefix(uri, "sip:") || strings.HasPrefix(uri, "sips:") {
+		return uri
+	}
+
+	return "sip:" + uri
+}
@@ -0,0 +1,80 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// SIP Message Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSIPMsg(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSIPMsg")
+
+	raw := "INVITE sip:bob@b.com SIP/2.0\r\n" +
+		"Via: SIP/2.0/WSS df7jal23ls0d.invalid;branch=z9hG4bK776asdhds\r\n" +
+		"v: SIP/2.0/WSS proxy.b.com;branch=z9hG4bK1\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"f: \"Alice\" <sip:alice@a.com>;tag=1928301774\r\n" +
+		"To: <sip:bob@b.com>\r\n" +
+		"call-id: a84b4c76e66710\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Subject: hello\r\n" +
+		" world\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"v=0\r\nxxx"
+
+	m, err := ParseSIPMsg([]byte(raw))
+	assert(err == nil)
+	assert(m.Method == "INVITE" && m.RequestURI == "sip:bob@b.com")
+	assert(len(m.HeaderValues("Via")) == 2)
+	assert(m.Header("Call-ID") == "a84b4c76e66710")
+	assert(m.Header("Subject") == "hello world")
+	assert(string(m.Body) == "v=0\r\n")
+
+	seq, method, err := m.CSeq()
+	assert(err == nil && seq == 314159 && method == "INVITE")
+
+	from, err := ParseSIPAddr(m.Header("From"))
+	assert(err == nil && from.Display == "Alice" &&
+		from.URI == "sip:alice@a.com" && from.Params["tag"] == "1928301774")
+	assert(from.String() == "\"Alice\" <sip:alice@a.com>;tag=1928301774")
+
+	m.SetHeader("Via", "SIP/2.0/WSS gortc.com;branch=z9hG4bK2")
+	m.DelHeader("Subject")
+	m2, err := ParseSIPMsg(m.Bytes())
+	assert(err == nil && len(m2.HeaderValues("Via")) == 1)
+	assert(m2.Header("Subject") == "" && string(m2.Body) == "v=0\r\n")
+
+	resp := "SIP/2.0 180 Ringing\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 314159 INVITE\r\n\r\n"
+	m, err = ParseSIPMsg([]byte(resp))
+	assert(err == nil && m.Code == 180 && m.Reason == "Ringing")
+
+	_, err = ParseSIPMsg([]byte("SIP/2.0 1000 Error\r\nCall-ID: 1\r\n" +
+		"CSeq: 1 INVITE\r\n\r\n"))
+	assert(err != nil)
+
+	_, err = ParseSIPMsg([]byte("INVITE sip:bob@b.com SIP/2.0\r\n" +
+		"CSeq: 1 INVITE\r\n\r\n"))
+	assert(err != nil)
+
+	_, err = ParseSIPMsg([]byte("INVITE sip:bob@b.com SIP/2.0\r\n" +
+		"Call-ID: 1\r\nCSeq: INVITE\r\n\r\n"))
+	assert(err != nil)
+
+	_, err = ParseSIPMsg([]byte("INVITE sip:bob@b.com SIP/2.0\r\n" +
+		"Call-ID: 1\r\nCSeq: 1 INVITE\r\nContent-Length: 10\r\n\r\nv=0"))
+	assert(err != nil)
+
+	assert(sipToJSIPUri("sip:alice@a.com:5060;transport=ws") ==
+		"alice@a.com:5060")
+	assert(sipToJSIPUri("sips:a.com?x=y") == "a.com")
+	assert(jsipToSIPUri("alice@a.com") == "sip:alice@a.com")
+	assert(jsipToSIPUri("sips:alice@a.com") == "sips:alice@a.com")
+}
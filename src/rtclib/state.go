@@ -0,0 +1,99 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Runtime state filter and pagination
+
+package rtclib
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/alexwoo/golib"
+)
+
+// Default entries returned in one page
+const DefStateLimit = 100
+
+// Filter for runtime state query
+type StateFilter struct {
+	Dlg    string // DialogueID contains Dlg
+	State  string // transaction or session state, case insensitive
+	SLP    string // task name
+	Offset int
+	Limit  int
+}
+
+// Parse filter from url query: dlg, state, slp, offset and limit
+func ParseStateFilter(query url.Values) (*StateFilter, error) {
+	f := &StateFilter{
+		Dlg:   query.Get("dlg"),
+		State: query.Get("state"),
+		SLP:   query.Get("slp"),
+		Limit: DefStateLimit,
+	}
+
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, errors.New("invalid offset " + v)
+		}
+		f.Offset = offset
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, errors.New("invalid limit " + v)
+		}
+		f.Limit = limit
+	}
+
+	return f, nil
+}
+
+func (f *StateFilter) matchDlg(dlg string) bool {
+	return f.Dlg == "" || strings.Contains(dlg, f.Dlg)
+}
+
+func (f *StateFilter) matchState(state string) bool {
+	return f.State == "" || strings.EqualFold(f.State, state)
+}
+
+// Return [start, end) of entries in page, total is number of entries matched
+func (f *StateFilter) Page(total int) (int, int) {
+	start := f.Offset
+	if start > total {
+		start = total
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefStateLimit
+	}
+
+	// start + limit may overflow
+	end := total
+	if limit < total-start {
+		end = start + limit
+	}
+
+	return start, end
+}
+
+// One page of runtime state entries
+type StatePage struct {
+	Total int         `json:"total"`
+	Items interface{} `json:"items"`
+}
+
+// description of connection for runtime state
+func connName(c golib.Conn) string {
+	if c == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(c.Prefix() + " " + c.Suffix())
+}
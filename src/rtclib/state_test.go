@@ -0,0 +1,112 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Runtime state Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+func TestStateFilter(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestStateFilter")
+
+	f, err := ParseStateFilter(url.Values{})
+	assert(err == nil && f.Offset == 0 && f.Limit == DefStateLimit)
+
+	q, _ := url.ParseQuery("dlg=abc&state=init&slp=chat&offset=2&limit=3")
+	f, err = ParseStateFilter(q)
+	assert(err == nil && f.Dlg == "abc" && f.State == "init" &&
+		f.SLP == "chat" && f.Offset == 2 && f.Limit == 3)
+
+	start, end := f.Page(10)
+	assert(start == 2 && end == 5)
+	start, end = f.Page(4)
+	assert(start == 2 && end == 4)
+	start, end = f.Page(1)
+	assert(start == 1 && end == 1)
+
+	// huge limit must not overflow
+	q, _ = url.ParseQuery("offset=2&limit=9223372036854775807")
+	f, err = ParseStateFilter(q)
+	assert(err == nil)
+	start, end = f.Page(10)
+	assert(start == 2 && end == 10)
+
+	for _, query := range []string{"offset=-1", "limit=0", "limit=a"} {
+		q, _ = url.ParseQuery(query)
+		_, err = ParseStateFilter(q)
+		assert(err != nil)
+	}
+}
+
+func TestStackState(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestStackState")
+
+	conn := &sipTestConn{}
+
+	s := &JSIPStack{
+		log:    golib.NewLog("stack.log"),
+		config: &jsipDConfig{Realm: "test.com"},
+		users:  map[string]golib.Conn{"alice": conn},
+		conns:  map[golib.Conn]string{conn: "alice"},
+	}
+	s.shards = []*jsipShard{newJSIPShard(s, 10), newJSIPShard(s, 10)}
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		dlg := fmt.Sprintf("dlg%d", i)
+		req := JSIPMsgReq(INVITE, "bob@test.com", "alice@test.com",
+			"bob@test.com", dlg)
+
+		sh := s.shard(dlg)
+		sh.conns[dlg] = conn
+		sh.sessions[dlg] = &jsipSession{
+			req:     req,
+			state:   INVITE_INIT,
+			created: now.Add(-10 * time.Second),
+			expire:  now.Add(20 * time.Second),
+		}
+
+		tid := transactionID(dlg, req.CSeq)
+		sh.transactions[tid] = &jsipTransaction{
+			req:     req,
+			state:   TRANS_INIT,
+			created: now,
+		}
+	}
+	s.shard("dlg1").sessions["dlg1"].state = INVITE_200
+
+	st := s.State(&StateFilter{Limit: 2, Offset: 1})
+	assert(st.Connections.Total == 5 && st.Sessions.Total == 5)
+	assert(st.Transactions.Total == 5 && st.Users.Total == 1)
+
+	sessions := st.Sessions.Items.([]*JSIPSessionInfo)
+	assert(len(sessions) == 2 && sessions[0].Dlg == "dlg1" &&
+		sessions[1].Dlg == "dlg2")
+	assert(sessions[0].State == "INVITE_200" && sessions[0].Age >= 10)
+	assert(sessions[0].Expire > 0 && sessions[0].Expire <= 20)
+
+	trans := st.Transactions.Items.([]*JSIPTransInfo)
+	assert(len(trans) == 2 && trans[0].Dlg == "dlg1" &&
+		trans[0].Type == "INVITE" && trans[0].State == "Init")
+
+	// filter
+	st = s.State(&StateFilter{Dlg: "dlg3", Limit: 10})
+	assert(st.Connections.Total == 1 && st.Sessions.Total == 1 &&
+		st.Transactions.Total == 1)
+
+	st = s.State(&StateFilter{State: "invite_init", Limit: 10})
+	assert(st.Sessions.Total == 4 && st.Transactions.Total == 0)
+
+	// offset out of range
+	st = s.State(&StateFilter{Offset: 10, Limit: 10})
+	assert(st.Sessions.Total == 5 &&
+		len(st.Sessions.Items.([]*JSIPSessionInfo)) == 0)
+}
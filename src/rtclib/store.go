@@ -0,0 +1,471 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// State store for SLPs, key/value with TTL and compare-and-set, states
+// saved in file store survive gortc restart
+
+package rtclib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type StateStore interface {
+	// Get value of key, false if key not exist or expired
+	Get(key string) ([]byte, bool)
+
+	// Set value of key, key expires after ttl, 0 for never expire
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Delete key, deleting key not exist is harmless
+	Delete(key string) error
+
+	// Set value of key if current value is old, nil old means key not
+	// exist, return false if current value is not old
+	CompareAndSet(key string, old []byte, value []byte,
+		ttl time.Duration) (bool, error)
+
+	// Keys with prefix, sorted
+	Keys(prefix string) []string
+
+	Close() error
+}
+
+// SLP save states into store, called before SLP upgraded and gortc stop
+type SLPSnapshotter interface {
+	Snapshot(store StateStore) error
+}
+
+// SLP rebuild states from store, called before OnLoad
+type SLPRestorer interface {
+	Restore(store StateStore) error
+}
+
+var (
+	storeLock  sync.Mutex
+	stateStore StateStore
+)
+
+// Set state store for SLPs, set by gortc
+func SetStateStore(s StateStore) {
+	storeLock.Lock()
+	stateStore = s
+	storeLock.Unlock()
+}
+
+// State store of SLP name, keys are isolated by SLP name, shared by all
+// versions and instances of SLP. In memory store used if gortc not set
+func SLPStore(name string) StateStore {
+	storeLock.Lock()
+	if stateStore == nil {
+		stateStore = NewMemoryStore()
+	}
+	s := stateStore
+	storeLock.Unlock()
+
+	return &prefixStore{store: s, prefix: "slp/" + name + "/"}
+}
+
+// State store of SLP of task
+func (t *Task) Store() StateStore {
+	return SLPStore(t.Name)
+}
+
+type storeItem struct {
+	value  []byte
+	expire time.Time // zero for never expire
+}
+
+func (i *storeItem) expired(now time.Time) bool {
+	return !i.expire.IsZero() && !now.Before(i.expire)
+}
+
+func expireTime(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
+
+// In memory state store, for test or states need not survive restart
+type memoryStore struct {
+	lock  sync.Mutex
+	items map[string]*storeItem
+
+	// called with lock after key changed, item nil for delete
+	onChange func(key string, item *storeItem) error
+}
+
+func NewMemoryStore() StateStore {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		items: make(map[string]*storeItem),
+	}
+}
+
+// must be called with lock
+func (s *memoryStore) get(key string) *storeItem {
+	item := s.items[key]
+	if item == nil {
+		return nil
+	}
+
+	if item.expired(time.Now()) {
+		delete(s.items, key)
+		return nil
+	}
+
+	return item
+}
+
+// must be called with lock
+func (s *memoryStore) set(key string, item *storeItem) error {
+	old := s.items[key]
+
+	if item == nil {
+		delete(s.items, key)
+	} else {
+		s.items[key] = item
+	}
+
+	if s.onChange == nil {
+		return nil
+	}
+
+	// change not saved, rollback
+	if err := s.onChange(key, item); err != nil {
+		if old == nil {
+			delete(s.items, key)
+		} else {
+			s.items[key] = old
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item := s.get(key)
+	if item == nil {
+		return nil, false
+	}
+
+	return append([]byte{}, item.value...), true
+}
+
+func (s *memoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.set(key, &storeItem{
+		value:  append([]byte{}, value...),
+		expire: expireTime(ttl),
+	})
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.get(key) == nil {
+		return nil
+	}
+
+	return s.set(key, nil)
+}
+
+func (s *memoryStore) CompareAndSet(key string, old []byte, value []byte,
+	ttl time.Duration) (bool, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	item := s.get(key)
+	if old == nil && item != nil {
+		return false, nil
+	}
+
+	if old != nil && (item == nil || !bytes.Equal(item.value, old)) {
+		return false, nil
+	}
+
+	err := s.set(key, &storeItem{
+		value:  append([]byte{}, value...),
+		expire: expireTime(ttl),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *memoryStore) Keys(prefix string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	keys := []string{}
+	for k, item := range s.items {
+		if item.expired(now) {
+			delete(s.items, k)
+			continue
+		}
+
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// one change of key in store file
+type storeRecord struct {
+	Key    string `json:"k"`
+	Value  []byte `json:"v,omitempty"`
+	Expire int64  `json:"e,omitempty"` // unix nano, 0 for never expire
+	Delete bool   `json:"d,omitempty"`
+}
+
+// File state store, changes appended to file, and file is compacted when
+// too many stale records
+type fileStore struct {
+	*memoryStore
+
+	path    string
+	file    *os.File
+	records int // records in file
+}
+
+// Open file state store, states saved in file are loaded
+func NewFileStore(path string) (StateStore, error) {
+	s := &fileStore{
+		memoryStore: newMemoryStore(),
+		path:        path,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	// drop stale records loaded
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	s.onChange = s.append
+
+	return s, nil
+}
+
+func (s *fileStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		r := &storeRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			// last record may be truncated when gortc crashed
+			continue
+		}
+
+		if r.Delete {
+			delete(s.items, r.Key)
+			continue
+		}
+
+		item := &storeItem{value: r.Value}
+		if r.Expire != 0 {
+			item.expire = time.Unix(0, r.Expire)
+		}
+
+		if item.expired(now) {
+			delete(s.items, r.Key)
+		} else {
+			s.items[r.Key] = item
+		}
+	}
+
+	return scanner.Err()
+}
+
+func record(key string, item *storeItem) *storeRecord {
+	r := &storeRecord{Key: key}
+	if item == nil {
+		r.Delete = true
+		return r
+	}
+
+	r.Value = item.value
+	if !item.expire.IsZero() {
+		r.Expire = item.expire.UnixNano()
+	}
+
+	return r
+}
+
+// append change to file, called with lock
+func (s *fileStore) append(key string, item *storeItem) error {
+	line, err := json.Marshal(record(key, item))
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.records++
+
+	// change saved, compact failed is retried at next change
+	if s.records > 2*len(s.items)+1024 {
+		s.compact()
+	}
+
+	return nil
+}
+
+// rewrite file with live items, called with lock
+func (s *fileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	w := bufio.NewWriter(f)
+	records := 0
+	for k, item := range s.items {
+		if item.expired(now) {
+			delete(s.items, k)
+			continue
+		}
+
+		line, err := json.Marshal(record(k, item))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+		records++
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.records = records
+
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return errors.New("store closed")
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	s.onChange = func(string, *storeItem) error {
+		return errors.New("store closed")
+	}
+
+	return err
+}
+
+// keys of SLP are prefixed with SLP name
+type prefixStore struct {
+	store  StateStore
+	prefix string
+}
+
+func (s *prefixStore) Get(key string) ([]byte, bool) {
+	return s.store.Get(s.prefix + key)
+}
+
+func (s *prefixStore) Set(key string, value []byte, ttl time.Duration) error {
+	return s.store.Set(s.prefix+key, value, ttl)
+}
+
+func (s *prefixStore) Delete(key string) error {
+	return s.store.Delete(s.prefix + key)
+}
+
+func (s *prefixStore) CompareAndSet(key string, old []byte, value []byte,
+	ttl time.Duration) (bool, error) {
+
+	return s.store.CompareAndSet(s.prefix+key, old, value, ttl)
+}
+
+func (s *prefixStore) Keys(prefix string) []string {
+	keys := s.store.Keys(s.prefix + prefix)
+	for i, k := range keys {
+		keys[i] = k[len(s.prefix):]
+	}
+
+	return keys
+}
+
+// store shared by SLP, not closed by SLP
+func (s *prefixStore) Close() error {
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// State store Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+func testStore(s StateStore) {
+	_, ok := s.Get("a")
+	assert(!ok)
+
+	assert(s.Set("a", []byte("1"), 0) == nil)
+	v, ok := s.Get("a")
+	assert(ok && string(v) == "1")
+
+	// compare and set
+	ok, err := s.CompareAndSet("a", []byte("2"), []byte("3"), 0)
+	assert(err == nil && !ok)
+	ok, err = s.CompareAndSet("a", []byte("1"), []byte("3"), 0)
+	assert(err == nil && ok)
+	ok, err = s.CompareAndSet("b", nil, []byte("b"), 0)
+	assert(err == nil && ok)
+	ok, err = s.CompareAndSet("b", nil, []byte("b"), 0)
+	assert(err == nil && !ok)
+
+	// ttl
+	assert(s.Set("c", []byte("c"), 20*time.Millisecond) == nil)
+	assert(s.Set("d/1", []byte("d1"), 0) == nil)
+	assert(s.Set("d/2", []byte("d2"), 0) == nil)
+
+	keys := s.Keys("")
+	assert(len(keys) == 5 && keys[0] == "a" && keys[2] == "c")
+
+	time.Sleep(30 * time.Millisecond)
+	_, ok = s.Get("c")
+	assert(!ok)
+
+	keys = s.Keys("d/")
+	assert(len(keys) == 2 && keys[0] == "d/1" && keys[1] == "d/2")
+
+	assert(s.Delete("d/1") == nil)
+	assert(s.Delete("none") == nil)
+	assert(len(s.Keys("d/")) == 1)
+}
+
+func TestMemoryStore(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestMemoryStore")
+
+	testStore(NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestFileStore")
+
+	dir, err := ioutil.TempDir("", "store")
+	assert(err == nil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data", "state.db")
+	s, err := NewFileStore(path)
+	assert(err == nil)
+
+	testStore(s)
+	assert(s.Set("e", []byte("e"), time.Hour) == nil)
+	assert(s.Close() == nil)
+	assert(s.Set("f", []byte("f"), 0) != nil)
+
+	// states survive reopen
+	s, err = NewFileStore(path)
+	assert(err == nil)
+
+	keys := s.Keys("")
+	assert(len(keys) == 4)
+	v, ok := s.Get("a")
+	assert(ok && string(v) == "3")
+	v, ok = s.Get("e")
+	assert(ok && string(v) == "e")
+	_, ok = s.Get("d/1")
+	assert(!ok)
+
+	// compact
+	for i := 0; i < 3000; i++ {
+		assert(s.Set("a", []byte(fmt.Sprint(i)), 0) == nil)
+	}
+	fs := s.(*fileStore)
+	assert(fs.records < 2000)
+	assert(s.Close() == nil)
+
+	s, err = NewFileStore(path)
+	assert(err == nil)
+	v, ok = s.Get("a")
+	assert(ok && string(v) == "2999")
+	assert(len(s.Keys("")) == 4)
+	s.Close()
+}
+
+type restoreTestSLP struct {
+	eventTestSLP
+	restored string
+}
+
+func (slp *restoreTestSLP) Restore(store StateStore) error {
+	v, _ := store.Get("k")
+	slp.restored = string(v)
+
+	return nil
+}
+
+func TestSLPStore(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestSLPStore")
+
+	s := NewMemoryStore()
+	SetStateStore(s)
+	defer SetStateStore(nil)
+
+	a := SLPStore("a")
+	assert(a.Set("k", []byte("a"), 0) == nil)
+	assert(SLPStore("b").Set("k", []byte("b"), 0) == nil)
+
+	keys := s.Keys("")
+	assert(len(keys) == 2 && keys[0] == "slp/a/k" && keys[1] == "slp/b/k")
+	keys = a.Keys("")
+	assert(len(keys) == 1 && keys[0] == "k")
+
+	// states restored before OnLoad
+	taskq := make(chan *Task, 1)
+	task := NewTask(taskq, nil, golib.NewLog("task.log"), golib.LOGDEBUG)
+	task.Name = "b"
+	slp := &restoreTestSLP{}
+	task.SLP = slp
+
+	restored := ""
+	task.Process = func(m *JSIP) { restored = slp.restored }
+	task.OnEvent(&TaskEvent{Type: TaskLoad})
+	task.Call(func() {})
+	assert(restored == "b")
+
+	task.SetFinished()
+	<-taskq
+}
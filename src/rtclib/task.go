@@ -6,7 +6,9 @@ package rtclib
 
 import (
 	"fmt"
+	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/alexwoo/golib"
 	uuid "github.com/satori/go.uuid"
@@ -23,13 +25,89 @@ type SLP interface {
 	NewSLPCtx() interface{}
 }
 
+// Optional interfaces of SLP, detected by type assertion on SLP instance
+// created when SLP loaded, except SLPEventHandler, which is detected on
+// SLP instance of task
+
+// SLP version unloaded, after deleted or replaced and drained
+type SLPUnloader interface {
+	OnUnload()
+}
+
+// gortc reload config
+type SLPReloader interface {
+	OnReload() error
+}
+
+// gortc stop gracefully, SLP should finish before deadline
+type SLPShutdowner interface {
+	OnShutdown(deadline time.Time)
+}
+
+// SLP receive TaskMessage and TaskShutdown events in task goroutine
+type SLPEventHandler interface {
+	OnEvent(ev *TaskEvent)
+}
+
+type TaskEventType int
+
+const (
+	TaskLoad       TaskEventType = iota + 1 // SLP loaded, for onload task
+	TaskMsg                                 // JSIP msg
+	TaskTimerFired                          // timer of task fired
+	TaskCall                                // function call by Task.Call
+	TaskMessage                             // message sent by Task.Send
+	TaskShutdown                            // gortc stop gracefully
+)
+
+var taskEventTypeStr = []string{
+	"Unknown",
+	"Load",
+	"Msg",
+	"TimerFired",
+	"Call",
+	"Message",
+	"Shutdown",
+}
+
+func (t TaskEventType) String() string {
+	if t < TaskEventType(Unknown) || t > TaskShutdown {
+		t = TaskEventType(Unknown)
+	}
+
+	return taskEventTypeStr[t]
+}
+
+// Event delivered to task, processed in task goroutine one by one
+type TaskEvent struct {
+	Type     TaskEventType
+	Msg      *JSIP       // JSIP msg for TaskMsg
+	From     *Task       // sender of TaskMessage, nil if not sent by task
+	Data     interface{} // data of TaskMessage
+	Deadline time.Time   // deadline of TaskShutdown
+
+	timer timerEvent
+	call  func()
+	done  chan bool
+}
+
 type Task struct {
-	Name  string
-	SLP   SLP
-	ctx   interface{}
-	msgs  chan *JSIP
-	taskq chan *Task
-	quit  chan bool
+	Name   string
+	SLP    SLP
+	Parent *Task // task invoked this task in process, nil if not invoked
+	ctx    interface{}
+	taskq  chan *Task
+	quit   chan bool
+	done   chan bool // closed when task finished
+
+	// events of task, include JSIP msgs, processed in task goroutine
+	events chan *TaskEvent
+
+	// timers of task, callback run in task goroutine
+	timers    map[*TaskTimer]bool
+	timerLock sync.Mutex
+	lifetime  *TaskTimer
+	created   time.Time
 
 	// DialogueID, RelID will save in relids table
 	relids     map[string]func(jsip *JSIP)
@@ -39,8 +117,12 @@ type Task struct {
 	log      *golib.Log
 	logLevel int
 
+	// TERM of dialogue is sent to SLP, default is termnotify in [JSIPStack]
 	TermNotify bool
 
+	// value recovered from panic in SLP, nil if task not crashed
+	Panic interface{}
+
 	Process func(jsip *JSIP)
 }
 
@@ -48,14 +130,17 @@ func NewTask(taskq chan *Task, setRelated func(dlg string, task *Task),
 	log *golib.Log, logLevel int) *Task {
 
 	t := &Task{
-		msgs:       make(chan *JSIP, 1024),
 		taskq:      taskq,
 		quit:       make(chan bool, 1),
+		done:       make(chan bool),
+		events:     make(chan *TaskEvent, 1024),
+		timers:     make(map[*TaskTimer]bool),
+		created:    time.Now(),
 		relids:     make(map[string]func(jsip *JSIP)),
 		setRelated: setRelated,
 		log:        log,
 		logLevel:   logLevel,
-		TermNotify: false,
+		TermNotify: jstack != nil && jstack.conf().TermNotify,
 	}
 
 	go t.run()
@@ -66,7 +151,7 @@ func NewTask(taskq chan *Task, setRelated func(dlg string, task *Task),
 // New a jsip DialogueID for sending a new jsip session
 func (t *Task) NewDialogueID() string {
 	u4, _ := uuid.NewV4()
-	dlg := "dlg_" + jstack.config.Realm + "_" + u4.String()
+	dlg := "dlg_" + jstack.conf().Realm + "_" + u4.String()
 
 	t.relLock.Lock()
 	t.relids[dlg] = nil
@@ -81,7 +166,7 @@ func (t *Task) NewDialogueID() string {
 // for sending a new jsip session
 func (t *Task) NewDialogueIDWithEntry(process func(*JSIP)) string {
 	u4, _ := uuid.NewV4()
-	dlg := "dlg_" + jstack.config.Realm + "_" + u4.String()
+	dlg := "dlg_" + jstack.conf().Realm + "_" + u4.String()
 
 	t.relLock.Lock()
 	t.relids[dlg] = process
@@ -99,7 +184,7 @@ func (t *Task) NewDialogueIDWithEntry(process func(*JSIP)) string {
 //		gortc can send the request to rtcbroker instance by this relid
 func (t *Task) NewRelIDWithEntry(process func(*JSIP)) string {
 	u4, _ := uuid.NewV4()
-	relid := "rel" + jstack.config.Realm + "+" + u4.String()
+	relid := "rel" + jstack.conf().Realm + "+" + u4.String()
 
 	t.relLock.Lock()
 	t.relids[relid] = process
@@ -115,97 +200,246 @@ func (t *Task) GetCtx() interface{} {
 	return t.ctx
 }
 
-// Terminate SLP instance
+// Terminate SLP instance, calling more than once is harmless
 func (t *Task) SetFinished() {
-	t.quit <- true
+	select {
+	case t.quit <- true:
+	default:
+	}
 }
 
-func (t *Task) run() {
-	//defer func() {
-	//	if err := recover(); err != nil {
-	//		t.LogError("task process err: %s", err)
-	//		t.taskq <- t
-	//	}
-	//}()
+// run f of SLP, return false if SLP panic
+func (t *Task) protect(name string, f func()) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			t.Panic = err
+			t.LogError("task process %s panic: %v\n%s", name, err, debug.Stack())
+			ok = false
+		}
+	}()
+
+	f()
+
+	return true
+}
+
+// process msg by entry, or by Process if entry is nil,
+// return false if SLP panic
+func (t *Task) call(entry func(*JSIP), msg *JSIP) bool {
+	if entry == nil {
+		entry = t.Process
+	}
+
+	name := "onload"
+	if msg != nil {
+		name = msg.Name() + " " + msg.DialogueID
+	}
+
+	return t.protect(name, func() { entry(msg) })
+}
+
+// task goroutine quit, recycle task by taskq
+func (t *Task) exit() {
+	t.timerLock.Lock()
+	close(t.done)
+	t.timerLock.Unlock()
+
+	t.stopTimers()
+	t.endInner()
+	t.taskq <- t
+}
+
+// SLP crashed, answer requests not responded in dialogues of task with 500
+func (t *Task) abort() {
+	if jstack == nil {
+		return
+	}
+
+	t.relLock.RLock()
+	dlgs := make([]string, 0, len(t.relids))
+	for id := range t.relids {
+		dlgs = append(dlgs, id)
+	}
+	t.relLock.RUnlock()
+
+	for _, dlg := range dlgs {
+		for _, req := range jstack.unanswered(dlg) {
+			res := JSIPMsgRes(req, 500)
+			res.SetString("Reason", "SLP Crashed")
+			SendMsg(res)
+		}
+	}
+}
 
+func (t *Task) run() {
 	for {
 		select {
-		case msg := <-t.msgs:
-
-			// Onload when slp load into system
-			if msg == nil {
-				t.Process(msg)
-				continue
+		case ev := <-t.events:
+			if !t.handle(ev) {
+				t.abort()
+				t.exit()
+				return
 			}
 
-			t.relLock.RLock()
-			entry, ok := t.relids[msg.DialogueID]
-			if ok { // old DialogueID
-				if msg.Type == TERM {
-					delete(t.relids, msg.DialogueID)
-					if !t.TermNotify {
-						t.relLock.RUnlock()
-						continue
-					}
-				}
+		case <-t.quit:
+			t.exit()
+			return
+		}
+	}
+}
 
-				if entry == nil {
-					t.Process(msg)
-				} else {
-					entry(msg)
+// process event in task goroutine, return false if SLP panic
+func (t *Task) handle(ev *TaskEvent) bool {
+	switch ev.Type {
+	case TaskLoad:
+		if r, ok := t.SLP.(SLPRestorer); ok {
+			restore := func() {
+				if err := r.Restore(t.Store()); err != nil {
+					t.LogError("SLP restore states failed: %v", err)
 				}
+			}
 
-				t.relLock.RUnlock()
-
-				continue
+			if !t.protect("restore", restore) {
+				return false
 			}
-			t.relids[msg.DialogueID] = nil
-			t.relLock.RUnlock()
+		}
+
+		return t.call(nil, nil)
+
+	case TaskMsg:
+		return t.processMsg(ev.Msg)
+
+	case TaskTimerFired:
+		if !t.fired(ev.timer) {
+			return true
+		}
+
+		if !t.protect("timer", ev.timer.tt.cb) {
+			return false
+		}
+
+		t.rearm(ev.timer)
+
+		return true
 
-			// new DialogueID
+	case TaskCall:
+		ok := t.protect("call", ev.call)
+		ev.done <- ok
 
-			// get relid
-			relid := ""
-			if len(msg.Router) > 0 {
-				jsipUri, _ := NewJSIPUri(msg.Router[0])
+		return ok
+	}
+
+	h, ok := t.SLP.(SLPEventHandler)
+	if !ok {
+		if ev.Type != TaskShutdown {
+			t.LogError("SLP not handle event %s, dropped", ev.Type)
+		}
+
+		return true
+	}
+
+	return t.protect(ev.Type.String(), func() { h.OnEvent(ev) })
+}
 
+func (t *Task) processMsg(msg *JSIP) bool {
+	t.relLock.Lock()
+	entry, ok := t.relids[msg.DialogueID]
+	if ok { // old DialogueID
+		if msg.Type == TERM {
+			delete(t.relids, msg.DialogueID)
+		}
+	} else {
+		t.relids[msg.DialogueID] = nil
+	}
+	t.relLock.Unlock()
+
+	if ok && msg.Type == TERM && !t.TermNotify {
+		return true
+	}
+
+	// new DialogueID
+	if !ok {
+		// get relid
+		relid := ""
+		if len(msg.Router) > 0 {
+			jsipUri, err := NewJSIPUri(msg.Router[0])
+			if err == nil {
 				rid, ok := jsipUri.Paras["relid"]
 				if ok && rid != "" {
 					relid = rid
 				}
 			}
+		}
 
-			if relid != "" {
-				t.relLock.Lock()
-				entry = t.relids[relid]
-				// New DialogueID use same entry with it's relid
-				t.relids[msg.DialogueID] = entry
-				t.relLock.Unlock()
-			} else {
-				t.relLock.RLock()
-				entry = t.relids[msg.DialogueID]
-				t.relLock.RUnlock()
-			}
-
-			if entry == nil {
-				t.Process(msg)
-			} else {
-				entry(msg)
-			}
-
-		case <-t.quit:
-			t.taskq <- t
-			return
+		if relid != "" {
+			t.relLock.Lock()
+			entry = t.relids[relid]
+			// New DialogueID use same entry with it's relid
+			t.relids[msg.DialogueID] = entry
+			t.relLock.Unlock()
 		}
 	}
+
+	return t.call(entry, msg)
 }
 
 func (t *Task) SetCtx(ctx interface{}) {
 	t.ctx = ctx
 }
 
+// Deliver JSIP msg to task, nil msg is same as TaskLoad event
 func (t *Task) OnMsg(jsip *JSIP) {
-	t.msgs <- jsip
+	if jsip == nil {
+		t.OnEvent(&TaskEvent{Type: TaskLoad})
+		return
+	}
+
+	t.OnEvent(&TaskEvent{Type: TaskMsg, Msg: jsip})
+}
+
+// Deliver event to task, return false if task finished
+func (t *Task) OnEvent(ev *TaskEvent) bool {
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+
+	select {
+	case t.events <- ev:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// Run f in task goroutine and wait until it return, for API and other
+// goroutines accessing states owned by task without lock,
+// return false if task finished before f run or f panic.
+// Should not be called in task goroutine
+func (t *Task) Call(f func()) bool {
+	ev := &TaskEvent{
+		Type: TaskCall,
+		call: f,
+		done: make(chan bool, 1),
+	}
+
+	if !t.OnEvent(ev) {
+		return false
+	}
+
+	select {
+	case ok := <-ev.done:
+		return ok
+	case <-t.done:
+		return false
+	}
+}
+
+// Send data to task as TaskMessage from task from, from could be nil if
+// not sent by task, return false if task finished
+func (t *Task) Send(from *Task, data interface{}) bool {
+	return t.OnEvent(&TaskEvent{Type: TaskMessage, From: from, Data: data})
 }
 
 func (t *Task) GetRelids() []string {
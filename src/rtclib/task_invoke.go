@@ -0,0 +1,203 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Invoke SLP in process, msgs of dialogue between caller task and callee
+// task are delivered to each other without JSIP stack. Caller and callee have
+// their own DialogueID of the dialogue, direction of msg is decided by
+// DialogueID it sent in
+
+package rtclib
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// dialogue between caller task and callee task in process
+type innerDialogue struct {
+	req       *JSIP  // initial request sent by caller
+	calleeDlg string // DialogueID of callee
+	caller    *Task
+	callee    *Task
+	answered  bool // final response of initial request sent
+}
+
+var (
+	invoker func(name string, parent *Task) (*Task, error)
+
+	innerLock sync.Mutex
+	innerDlgs = map[string]*innerDialogue{} // DialogueID of both sides
+)
+
+// Set function to create task of SLP name invoked by parent task, set by
+// gortc
+func SetInvoker(f func(name string, parent *Task) (*Task, error)) {
+	invoker = f
+}
+
+func (t *Task) child(name string) (*Task, error) {
+	if invoker == nil {
+		return nil, errors.New("invoker not set")
+	}
+
+	c, err := invoker(name, t)
+	if err != nil {
+		return nil, err
+	}
+	c.Parent = t
+
+	return c, nil
+}
+
+// Invoke SLP name in process with request req, req.DialogueID is set to a
+// new dialogue of t, msgs sent by callee in the dialogue are delivered to
+// entry, or Process if entry is nil. Callee receives copy of req in its own
+// DialogueID. Return callee task
+func (t *Task) Invoke(name string, req *JSIP, entry func(*JSIP)) (*Task,
+	error) {
+
+	if req == nil || req.Code != 0 || req.Type == ACK || req.Type == TERM {
+		return nil, errors.New("invoke need initial request")
+	}
+
+	c, err := t.child(name)
+	if err != nil {
+		return nil, err
+	}
+
+	req.DialogueID = t.NewDialogueIDWithEntry(entry)
+	if req.CSeq == 0 {
+		req.CSeq = uint64(rand.Uint32())
+	}
+	if req.rawMsg == nil {
+		req.rawMsg = make(map[string]interface{})
+	}
+
+	creq := JSIPMsgClone(req, c.NewDialogueID())
+	creq.CSeq = req.CSeq
+
+	d := &innerDialogue{
+		req:       req,
+		calleeDlg: creq.DialogueID,
+		caller:    t,
+		callee:    c,
+	}
+
+	innerLock.Lock()
+	innerDlgs[req.DialogueID] = d
+	innerDlgs[d.calleeDlg] = d
+	innerLock.Unlock()
+
+	c.OnMsg(creq)
+
+	return c, nil
+}
+
+// Invoke SLP name in process with custom data, callee task receives data as
+// TaskMessage event from t, and can reply by Send to t. Return callee task
+func (t *Task) InvokeWithData(name string, data interface{}) (*Task, error) {
+	c, err := t.child(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Send(t, data)
+
+	return c, nil
+}
+
+// deliver msg sent in dialogue between tasks, return false if msg not in
+// such dialogue
+func sendInner(m *JSIP) bool {
+	innerLock.Lock()
+	d := innerDlgs[m.DialogueID]
+	if d == nil {
+		innerLock.Unlock()
+		return false
+	}
+
+	if m.Type == TERM {
+		delete(innerDlgs, d.req.DialogueID)
+		delete(innerDlgs, d.calleeDlg)
+	}
+
+	// msgs sent in DialogueID of caller are from caller
+	toCallee := m.DialogueID == d.req.DialogueID
+
+	if !toCallee && m.Code >= 200 && m.CSeq == d.req.CSeq {
+		d.answered = true
+	}
+	innerLock.Unlock()
+
+	if m.Type == TERM {
+		// TERM is sent to both sides
+		d.caller.OnMsg(JSIPMsgTerm(d.req.DialogueID))
+		d.callee.OnMsg(JSIPMsgTerm(d.calleeDlg))
+
+		return true
+	}
+
+	if toCallee {
+		m.DialogueID = d.calleeDlg
+	} else {
+		m.DialogueID = d.req.DialogueID
+	}
+
+	if m.Code != 0 {
+		if m.Type == JSIPType(Unknown) {
+			m.Type = d.req.Type
+		}
+
+		if m.From == "" {
+			m.From = d.req.From
+		}
+
+		if m.To == "" {
+			m.To = d.req.To
+		}
+	}
+
+	if toCallee {
+		d.callee.OnMsg(m)
+	} else {
+		d.caller.OnMsg(m)
+	}
+
+	return true
+}
+
+// task finished, terminate dialogues of task with other tasks, initial
+// request not answered by callee is answered with 500
+func (t *Task) endInner() {
+	dlgs := []*innerDialogue{}
+
+	innerLock.Lock()
+	for dlg, d := range innerDlgs {
+		// every dialogue is added once by DialogueID of caller
+		if (d.caller == t || d.callee == t) && dlg == d.req.DialogueID {
+			dlgs = append(dlgs, d)
+		}
+	}
+
+	for _, d := range dlgs {
+		delete(innerDlgs, d.req.DialogueID)
+		delete(innerDlgs, d.calleeDlg)
+	}
+	innerLock.Unlock()
+
+	for _, d := range dlgs {
+		if d.caller == t {
+			d.callee.OnMsg(JSIPMsgTerm(d.calleeDlg))
+			continue
+		}
+
+		if !d.answered {
+			res := JSIPMsgRes(d.req, 500)
+			res.SetString("Reason", "SLP Finished")
+			d.caller.OnMsg(res)
+		}
+
+		d.caller.OnMsg(JSIPMsgTerm(d.req.DialogueID))
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Task Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+func TestTaskPanic(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTaskPanic")
+
+	taskq := make(chan *Task, 1)
+	task := NewTask(taskq, nil, golib.NewLog("task.log"), golib.LOGDEBUG)
+
+	processed := 0
+	task.Process = func(m *JSIP) {
+		processed++
+		if m.Type == BYE {
+			var p *JSIP
+			_ = p.Type
+		}
+	}
+
+	task.OnMsg(JSIPMsgReq(INVITE, "bob@test.com", "alice@test.com",
+		"bob@test.com", "dlg_panic"))
+	task.OnMsg(JSIPMsgReq(BYE, "bob@test.com", "alice@test.com",
+		"bob@test.com", "dlg_panic"))
+
+	select {
+	case q := <-taskq:
+		assert(q == task)
+	case <-time.After(time.Second):
+		assert(false)
+	}
+
+	assert(processed == 2)
+	assert(task.Panic != nil)
+	assert(len(task.GetRelids()) > 0)
+
+	// task not crashed
+	task = NewTask(taskq, nil, golib.NewLog("task.log"), golib.LOGDEBUG)
+	task.Process = func(m *JSIP) {}
+	task.OnMsg(JSIPMsgReq(MESSAGE, "bob@test.com", "alice@test.com",
+		"bob@test.com", "dlg_normal"))
+	task.SetFinished()
+
+	q := <-taskq
+	assert(q == task && task.Panic == nil)
+}
+
+func TestTaskTimer(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTaskTimer")
+
+	taskq := make(chan *Task, 1)
+	task := NewTask(taskq, nil, golib.NewLog("task.log"), golib.LOGDEBUG)
+
+	// callbacks run in task goroutine, no lock needed
+	once := 0
+	ticks := 0
+	stopped := 0
+	fired := make(chan bool, 1)
+
+	task.AfterFunc(10*time.Millisecond, func() { once++ })
+	s := task.AfterFunc(10*time.Millisecond, func() { stopped++ })
+	assert(s.Stop())
+	assert(!s.Stop())
+
+	ticker := make(chan *TaskTimer, 1)
+	ticker <- task.Ticker(10*time.Millisecond, func() {
+		ticks++
+		if ticks == 3 {
+			(<-ticker).Stop()
+			fired <- true
+		}
+	})
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		assert(false)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// reset one shot timer after fired
+	r := task.AfterFunc(time.Hour, func() { fired <- true })
+	assert(r.Reset(10 * time.Millisecond))
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		assert(false)
+	}
+
+	task.SetFinished()
+	<-taskq
+
+	assert(once == 1 && ticks == 3 && stopped == 0)
+	assert(!r.Reset(time.Millisecond))
+
+	// max lifetime
+	task = NewTask(taskq, nil, golib.NewLog("task.log"), golib.LOGDEBUG)
+	task.SetMaxLifetime(time.Hour)
+	task.SetMaxLifetime(20 * time.Millisecond)
+
+	select {
+	case q := <-taskq:
+		assert(q == task)
+	case <-time.After(time.Second):
+		assert(false)
+	}
+}
+
+type eventTestSLP struct {
+	events []*TaskEvent
+}
+
+func (slp *eventTestSLP) Process(m *JSIP) {}
+
+func (slp *eventTestSLP) OnLoad(m *JSIP) {}
+
+func (slp *eventTestSLP) NewSLPCtx() interface{} {
+	return nil
+}
+
+func (slp *eventTestSLP) OnEvent(ev *TaskEvent) {
+	slp.events = append(slp.events, ev)
+}
+
+func TestTaskEvent(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTaskEvent")
+
+	assert(TaskLoad.String() == "Load" && TaskShutdown.String() == "Shutdown")
+	assert(TaskEventType(100).String() == "Unknown")
+
+	taskq := make(chan *Task, 2)
+	slp := &eventTestSLP{}
+	task := NewTask(taskq, nil, golib.NewLog("task.log"), golib.LOGDEBUG)
+	task.SLP = slp
+
+	loaded := 0
+	task.Process = func(m *JSIP) {
+		if m == nil {
+			loaded++
+		}
+	}
+
+	task.OnMsg(nil)
+	assert(task.OnEvent(&TaskEvent{Type: TaskLoad}))
+
+	// message from other task and from goroutine not task
+	other := NewTask(taskq, nil, golib.NewLog("task.log"), golib.LOGDEBUG)
+	assert(task.Send(other, "hello"))
+	assert(task.Send(nil, 1))
+	assert(task.OnEvent(&TaskEvent{Type: TaskShutdown,
+		Deadline: time.Now()}))
+
+	// Call run after events before, states of task accessed without lock
+	n := 0
+	assert(task.Call(func() {
+		n = len(slp.events)
+		assert(loaded == 2)
+	}))
+	assert(n == 3)
+	assert(slp.events[0].Type == TaskMessage && slp.events[0].From == other &&
+		slp.events[0].Data.(string) == "hello")
+	assert(slp.events[1].From == nil && slp.events[1].Data.(int) == 1)
+	assert(slp.events[2].Type == TaskShutdown)
+
+	// panic in Call
+	assert(!task.Call(func() {
+		var p *JSIP
+		_ = p.Type
+	}))
+	assert(<-taskq == task && task.Panic != nil)
+
+	assert(!task.Call(func() {}))
+	assert(!task.Send(nil, "bye"))
+
+	other.SetFinished()
+	assert(<-taskq == other)
+}
+
+func TestTaskInvoke(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTaskInvoke")
+
+	old := jstack
+	jstack = &JSIPStack{
+		log:    golib.NewLog("stack.log"),
+		config: &jsipDConfig{Realm: "test.com"},
+	}
+	defer func() { jstack = old }()
+
+	taskq := make(chan *Task, 8)
+	setRelated := func(id string, task *Task) {}
+	log := golib.NewLog("task.log")
+
+	answer := true
+	calleeMsgs := make(chan *JSIP, 4)
+	SetInvoker(func(name string, parent *Task) (*Task, error) {
+		c := NewTask(taskq, setRelated, log, golib.LOGDEBUG)
+		c.SLP = &eventTestSLP{}
+
+		switch name {
+		case "echo":
+			reply := answer
+			c.Process = func(m *JSIP) {
+				if m.Code != 0 || m.Type == TERM {
+					return
+				}
+
+				if reply {
+					SendMsg(JSIPMsgRes(m, 200))
+				} else {
+					c.SetFinished()
+				}
+			}
+		case "hangup":
+			// answer INVITE and hangup by BYE created from INVITE
+			c.TermNotify = true
+			c.Process = func(m *JSIP) {
+				if m.Type == INVITE && m.Code == 0 {
+					SendMsg(JSIPMsgRes(m, 200))
+					SendMsg(JSIPMsgBye(m))
+					return
+				}
+
+				calleeMsgs <- m
+			}
+		default:
+			return nil, fmt.Errorf("SLP %s not exist", name)
+		}
+
+		return c, nil
+	})
+	defer SetInvoker(nil)
+
+	caller := NewTask(taskq, setRelated, log, golib.LOGDEBUG)
+	caller.TermNotify = true
+	caller.Process = func(m *JSIP) {}
+
+	msgs := make(chan *JSIP, 4)
+	entry := func(m *JSIP) { msgs <- m }
+
+	invoke := func(name string) (*Task, error) {
+		var c *Task
+		var err error
+		caller.Call(func() {
+			c, err = caller.Invoke(name, JSIPMsgReq(MESSAGE, "echo@test.com",
+				"alice@test.com", "echo@test.com", ""), entry)
+		})
+
+		return c, err
+	}
+
+	_, err := invoke("unknown")
+	assert(err != nil)
+
+	// response from callee delivered to caller entry
+	c, err := invoke("echo")
+	assert(err == nil && c.Parent == caller)
+
+	m := <-msgs
+	assert(m.Code == 200 && m.Type == MESSAGE && m.From == "alice@test.com")
+
+	c.SetFinished()
+	assert(<-taskq == c)
+	m = <-msgs
+	assert(m.Type == TERM)
+
+	// callee finished without response
+	answer = false
+	c, err = invoke("echo")
+	assert(err == nil)
+	assert(<-taskq == c)
+
+	m = <-msgs
+	assert(m.Code == 500)
+	m = <-msgs
+	assert(m.Type == TERM)
+
+	innerLock.Lock()
+	assert(len(innerDlgs) == 0)
+	innerLock.Unlock()
+
+	// callee sends BYE, From of BYE is caller as created from INVITE
+	var invite *JSIP
+	caller.Call(func() {
+		invite = JSIPMsgReq(INVITE, "echo@test.com", "alice@test.com",
+			"echo@test.com", "")
+		c, err = caller.Invoke("hangup", invite, entry)
+	})
+	assert(err == nil)
+
+	m = <-msgs
+	assert(m.Code == 200 && m.Type == INVITE &&
+		m.DialogueID == invite.DialogueID)
+	m = <-msgs
+	assert(m.Type == BYE && m.Code == 0 && m.DialogueID == invite.DialogueID)
+
+	// response of BYE and TERM from caller delivered to callee
+	SendMsg(JSIPMsgRes(m, 200))
+	m = <-calleeMsgs
+	assert(m.Type == BYE && m.Code == 200 &&
+		m.DialogueID != invite.DialogueID)
+	calleeDlg := m.DialogueID
+
+	SendMsg(JSIPMsgTerm(invite.DialogueID))
+	m = <-calleeMsgs
+	assert(m.Type == TERM && m.DialogueID == calleeDlg)
+	m = <-msgs
+	assert(m.Type == TERM && m.DialogueID == invite.DialogueID)
+
+	innerLock.Lock()
+	assert(len(innerDlgs) == 0)
+	innerLock.Unlock()
+
+	c.SetFinished()
+	assert(<-taskq == c)
+
+	// custom data
+	c, err = caller.InvokeWithData("echo", "hello")
+	assert(err == nil)
+
+	n := 0
+	slp := c.SLP.(*eventTestSLP)
+	c.Call(func() { n = len(slp.events) })
+	assert(n == 1 && slp.events[0].From == caller &&
+		slp.events[0].Data.(string) == "hello")
+
+	c.SetFinished()
+	assert(<-taskq == c)
+	caller.SetFinished()
+	assert(<-taskq == caller)
+}
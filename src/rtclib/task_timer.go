@@ -0,0 +1,175 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Task timers, callbacks are run in task goroutine serialized with JSIP msgs
+
+package rtclib
+
+import (
+	"time"
+)
+
+type TaskTimer struct {
+	task   *Task
+	timer  *wheelTimer
+	period time.Duration // 0 for timer fire once
+	cb     func()
+	seq    uint64 // schedule of timer, event of old schedule is dropped
+}
+
+// timer fired, delivered to task goroutine
+type timerEvent struct {
+	tt  *TaskTimer
+	seq uint64
+}
+
+// schedule timer after d, must be called with timerLock
+func (tt *TaskTimer) schedule(d time.Duration) {
+	t := tt.task
+
+	tt.seq++
+	seq := tt.seq
+	t.timers[tt] = true
+	tt.timer = sharedWheel().AfterFunc(d, func() {
+		select {
+		case t.events <- &TaskEvent{
+			Type:  TaskTimerFired,
+			timer: timerEvent{tt: tt, seq: seq},
+		}:
+		case <-t.done:
+		}
+	})
+}
+
+func (t *Task) newTimer(d time.Duration, period time.Duration,
+	cb func()) *TaskTimer {
+
+	tt := &TaskTimer{
+		task:   t,
+		period: period,
+		cb:     cb,
+	}
+
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+
+	select {
+	case <-t.done: // task finished, timer never fire
+		return tt
+	default:
+	}
+
+	tt.schedule(d)
+
+	return tt
+}
+
+// Call cb in task goroutine after duration d
+func (t *Task) AfterFunc(d time.Duration, cb func()) *TaskTimer {
+	return t.newTimer(d, 0, cb)
+}
+
+// Call cb in task goroutine every duration d, next tick is scheduled after
+// cb return
+func (t *Task) Ticker(d time.Duration, cb func()) *TaskTimer {
+	return t.newTimer(d, d, cb)
+}
+
+// Terminate task if task not finished after d since created, a new max
+// lifetime replaces the old one
+func (t *Task) SetMaxLifetime(d time.Duration) {
+	lifetime := t.AfterFunc(time.Until(t.created.Add(d)), func() {
+		t.LogError("task reach max lifetime %s", d)
+		t.SetFinished()
+	})
+
+	t.timerLock.Lock()
+	old := t.lifetime
+	t.lifetime = lifetime
+	t.timerLock.Unlock()
+
+	if old != nil {
+		old.Stop()
+	}
+}
+
+// Stop timer, return false if timer has been stopped or has fired
+func (tt *TaskTimer) Stop() bool {
+	t := tt.task
+
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+
+	if !t.timers[tt] {
+		return false
+	}
+
+	delete(t.timers, tt)
+	tt.timer.Stop()
+
+	return true
+}
+
+// Reset timer to fire after duration d, restart timer if it has been
+// stopped or has fired, return false if task finished
+func (tt *TaskTimer) Reset(d time.Duration) bool {
+	t := tt.task
+
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+
+	if tt.timer != nil {
+		tt.timer.Stop()
+	}
+	tt.schedule(d)
+
+	return true
+}
+
+// check timer event in task goroutine, return false if event should be
+// dropped
+func (t *Task) fired(ev timerEvent) bool {
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+
+	tt := ev.tt
+	if !t.timers[tt] || tt.seq != ev.seq {
+		return false
+	}
+
+	if tt.period == 0 {
+		delete(t.timers, tt)
+	}
+
+	return true
+}
+
+// schedule next tick of ticker after callback
+func (t *Task) rearm(ev timerEvent) {
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+
+	tt := ev.tt
+	if tt.period == 0 || !t.timers[tt] || tt.seq != ev.seq {
+		return
+	}
+
+	tt.schedule(tt.period)
+}
+
+// stop all timers when task finished
+func (t *Task) stopTimers() {
+	t.timerLock.Lock()
+	defer t.timerLock.Unlock()
+
+	for tt := range t.timers {
+		tt.timer.Stop()
+	}
+	t.timers = make(map[*TaskTimer]bool)
+}
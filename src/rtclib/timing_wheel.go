@@ -0,0 +1,253 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Hierarchical timing wheel shared by transactions, sessions and task timers,
+// schedule and cancel are O(1), expire is rounded up to tick
+
+package rtclib
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 4 // 64^4 ticks, about 46 hours for 10ms tick
+
+	defaultTimerTick = 10 * time.Millisecond
+)
+
+var (
+	wheelOnce sync.Once
+	wheel     *timingWheel
+	wheelTick = defaultTimerTick
+)
+
+// shared timing wheel, created when first used
+func sharedWheel() *timingWheel {
+	wheelOnce.Do(func() {
+		wheel = newTimingWheel(wheelTick)
+	})
+
+	return wheel
+}
+
+// set tick of shared timing wheel, no effect after wheel used
+func setTimerTick(d time.Duration) {
+	if d > 0 {
+		wheelTick = d
+	}
+}
+
+type wheelTimer struct {
+	w    *timingWheel
+	f    func()
+	when uint64 // tick timer expire
+
+	// linked in slot, slot is nil if timer not scheduled
+	slot       *wheelTimer
+	prev, next *wheelTimer
+}
+
+type timingWheel struct {
+	tick  time.Duration
+	start time.Time
+
+	lock     sync.Mutex
+	now      uint64 // ticks has been processed
+	count    int
+	levels   [wheelLevels][wheelSlots]wheelTimer // slots, head of list
+	overflow wheelTimer                          // timers beyond all levels
+
+	quit chan struct{}
+}
+
+func newTimingWheel(tick time.Duration) *timingWheel {
+	w := &timingWheel{
+		tick:  tick,
+		start: time.Now(),
+		quit:  make(chan struct{}),
+	}
+
+	for l := range w.levels {
+		for i := range w.levels[l] {
+			head := &w.levels[l][i]
+			head.prev, head.next = head, head
+		}
+	}
+	w.overflow.prev, w.overflow.next = &w.overflow, &w.overflow
+
+	go w.loop()
+
+	return w
+}
+
+// Call f in its own goroutine after duration d, as time.AfterFunc
+func (w *timingWheel) AfterFunc(d time.Duration, f func()) *wheelTimer {
+	t := w.NewTimer(f)
+	t.Reset(d)
+
+	return t
+}
+
+// New timer calling f in its own goroutine, not scheduled until Reset, so
+// timer can be saved before f may read it
+func (w *timingWheel) NewTimer(f func()) *wheelTimer {
+	return &wheelTimer{w: w, f: f}
+}
+
+// Stop timer, return false if timer has been stopped or has fired
+func (t *wheelTimer) Stop() bool {
+	w := t.w
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if t.slot == nil {
+		return false
+	}
+
+	w.remove(t)
+
+	return true
+}
+
+// Reset timer to fire after duration d, return false if timer has been
+// stopped or has fired
+func (t *wheelTimer) Reset(d time.Duration) bool {
+	w := t.w
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	active := t.slot != nil
+	if active {
+		w.remove(t)
+	}
+	w.schedule(t, d)
+
+	return active
+}
+
+// number of timers scheduled
+func (w *timingWheel) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.count
+}
+
+func (w *timingWheel) Stop() {
+	close(w.quit)
+}
+
+// must be called with lock
+func (w *timingWheel) schedule(t *wheelTimer, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	// round up, never fire before d
+	t.when = uint64((time.Since(w.start) + d + w.tick - 1) / w.tick)
+	if t.when <= w.now {
+		t.when = w.now + 1
+	}
+
+	w.add(t)
+	w.count++
+}
+
+// must be called with lock
+func (w *timingWheel) remove(t *wheelTimer) {
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next, t.slot = nil, nil, nil
+	w.count--
+}
+
+// put timer into lowest level on which when and now are in same round,
+// slot of when on this level is always ahead of now
+func (w *timingWheel) add(t *wheelTimer) {
+	head := &w.overflow
+	for l := 0; l < wheelLevels; l++ {
+		shift := uint(wheelBits * (l + 1))
+		if t.when>>shift == w.now>>shift {
+			head = &w.levels[l][(t.when>>uint(wheelBits*l))&wheelMask]
+			break
+		}
+	}
+
+	t.slot = head
+	t.prev = head.prev
+	t.next = head
+	head.prev.next = t
+	head.prev = t
+}
+
+// process one tick, return timers expired
+func (w *timingWheel) advance(expired []*wheelTimer) []*wheelTimer {
+	w.now++
+
+	if w.now&(1<<uint(wheelBits*wheelLevels)-1) == 0 {
+		w.cascadeSlot(&w.overflow)
+	}
+
+	for l := wheelLevels - 1; l > 0; l-- {
+		if w.now&(1<<uint(wheelBits*l)-1) == 0 {
+			w.cascadeSlot(&w.levels[l][(w.now>>uint(wheelBits*l))&wheelMask])
+		}
+	}
+
+	head := &w.levels[0][w.now&wheelMask]
+	for t := head.next; t != head; t = head.next {
+		w.remove(t)
+		expired = append(expired, t)
+	}
+
+	return expired
+}
+
+// unlink all timers from slot, then add them again into lower levels
+func (w *timingWheel) cascadeSlot(head *wheelTimer) {
+	t := head.next
+	head.prev.next = nil
+	head.prev, head.next = head, head
+
+	for t != nil && t != head {
+		next := t.next
+		w.add(t)
+		t = next
+	}
+}
+
+func (w *timingWheel) loop() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	var expired []*wheelTimer
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.quit:
+			return
+		}
+
+		target := uint64(time.Since(w.start) / w.tick)
+
+		w.lock.Lock()
+		for w.now < target {
+			expired = w.advance(expired)
+		}
+		w.lock.Unlock()
+
+		for i, t := range expired {
+			go t.f()
+			expired[i] = nil
+		}
+		expired = expired[:0]
+	}
+}
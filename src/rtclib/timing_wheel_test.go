@@ -0,0 +1,136 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// Timing wheel Test Case
+
+package rtclib
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimingWheelCascade(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTimingWheelCascade")
+
+	// loop never advance, ticks are processed by test
+	w := newTimingWheel(time.Hour)
+	defer w.Stop()
+
+	whens := []uint64{1, 2, 63, 64, 65, 127, 4095, 4096, 4097, 262143,
+		262144, 262145, 1<<24 - 1, 1 << 24, 1<<24 + 3}
+
+	timers := map[*wheelTimer]uint64{}
+	w.lock.Lock()
+	for _, when := range whens {
+		tt := &wheelTimer{w: w, when: when}
+		w.add(tt)
+		w.count++
+		timers[tt] = when
+	}
+	w.lock.Unlock()
+
+	stopped := &wheelTimer{w: w, when: 100}
+	w.lock.Lock()
+	w.add(stopped)
+	w.count++
+	w.lock.Unlock()
+	assert(stopped.Stop())
+	assert(!stopped.Stop())
+	assert(w.Len() == len(whens))
+
+	last := whens[len(whens)-1]
+	fired := 0
+
+	w.lock.Lock()
+	for w.now < last {
+		for _, tt := range w.advance(nil) {
+			assert(timers[tt] == w.now)
+			fired++
+		}
+	}
+	w.lock.Unlock()
+
+	assert(fired == len(whens))
+	assert(w.Len() == 0)
+}
+
+func TestTimingWheelFire(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTimingWheelFire")
+
+	w := newTimingWheel(time.Millisecond)
+	defer w.Stop()
+
+	start := time.Now()
+	c := make(chan time.Duration, 1)
+	w.AfterFunc(50*time.Millisecond, func() {
+		c <- time.Since(start)
+	})
+
+	d := <-c
+	assert(d >= 50*time.Millisecond && d < time.Second)
+
+	// stopped timer never fire
+	var count int32
+	tt := w.AfterFunc(20*time.Millisecond, func() {
+		atomic.AddInt32(&count, 1)
+	})
+	assert(tt.Stop())
+	time.Sleep(50 * time.Millisecond)
+	assert(atomic.LoadInt32(&count) == 0)
+
+	// reset stopped timer
+	assert(!tt.Reset(10 * time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+	assert(atomic.LoadInt32(&count) == 1)
+
+	// reset active timer, fire only once
+	start = time.Now()
+	tt = w.AfterFunc(10*time.Millisecond, func() {
+		c <- time.Since(start)
+	})
+	assert(tt.Reset(80 * time.Millisecond))
+	d = <-c
+	assert(d >= 80*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert(len(c) == 0)
+	assert(w.Len() == 0)
+
+	// new timer not scheduled until reset, callback can read timer
+	var nt *wheelTimer
+	nt = w.NewTimer(func() {
+		assert(!nt.Stop())
+		c <- 0
+	})
+	time.Sleep(20 * time.Millisecond)
+	assert(len(c) == 0 && w.Len() == 0)
+	assert(!nt.Reset(10 * time.Millisecond))
+	<-c
+	assert(w.Len() == 0)
+}
+
+func BenchmarkTimingWheel(b *testing.B) {
+	w := newTimingWheel(10 * time.Millisecond)
+	defer w.Stop()
+
+	f := func() {}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tt := w.AfterFunc(time.Duration(i%600)*time.Second, f)
+		tt.Reset(time.Minute)
+		tt.Stop()
+	}
+}
+
+func BenchmarkTimeAfterFunc(b *testing.B) {
+	f := func() {}
+
+	for i := 0; i < b.N; i++ {
+		tt := time.AfterFunc(time.Duration(i%600)*time.Second, f)
+		tt.Reset(time.Minute)
+		tt.Stop()
+	}
+}
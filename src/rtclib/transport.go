@@ -0,0 +1,201 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Transport
+
+package rtclib
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alexwoo/golib"
+	"github.com/gorilla/websocket"
+)
+
+// Options for transport dial and listen
+type TransportOpts struct {
+	Location string // websocket location
+	Timeout  time.Duration
+	Retry    int
+	Qsize    uint64
+	TLS      *tls.Config
+
+	// JSIP subprotocol preferred when dial websocket, JSON if empty
+	Subprotocol string
+
+	Handler  func(golib.Conn, []byte) // JSIP msg receive handler
+	Log      *golib.Log
+	LogLevel int
+}
+
+// Transport Listener for receiving JSIP msg
+type TransportListener interface {
+	// Accept connections or datagrams until listener closed
+	Serve() error
+
+	// Address listened
+	Addr() net.Addr
+
+	// Close listener
+	Close()
+}
+
+// Transport for JSIP msg, selected by URI para transport,
+// as user@host:port;transport=tcp
+type Transport interface {
+	// Dial to hostport, return nil if dial failed,
+	// name is connection name, userid is local user send to peer
+	Dial(name string, hostport string, userid string,
+		opts *TransportOpts) golib.Conn
+
+	// Listen on addr
+	Listen(addr string, opts *TransportOpts) (TransportListener, error)
+}
+
+var (
+	transLock  sync.RWMutex
+	transports = map[string]Transport{}
+)
+
+// Register a transport with name, transport registered with the same name
+// will be replaced
+func RegisterTransport(name string, t Transport) {
+	transLock.Lock()
+	transports[name] = t
+	transLock.Unlock()
+}
+
+// Get transport by name, return nil if not registered
+func GetTransport(name string) Transport {
+	transLock.RLock()
+	defer transLock.RUnlock()
+
+	return transports[name]
+}
+
+func init() {
+	RegisterTransport("ws", &wsTransport{scheme: "ws"})
+	RegisterTransport("wss", &wsTransport{scheme: "wss", secure: true})
+	RegisterTransport("tcp", &streamTransport{network: "tcp"})
+	RegisterTransport("tls", &streamTransport{network: "tls"})
+	RegisterTransport("udp", &udpTransport{})
+}
+
+// websocket transport
+type wsTransport struct {
+	scheme string
+	secure bool
+}
+
+func (t *wsTransport) Dial(name string, hostport string, userid string,
+	opts *TransportOpts) golib.Conn {
+
+	url := t.scheme + "://" + hostport + opts.Location + "?userid=" + userid
+
+	if !t.secure && !IsJSIPBinarySubprotocol(opts.Subprotocol) {
+		return golib.NewWSClient(name, url, opts.Timeout, opts.Retry,
+			opts.Qsize, opts.Handler, opts.Log, opts.LogLevel)
+	}
+
+	// golib websocket client cannot set tls config and subprotocols,
+	// use stream connection
+	c := newStreamConn(t.scheme, name, hostport, opts)
+	c.dial = func() (msgConn, error) {
+		dialer := &websocket.Dialer{
+			HandshakeTimeout: opts.Timeout,
+			TLSClientConfig:  opts.TLS,
+		}
+
+		// fall back to JSON if peer not support subprotocol preferred
+		if IsJSIPBinarySubprotocol(opts.Subprotocol) {
+			dialer.Subprotocols = []string{opts.Subprotocol, JSIPSubprotoJSON}
+		}
+
+		conn, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return newWSMsgConn(conn), nil
+	}
+
+	go c.connect()
+
+	return c
+}
+
+func (t *wsTransport) Listen(addr string,
+	opts *TransportOpts) (TransportListener, error) {
+
+	return nil, errors.New("websocket listen in rtc server")
+}
+
+// Connection accepted by websocket server of rtc server
+type WSServerConn interface {
+	golib.Conn
+
+	// Serve connection, return when connection closed
+	Accept()
+}
+
+// Create connection for websocket accepted with binary JSIP subprotocol,
+// msgs are sent and received in encoding negotiated
+func NewWSServerConn(name string, conn *websocket.Conn,
+	opts *TransportOpts) WSServerConn {
+
+	c := newStreamConn("ws", name, conn.RemoteAddr().String(), opts)
+	c.dial = func() (msgConn, error) {
+		return newWSMsgConn(conn), nil
+	}
+
+	return c
+}
+
+// JSIP msg in websocket text message, or binary message if binary encoding
+// negotiated
+type wsMsgConn struct {
+	conn  *websocket.Conn
+	codec jsipBinaryCodec
+}
+
+func newWSMsgConn(conn *websocket.Conn) *wsMsgConn {
+	return &wsMsgConn{
+		conn:  conn,
+		codec: jsipBinaryCodecs[conn.Subprotocol()],
+	}
+}
+
+func (c *wsMsgConn) ReadMsg() ([]byte, error) {
+	_, data, err := c.conn.ReadMessage()
+
+	return data, err
+}
+
+func (c *wsMsgConn) WriteMsg(data []byte) error {
+	if c.codec == nil {
+		return c.conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	// msgs queued before connected are encoded in JSON
+	if len(data) > 0 && data[0] == '{' {
+		m := &JSIP{}
+		if err := m.decode(data); err != nil {
+			return err
+		}
+
+		var err error
+		if data, err = m.encodeBinary(c.codec); err != nil {
+			return err
+		}
+	}
+
+	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *wsMsgConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,336 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Transport over TCP and TLS
+// every JSIP msg is framed with 4 bytes length in network byte order
+
+package rtclib
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+const (
+	maxFrameSize = 1024 * 1024
+)
+
+func writeFrame(w io.Writer, data []byte) error {
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(head)
+	if l > maxFrameSize {
+		return nil, errors.New("Frame too large")
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Connection send and receive whole JSIP msg
+type msgConn interface {
+	ReadMsg() ([]byte, error)
+	WriteMsg(data []byte) error
+	Close() error
+}
+
+// JSIP msg framed in net.Conn
+type frameConn struct {
+	conn net.Conn
+}
+
+func (c *frameConn) ReadMsg() ([]byte, error) {
+	return readFrame(c.conn)
+}
+
+func (c *frameConn) WriteMsg(data []byte) error {
+	return writeFrame(c.conn, data)
+}
+
+func (c *frameConn) Close() error {
+	return c.conn.Close()
+}
+
+// TCP or TLS transport
+type streamTransport struct {
+	network string
+}
+
+func (t *streamTransport) Dial(name string, hostport string, userid string,
+	opts *TransportOpts) golib.Conn {
+
+	c := newStreamConn(t.network, name, hostport, opts)
+	c.dial = func() (msgConn, error) {
+		var conn net.Conn
+		var err error
+
+		dialer := &net.Dialer{Timeout: opts.Timeout}
+		if t.network == "tls" {
+			conn, err = tls.DialWithDialer(dialer, "tcp", hostport, opts.TLS)
+		} else {
+			conn, err = dialer.Dial("tcp", hostport)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &frameConn{conn: conn}, nil
+	}
+
+	go c.connect()
+
+	return c
+}
+
+func (t *streamTransport) Listen(addr string,
+	opts *TransportOpts) (TransportListener, error) {
+
+	var l net.Listener
+	var err error
+
+	if t.network == "tls" {
+		if opts.TLS == nil {
+			return nil, errors.New("TLS config not set")
+		}
+
+		l, err = tls.Listen("tcp", addr, opts.TLS)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamListener{
+		network: t.network,
+		l:       l,
+		opts:    opts,
+	}, nil
+}
+
+type streamListener struct {
+	network string
+	l       net.Listener
+	opts    *TransportOpts
+	closed  bool
+	lock    sync.Mutex
+}
+
+func (l *streamListener) Serve() error {
+	for {
+		conn, err := l.l.Accept()
+		if err != nil {
+			l.lock.Lock()
+			closed := l.closed
+			l.lock.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		remote := conn.RemoteAddr().String()
+		c := newStreamConn(l.network, remote, remote, l.opts)
+		c.setConn(&frameConn{conn: conn})
+	}
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+func (l *streamListener) Close() {
+	l.lock.Lock()
+	l.closed = true
+	l.lock.Unlock()
+
+	l.l.Close()
+}
+
+// Connection for stream transport, sending msg in queue
+type streamConn struct {
+	network  string
+	name     string
+	hostport string
+	opts     *TransportOpts
+	dial     func() (msgConn, error)
+
+	lock  sync.Mutex
+	conn  msgConn
+	sendq chan []byte
+	quit  chan bool
+	once  sync.Once
+}
+
+func newStreamConn(network string, name string, hostport string,
+	opts *TransportOpts) *streamConn {
+
+	return &streamConn{
+		network:  network,
+		name:     name,
+		hostport: hostport,
+		opts:     opts,
+		sendq:    make(chan []byte, opts.Qsize),
+		quit:     make(chan bool),
+	}
+}
+
+func (c *streamConn) setConn(conn msgConn) {
+	c.lock.Lock()
+	select {
+	case <-c.quit: // closed before connected
+		c.lock.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	c.conn = conn
+	c.lock.Unlock()
+
+	go c.read(conn)
+	go c.write(conn)
+}
+
+func (c *streamConn) connect() {
+	for i := 0; i <= c.opts.Retry; i++ {
+		conn, err := c.dial()
+		if err == nil {
+			c.setConn(conn)
+			return
+		}
+
+		c.opts.Log.LogError(c, "connect failure %d, %v", i+1, err)
+
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(c.opts.Timeout):
+		}
+	}
+
+	c.opts.Log.LogError(c, "connect failed")
+	c.Close()
+}
+
+// Serve connection accepted, dial returns connection accepted
+func (c *streamConn) Accept() {
+	if conn, err := c.dial(); err == nil {
+		c.setConn(conn)
+	} else {
+		c.opts.Log.LogError(c, "accept failed, %v", err)
+		c.Close()
+	}
+
+	<-c.quit
+}
+
+// binary JSIP codec negotiated, nil for JSON or not connected
+func (c *streamConn) codec() jsipBinaryCodec {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ws, ok := c.conn.(*wsMsgConn); ok {
+		return ws.codec
+	}
+
+	return nil
+}
+
+func (c *streamConn) read(conn msgConn) {
+	defer c.Close()
+
+	for {
+		data, err := conn.ReadMsg()
+		if err != nil {
+			if err != io.EOF {
+				c.opts.Log.LogError(c, "read failed, %v", err)
+			}
+
+			return
+		}
+
+		c.opts.Handler(c, data)
+	}
+}
+
+func (c *streamConn) write(conn msgConn) {
+	for {
+		select {
+		case data := <-c.sendq:
+			if err := conn.WriteMsg(data); err != nil {
+				c.opts.Log.LogError(c, "write failed, %v", err)
+				c.Close()
+				return
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *streamConn) Send(data []byte) {
+	select {
+	case <-c.quit:
+		c.opts.Log.LogError(c, "send on closed connection")
+	case c.sendq <- data:
+	default:
+		c.opts.Log.LogError(c, "send queue full")
+	}
+}
+
+func (c *streamConn) Close() {
+	c.once.Do(func() {
+		close(c.quit)
+
+		c.lock.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.lock.Unlock()
+
+		unbindConn(c)
+	})
+}
+
+// for log ctx
+
+func (c *streamConn) Prefix() string {
+	return "[" + c.network + "]"
+}
+
+func (c *streamConn) Suffix() string {
+	return c.name + " " + c.hostport
+}
+
+func (c *streamConn) LogLevel() int {
+	return c.opts.LogLevel
+}
@@ -0,0 +1,148 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Transport Test Case
+
+package rtclib
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+var tlog = golib.NewLog("transport.log")
+
+func testTransport(name string) {
+	srvC := make(chan []byte, 1)
+	cliC := make(chan []byte, 1)
+
+	srvOpts := &TransportOpts{
+		Qsize: 16,
+		Handler: func(c golib.Conn, data []byte) {
+			srvC <- data
+			c.Send(data) // echo
+		},
+		Log: tlog,
+	}
+
+	t := GetTransport(name)
+	assert(t != nil)
+
+	l, err := t.Listen("127.0.0.1:0", srvOpts)
+	assert(err == nil)
+	defer l.Close()
+
+	go l.Serve()
+
+	cliOpts := &TransportOpts{
+		Timeout: time.Second,
+		Retry:   1,
+		Qsize:   16,
+		Handler: func(c golib.Conn, data []byte) {
+			cliC <- data
+		},
+		Log: tlog,
+	}
+
+	c := t.Dial("test", l.Addr().String(), "test", cliOpts)
+	assert(c != nil)
+	defer c.Close()
+
+	msg := []byte(`{"Type":"MESSAGE"}`)
+	c.Send(msg)
+
+	select {
+	case data := <-srvC:
+		assert(bytes.Equal(data, msg))
+	case <-time.After(time.Second):
+		assert(false)
+	}
+
+	select {
+	case data := <-cliC:
+		assert(bytes.Equal(data, msg))
+	case <-time.After(time.Second):
+		assert(false)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestTransport")
+
+	assert(GetTransport("ws") != nil)
+	assert(GetTransport("sctp") == nil)
+
+	_, err := GetTransport("ws").Listen(":0", &TransportOpts{})
+	assert(err != nil)
+
+	_, err = GetTransport("tls").Listen(":0", &TransportOpts{})
+	assert(err.Error() == "TLS config not set")
+
+	testTransport("tcp")
+	testTransport("udp")
+}
+
+func TestFrame(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestFrame")
+
+	buf := &bytes.Buffer{}
+	assert(writeFrame(buf, []byte("abc")) == nil)
+	assert(writeFrame(buf, []byte("")) == nil)
+	assert(buf.Len() == 11)
+
+	data, err := readFrame(buf)
+	assert(err == nil && string(data) == "abc")
+
+	data, err = readFrame(buf)
+	assert(err == nil && len(data) == 0)
+
+	_, err = readFrame(buf)
+	assert(err != nil)
+
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	_, err = readFrame(buf)
+	assert(err.Error() == "Frame too large")
+}
+
+func TestUDPIdle(t *testing.T) {
+	fmt.Println("!!!!!!!!!!TestUDPIdle")
+
+	srvC := make(chan []byte, 1)
+
+	srvOpts := &TransportOpts{
+		Handler: func(c golib.Conn, data []byte) {
+			srvC <- data
+		},
+		Log: tlog,
+	}
+
+	tl, err := GetTransport("udp").Listen("127.0.0.1:0", srvOpts)
+	assert(err == nil)
+	defer tl.Close()
+
+	l := tl.(*udpListener)
+	l.idle = 50 * time.Millisecond
+	go l.Serve()
+
+	c := GetTransport("udp").Dial("test", l.Addr().String(), "test",
+		&TransportOpts{Handler: func(golib.Conn, []byte) {}, Log: tlog})
+	assert(c != nil)
+	defer c.Close()
+
+	c.Send([]byte(`{"Type":"MESSAGE"}`))
+	<-srvC
+
+	l.lock.Lock()
+	assert(len(l.conns) == 1)
+	l.lock.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+
+	l.lock.Lock()
+	assert(len(l.conns) == 0)
+	l.lock.Unlock()
+}
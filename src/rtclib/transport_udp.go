@@ -0,0 +1,250 @@
+// Copyright (C) AlexWoo(Wu Jie) wj19840501@gmail.com
+//
+
+// JSIP Transport over UDP
+// every JSIP msg is sent in one datagram
+
+package rtclib
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexwoo/golib"
+)
+
+const (
+	maxDatagramSize = 65507 // max UDP payload over IPv4
+
+	// connection of peer without datagram received or sent is removed
+	udpIdleTimeout = 5 * time.Minute
+)
+
+type udpTransport struct {
+}
+
+func (t *udpTransport) Dial(name string, hostport string, userid string,
+	opts *TransportOpts) golib.Conn {
+
+	c := &udpConn{
+		name: name,
+		opts: opts,
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		opts.Log.LogError(c, "resolve %s failed, %v", hostport, err)
+		return nil
+	}
+	c.addr = raddr
+
+	sock, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		opts.Log.LogError(c, "dial %s failed, %v", hostport, err)
+		return nil
+	}
+	c.sock = sock
+
+	go c.read()
+
+	return c
+}
+
+func (t *udpTransport) Listen(addr string,
+	opts *TransportOpts) (TransportListener, error) {
+
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sock, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &udpListener{
+		sock:  sock,
+		opts:  opts,
+		idle:  udpIdleTimeout,
+		conns: make(map[string]*udpConn),
+		quit:  make(chan struct{}),
+	}, nil
+}
+
+type udpListener struct {
+	sock   *net.UDPConn
+	opts   *TransportOpts
+	idle   time.Duration
+	closed bool
+
+	lock  sync.Mutex
+	conns map[string]*udpConn
+	quit  chan struct{}
+}
+
+func (l *udpListener) conn(raddr *net.UDPAddr) *udpConn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	name := raddr.String()
+	c := l.conns[name]
+	if c == nil {
+		c = &udpConn{
+			name:     name,
+			sock:     l.sock,
+			addr:     raddr,
+			opts:     l.opts,
+			listener: l,
+		}
+		l.conns[name] = c
+	}
+	c.touch()
+
+	return c
+}
+
+// remove connections idle, sources of datagrams may be spoofed or rotating
+func (l *udpListener) reap() {
+	ticker := time.NewTicker(l.idle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.quit:
+			return
+		}
+
+		deadline := time.Now().Add(-l.idle).UnixNano()
+
+		l.lock.Lock()
+		for name, c := range l.conns {
+			if atomic.LoadInt64(&c.active) < deadline {
+				delete(l.conns, name)
+				unbindConn(c)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+func (l *udpListener) Serve() error {
+	go l.reap()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, raddr, err := l.sock.ReadFromUDP(buf)
+		if err != nil {
+			l.lock.Lock()
+			closed := l.closed
+			l.lock.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		l.opts.Handler(l.conn(raddr), data)
+	}
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.sock.LocalAddr()
+}
+
+func (l *udpListener) Close() {
+	l.lock.Lock()
+	if !l.closed {
+		close(l.quit)
+	}
+	l.closed = true
+	l.lock.Unlock()
+
+	l.sock.Close()
+}
+
+type udpConn struct {
+	name     string
+	sock     *net.UDPConn
+	addr     *net.UDPAddr
+	opts     *TransportOpts
+	listener *udpListener // nil for client connection
+	active   int64        // unix nano of last datagram received or sent
+}
+
+func (c *udpConn) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+func (c *udpConn) read() {
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, err := c.sock.Read(buf)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		c.opts.Handler(c, data)
+	}
+}
+
+func (c *udpConn) Send(data []byte) {
+	if len(data) > maxDatagramSize {
+		c.opts.Log.LogError(c, "msg too large for datagram, %d", len(data))
+		return
+	}
+
+	var err error
+	if c.listener == nil {
+		_, err = c.sock.Write(data)
+	} else {
+		c.touch()
+		_, err = c.sock.WriteToUDP(data, c.addr)
+	}
+
+	if err != nil {
+		c.opts.Log.LogError(c, "send failed, %v", err)
+	}
+}
+
+func (c *udpConn) Close() {
+	if c.listener == nil {
+		c.sock.Close()
+		return
+	}
+
+	c.listener.lock.Lock()
+	delete(c.listener.conns, c.name)
+	c.listener.lock.Unlock()
+}
+
+// for log ctx
+
+func (c *udpConn) Prefix() string {
+	return "[udp]"
+}
+
+func (c *udpConn) Suffix() string {
+	if c.addr == nil {
+		return c.name
+	}
+
+	return c.name + " " + c.addr.String()
+}
+
+func (c *udpConn) LogLevel() int {
+	return c.opts.LogLevel
+}